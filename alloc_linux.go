@@ -0,0 +1,19 @@
+//go:build linux
+
+package caskdb
+
+import (
+	"os"
+	"syscall"
+)
+
+// allocate allocates n bytes of the file from the offset on, and extends the file
+// to cover them.
+func allocate(f *os.File, offset int64, n int64) error {
+	err := syscall.Fallocate(int(f.Fd()), 0, offset, n)
+	if err == syscall.EOPNOTSUPP {
+		// not every filesystem can allocate the blocks upfront
+		return f.Truncate(offset + n)
+	}
+	return err
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package caskdb
+
+import "os"
+
+// allocate extends the file by n bytes from the offset on. Without fallocate the
+// blocks are allocated only once they are written.
+func allocate(f *os.File, offset int64, n int64) error {
+	return f.Truncate(offset + n)
+}
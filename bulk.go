@@ -0,0 +1,258 @@
+package caskdb
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// BulkLoad appends all the key value pairs which fn emits, in one go. It is meant
+// for loading a lot of data into a fresh database, where calling Set in a loop is
+// slow: every Set takes the lock, fsyncs the file and updates keyDir.
+//
+// BulkLoad takes the write lock once for the whole load, writes the records
+// through a buffer and fsyncs only at the end. The keyDir is updated in one pass
+// after all the records are written. If fn returns an error, or any write fails,
+// the file is truncated back to where it was and the keyDir is left untouched, so
+// either all of the pairs are loaded or none of them. A key emitted more than once
+// keeps its last value, unless WithBulkLoadDuplicates says otherwise.
+//
+//	err := store.BulkLoad(func(emit func(key, value string)) error {
+//		for _, book := range books {
+//			emit(book.Title, book.Author)
+//		}
+//		return nil
+//	})
+func (d *DiskStore) BulkLoad(fn func(emit func(key, value string)) error) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return ErrClosed
+	}
+	_, err := d.bulkLoad(func(emit func(r Record)) error {
+		return fn(func(key, value string) {
+			emit(Record{Key: key, Value: []byte(value)})
+		})
+	}, d.opts.bulkDuplicates)
+	return err
+}
+
+// AppendBatch appends all the records in one go, just like BulkLoad, and returns
+// the byte offset in the file of each of them, in order, like AppendRaw does for a
+// single record. This is for the users who build their own indexes while loading
+// the data, without reading it back. A key which comes up more than once keeps its
+// last value, whatever WithBulkLoadDuplicates says, and every one of its records
+// gets its offset. The offsets are valid only till the next Merge.
+//
+// A record with Tombstone set deletes its key, and the Meta of the others is
+// stored just like SetWithMeta does, so the records read with ReadRecordAt can be
+// appended as they are to another store. Their Timestamp is ignored, all the
+// records get the time of the write.
+func (d *DiskStore) AppendBatch(records []Record) ([]int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return nil, ErrClosed
+	}
+	return d.bulkLoad(func(emit func(r Record)) error {
+		for _, r := range records {
+			emit(r)
+		}
+		return nil
+	}, DuplicateLastWins)
+}
+
+// bulkLoad writes the records which fn emits, see BulkLoad, and returns the
+// offsets of the records it wrote. The caller must hold the write lock.
+func (d *DiskStore) bulkLoad(fn func(emit func(r Record)) error, duplicates DuplicatePolicy) ([]int64, error) {
+	if d.opts.readOnly {
+		return nil, ErrReadOnly
+	}
+
+	type loaded struct {
+		key       string
+		kEntry    KeyEntry
+		tombstone bool
+	}
+	var entries []loaded
+	var writeErr error
+	start := d.writePosition
+	position := start
+	timestamp := d.now().UnixNano()
+	// the records go to the file in a single write, see write
+	var buf []byte
+	// emitted has the keys emitted so far, when the policy needs them
+	var emitted map[string]bool
+	if duplicates != DuplicateLastWins {
+		emitted = make(map[string]bool)
+	}
+	emit := func(r Record) {
+		if writeErr != nil {
+			return
+		}
+		if emitted != nil {
+			if emitted[r.Key] {
+				if duplicates == DuplicateFail {
+					writeErr = fmt.Errorf("%w: %q", ErrDuplicateKey, r.Key)
+				}
+				return
+			}
+			emitted[r.Key] = true
+		}
+		value := string(r.Value)
+		var data []byte
+		if r.Tombstone {
+			_, data = encodeTombstone(timestamp, r.Key)
+		} else {
+			if writeErr = d.validate(r.Key, value); writeErr != nil {
+				return
+			}
+			if len(r.Meta) > maxMetaSize {
+				writeErr = fmt.Errorf("caskdb: the metadata of the key %q takes %d bytes, more than %d", r.Key, len(r.Meta), maxMetaSize)
+				return
+			}
+			var ext extension
+			if len(r.Meta) > 0 {
+				ext.meta = r.Meta
+			}
+			_, data = encodeExtendedKV(timestamp, r.Key, value, ext)
+		}
+		data = alignRecord(data, int64(position), d.opts.alignment)
+		size := len(data)
+		buf = append(buf, data...)
+		entries = append(entries, loaded{r.Key, d.newKeyEntry(timestamp, position, size, value), r.Tombstone})
+		position += size
+	}
+	err := fn(emit)
+	if err == nil {
+		err = writeErr
+	}
+	if err == nil && d.opts.maxRecordCount > 0 {
+		// whether every key is there once the load is done
+		live := make(map[string]bool)
+		for _, e := range entries {
+			live[e.key] = !e.tombstone
+		}
+		newKeys := 0
+		for key, isLive := range live {
+			_, exists := d.keyDir[key]
+			switch {
+			case isLive && !exists:
+				newKeys++
+			case !isLive && exists:
+				newKeys--
+			}
+		}
+		err = d.checkRecordLimit(newKeys)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) == 0 {
+		return nil, nil
+	}
+	if err := d.write(buf); err != nil {
+		// throw away whatever made it to the file, the records of a failed fsync
+		// included
+		if rollbackErr := d.rollback(); rollbackErr != nil {
+			return nil, rollbackErr
+		}
+		return nil, err
+	}
+
+	offsets := make([]int64, len(entries))
+	for i, e := range entries {
+		if e.tombstone {
+			d.removeKey(e.key)
+		} else {
+			d.putKey(e.key, e.kEntry)
+		}
+		offsets[i] = int64(e.kEntry.position)
+	}
+	d.writePosition = position
+	if int64(position) > d.allocated {
+		d.allocated = int64(position)
+	}
+	d.maybeRemap()
+	return offsets, nil
+}
+
+// ReplaceAll replaces the whole dataset with kv: afterwards the store holds
+// exactly the pairs of kv, and every other key is gone. The pairs are written
+// to a new file with a `.replace` suffix, which is synced and then renamed over
+// the old one, just like Merge does. The readers never see a partial dataset. Till
+// ReplaceAll returns they see the old data, and afterwards the new data. If
+// anything fails, the old data is left as it was.
+//
+// This suits the datasets which are shipped as a whole, like configs, better than
+// deleting every key and loading the new ones. The pairs are written in the order
+// of their keys.
+func (d *DiskStore) ReplaceAll(kv map[string]string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return ErrClosed
+	}
+	if d.opts.readOnly {
+		return ErrReadOnly
+	}
+	if d.opts.baseOffset > 0 {
+		return ErrBaseOffset
+	}
+	if d.opts.maxRecordCount > 0 && len(kv) > d.opts.maxRecordCount {
+		return ErrRecordLimit
+	}
+
+	keys := make([]string, 0, len(kv))
+	for key, value := range kv {
+		if err := d.validate(key, value); err != nil {
+			return err
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	replaceFileName := d.fileName + ".replace"
+	replaceFile, err := os.OpenFile(replaceFileName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	cleanup := func(err error) error {
+		replaceFile.Close()
+		os.Remove(replaceFileName)
+		return err
+	}
+	writer := bufio.NewWriter(replaceFile)
+	header := append(encodeFileHeader(formatVersion), alignmentFiller(d.opts.alignment)...)
+	if _, err := writer.Write(header); err != nil {
+		return cleanup(err)
+	}
+	entries := make([]KeyEntry, len(keys))
+	position := len(header)
+	timestamp := d.now().UnixNano()
+	for i, key := range keys {
+		_, data := encodeKV(timestamp, key, kv[key])
+		data = alignRecord(data, int64(position), d.opts.alignment)
+		if _, err := writer.Write(data); err != nil {
+			return cleanup(err)
+		}
+		entries[i] = d.newKeyEntry(timestamp, position, len(data), kv[key])
+		position += len(data)
+	}
+	if err := writer.Flush(); err != nil {
+		return cleanup(err)
+	}
+	if err := replaceFile.Sync(); err != nil {
+		return cleanup(err)
+	}
+	if err := replaceFile.Close(); err != nil {
+		return cleanup(err)
+	}
+	if err := d.replaceFile(replaceFileName, make(map[string]KeyEntry, len(keys)), position); err != nil {
+		return err
+	}
+	for i, key := range keys {
+		d.putKey(key, entries[i])
+	}
+	return nil
+}
@@ -0,0 +1,266 @@
+package caskdb
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestDiskStore_BulkLoad(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+
+	tests := map[string]string{
+		"crime and punishment": "dostoevsky",
+		"anna karenina":        "tolstoy",
+		"war and peace":        "tolstoy",
+		"hamlet":               "shakespeare",
+	}
+	err = store.BulkLoad(func(emit func(key, value string)) error {
+		for key, val := range tests {
+			emit(key, val)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("BulkLoad() error = %v", err)
+	}
+	for key, val := range tests {
+		if got, _ := store.Get(key); got != val {
+			t.Errorf("Get() = %v, want %v", got, val)
+		}
+	}
+	// the records written after the load go after the loaded ones
+	store.Set("dune", "frank herbert")
+	store.Close()
+
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	tests["dune"] = "frank herbert"
+	for key, val := range tests {
+		if got, _ := store.Get(key); got != val {
+			t.Errorf("Get() = %v, want %v", got, val)
+		}
+	}
+	store.Close()
+}
+
+func TestDiskStore_BulkLoadError(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	store.Set("dune", "frank herbert")
+	size := fileSize(t, "test.db")
+	loadErr := errors.New("source went away")
+	err = store.BulkLoad(func(emit func(key, value string)) error {
+		emit("hamlet", "shakespeare")
+		return loadErr
+	})
+	if !errors.Is(err, loadErr) {
+		t.Errorf("BulkLoad() error = %v, want %v", err, loadErr)
+	}
+	if val, _ := store.Get("hamlet"); val != "" {
+		t.Errorf("Get() = %v, want '' (empty)", val)
+	}
+	if got := fileSize(t, "test.db"); got != size {
+		t.Errorf("file size = %v, want %v", got, size)
+	}
+}
+
+func TestDiskStore_BulkLoadFailedWrite(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	store.Set("dune", "frank herbert")
+	size := fileSize(t, "test.db")
+	load := func(emit func(key, value string)) error {
+		emit("othello", "shakespeare")
+		emit("hamlet", "shakespeare")
+		return nil
+	}
+	// the disk takes the first few bytes of the records, and then it is full
+	store.writeHook = func(p []byte) (int, error) {
+		written, err := store.file.Write(p[:10])
+		if err == nil {
+			err = &os.PathError{Op: "write", Path: "test.db", Err: syscall.ENOSPC}
+		}
+		return written, err
+	}
+	if err := store.BulkLoad(load); !errors.Is(err, ErrDiskFull) {
+		t.Errorf("BulkLoad() error = %v, want %v", err, ErrDiskFull)
+	}
+	if got := fileSize(t, "test.db"); got != size {
+		t.Errorf("file size after the failed write = %v, want %v", got, size)
+	}
+	store.writeHook = nil
+
+	// a failed fsync cuts the records off as well, and it sticks
+	failed := errors.New("fsync failed")
+	store.syncHook = func() error {
+		return failed
+	}
+	if err := store.BulkLoad(load); !errors.Is(err, failed) {
+		t.Errorf("BulkLoad() error = %v, want %v", err, failed)
+	}
+	if got := fileSize(t, "test.db"); got != size {
+		t.Errorf("file size after the failed fsync = %v, want %v", got, size)
+	}
+	store.syncHook = nil
+	if err := store.BulkLoad(load); !errors.Is(err, failed) {
+		t.Errorf("BulkLoad() after a failed fsync error = %v, want %v", err, failed)
+	}
+	for _, key := range []string{"othello", "hamlet"} {
+		if _, err := store.Get(key); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Get() error = %v, want %v", err, ErrKeyNotFound)
+		}
+	}
+}
+
+func TestDiskStore_ReplaceAll(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+
+	store.Set("othello", "marlowe")
+	store.Set("dune", "frank herbert")
+	if err := store.ReplaceAll(map[string]string{"othello": "shakespeare", "hamlet": "shakespeare"}); err != nil {
+		t.Fatalf("ReplaceAll() error = %v", err)
+	}
+	if _, err := os.Stat("test.db.replace"); !os.IsNotExist(err) {
+		t.Errorf("the new file is left behind: %v", err)
+	}
+	if keys := store.Stats().Keys; keys != 2 {
+		t.Errorf("Stats().Keys = %v, want %v", keys, 2)
+	}
+	store.Close()
+
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	tests := map[string]string{"othello": "shakespeare", "hamlet": "shakespeare", "dune": ""}
+	for key, val := range tests {
+		if got, _ := store.Get(key); got != val {
+			t.Errorf("Get() = %v, want %v", got, val)
+		}
+	}
+}
+
+func TestDiskStore_BulkLoadDuplicates(t *testing.T) {
+	load := func(emit func(key, value string)) error {
+		emit("hamlet", "shakespeare")
+		emit("dune", "frank herbert")
+		emit("hamlet", "unknown")
+		return nil
+	}
+	tests := []struct {
+		policy  DuplicatePolicy
+		want    string
+		wantErr error
+	}{
+		{DuplicateLastWins, "unknown", nil},
+		{DuplicateFirstWins, "shakespeare", nil},
+		{DuplicateFail, "", ErrDuplicateKey},
+	}
+	for _, tt := range tests {
+		store, err := NewDiskStore("test.db", WithBulkLoadDuplicates(tt.policy))
+		if err != nil {
+			t.Fatalf("failed to create disk store: %v", err)
+		}
+		if err := store.BulkLoad(load); !errors.Is(err, tt.wantErr) {
+			t.Errorf("BulkLoad() with policy %d error = %v, want %v", tt.policy, err, tt.wantErr)
+		}
+		if got, _ := store.Get("hamlet"); got != tt.want {
+			t.Errorf("Get() with policy %d = %v, want %v", tt.policy, got, tt.want)
+		}
+		store.Close()
+		os.Remove("test.db")
+	}
+}
+
+func TestDiskStore_AppendBatch(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	store.Set("dune", "frank herbert")
+	records := []Record{
+		{Key: "othello", Value: []byte("shakespeare")},
+		{Key: "hamlet", Value: []byte("shakespeare")},
+		{Key: "othello", Value: []byte("marlowe")},
+	}
+	offsets, err := store.AppendBatch(records)
+	if err != nil {
+		t.Fatalf("AppendBatch() error = %v", err)
+	}
+	if len(offsets) != len(records) {
+		t.Fatalf("AppendBatch() returned %d offsets, want %d", len(offsets), len(records))
+	}
+	for i, r := range records {
+		key, value, err := store.GetAtOffset(offsets[i])
+		if err != nil || key != r.Key || value != string(r.Value) {
+			t.Errorf("GetAtOffset(%d) = %v, %v, %v, want %v, %v", offsets[i], key, value, err, r.Key, string(r.Value))
+		}
+	}
+	if got, _ := store.Get("othello"); got != "marlowe" {
+		t.Errorf("Get() = %v, want marlowe", got)
+	}
+	if got := int64(store.keyDir["othello"].position); got != offsets[2] {
+		t.Errorf("keyDir position = %d, want %d", got, offsets[2])
+	}
+}
+
+func TestDiskStore_AppendBatchRecords(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	store.Set("dune", "frank herbert")
+	records := []Record{
+		{Key: "othello", Value: []byte("shakespeare"), Meta: []byte("text/plain")},
+		{Key: "dune", Tombstone: true},
+	}
+	offsets, err := store.AppendBatch(records)
+	if err != nil {
+		t.Fatalf("AppendBatch() error = %v", err)
+	}
+	if _, err := store.Get("dune"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Get() error = %v, want %v", err, ErrKeyNotFound)
+	}
+	if _, meta, _ := store.GetWithMetadata("othello"); string(meta) != "text/plain" {
+		t.Errorf("GetWithMetadata() meta = %q, want text/plain", meta)
+	}
+	// the records read back are the ones appended, with their timestamps
+	for i, want := range records {
+		got, _, err := store.ReadRecordAt(offsets[i])
+		if err != nil {
+			t.Fatalf("ReadRecordAt() error = %v", err)
+		}
+		if got.Key != want.Key || string(got.Value) != string(want.Value) || got.Tombstone != want.Tombstone || string(got.Meta) != string(want.Meta) || got.Timestamp == 0 {
+			t.Errorf("ReadRecordAt() = %+v, want %+v", got, want)
+		}
+	}
+}
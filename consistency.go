@@ -0,0 +1,85 @@
+package caskdb
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Inconsistency is an entry of the keyDir which does not agree with the file, as
+// found by CheckConsistency.
+type Inconsistency struct {
+	// Key is the key of the entry
+	Key string
+	// Offset is the position of the record the entry points at
+	Offset int64
+	// Reason describes what is wrong with the record
+	Reason string
+}
+
+func (i Inconsistency) String() string {
+	return fmt.Sprintf("key %q at offset %d: %s", i.Key, i.Offset, i.Reason)
+}
+
+// CheckConsistency reads the record of every entry of the keyDir, and checks
+// that it is intact and that it really is the record the entry describes: its
+// key, its size and its timestamp must all match the entry, and it must not be a
+// tombstone. Every mismatch is reported, in the order of the offsets. An empty
+// list means the keyDir describes the file faithfully. This is what to run after
+// a suspected bug or a crash, before trusting the store again. If the keyDir is
+// wrong, RebuildIndex builds it again from the file.
+//
+// The errors of the disk itself stop the check and are returned. The check reads
+// every live record, and holds the read lock while it runs.
+func (d *DiskStore) CheckConsistency() ([]Inconsistency, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return nil, ErrClosed
+	}
+	if d.opts.noIndex {
+		return nil, ErrNoIndex
+	}
+	keys := make([]string, 0, len(d.keyDir))
+	for key := range d.keyDir {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return d.keyDir[keys[i]].position < d.keyDir[keys[j]].position })
+
+	var found []Inconsistency
+	file := d.scanReader()
+	for _, key := range keys {
+		kEntry := d.keyDir[key]
+		report := func(format string, args ...interface{}) {
+			found = append(found, Inconsistency{Key: key, Offset: int64(kEntry.position), Reason: fmt.Sprintf(format, args...)})
+		}
+		record, err := d.readRecordFrom(file, int64(kEntry.position))
+		var timestamp int64
+		var recordKey, value string
+		if err == nil {
+			timestamp, recordKey, value, err = decodeKV(record)
+		}
+		if errors.Is(err, ErrCorruptRecord) {
+			report("%v", err)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case recordKey != key:
+			report("the record is of the key %q", recordKey)
+		case len(record) != int(kEntry.totalSize):
+			report("the record takes %d bytes, not %d", len(record), kEntry.totalSize)
+		case timestamp != kEntry.timestamp:
+			report("the record has the timestamp %d, not %d", timestamp, kEntry.timestamp)
+		case isTombstone(record):
+			report("the record is a tombstone")
+		case recordExpiry(record) != kEntry.expireAt:
+			report("the record expires at %d, not at %d", recordExpiry(record), kEntry.expireAt)
+		case kEntry.value != nil && string(kEntry.value) != value:
+			report("the inline copy of the value differs from the record")
+		}
+	}
+	return found, nil
+}
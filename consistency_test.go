@@ -0,0 +1,35 @@
+package caskdb
+
+import (
+	"os"
+	"testing"
+)
+
+func TestDiskStore_CheckConsistency(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	store.Set("othello", "shakespeare")
+	store.Set("dune", "frank herbert")
+	store.Set("hamlet", "shakespeare")
+	if found, err := store.CheckConsistency(); err != nil || len(found) != 0 {
+		t.Fatalf("CheckConsistency() = %v, %v, want no inconsistencies", found, err)
+	}
+
+	// point dune at the record of othello, and make the timestamp of hamlet wrong
+	othello, dune, hamlet := store.keyDir["othello"], store.keyDir["dune"], store.keyDir["hamlet"]
+	dune.position = othello.position
+	hamlet.timestamp++
+	store.keyDir["dune"], store.keyDir["hamlet"] = dune, hamlet
+	found, err := store.CheckConsistency()
+	if err != nil {
+		t.Fatalf("CheckConsistency() error = %v", err)
+	}
+	if len(found) != 2 || found[0].Key != "dune" || found[1].Key != "hamlet" {
+		t.Errorf("CheckConsistency() = %v, want dune and hamlet", found)
+	}
+}
@@ -0,0 +1,46 @@
+package caskdb
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// createSuffix is the suffix of the temporary file which WithAtomicCreate writes
+// the new database to.
+const createSuffix = ".create"
+
+// createAtomically creates the database file with just its header, unless the
+// file exists already, see WithAtomicCreate. It reports whether it created the
+// file.
+func createAtomically(fileName string, alignment int) (bool, error) {
+	if _, err := os.Stat(fileName); err == nil || !errors.Is(err, fs.ErrNotExist) {
+		return false, err
+	}
+	tmpName := fileName + createSuffix
+	tmp, err := os.OpenFile(tmpName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return false, err
+	}
+	cleanup := func(err error) (bool, error) {
+		tmp.Close()
+		os.Remove(tmpName)
+		return false, err
+	}
+	header := append(encodeFileHeader(formatVersion), alignmentFiller(alignment)...)
+	if _, err := tmp.Write(header); err != nil {
+		return cleanup(err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return cleanup(err)
+	}
+	if err := tmp.Close(); err != nil {
+		return cleanup(err)
+	}
+	if err := os.Rename(tmpName, fileName); err != nil {
+		os.Remove(tmpName)
+		return false, err
+	}
+	return true, syncDir(filepath.Dir(fileName))
+}
@@ -0,0 +1,9 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package caskdb
+
+// syncDir does nothing on this platform, where the directories cannot be opened
+// for fsync.
+func syncDir(dir string) error {
+	return nil
+}
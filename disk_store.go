@@ -1,11 +1,19 @@
 package caskdb
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
-	"io/fs"
+	"log"
 	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -21,6 +29,15 @@ import (
 // https://pkg.go.dev/os#File.Seek
 const defaultWhence = 0
 
+// mmapRemapSize is the number of bytes which can be appended after the last mmap
+// call before we map the file again. Records in this tail are read using ReadAt.
+const mmapRemapSize = 4 * 1024 * 1024
+
+// estimatedRecordSize is the average size of a record we assume, when we guess the
+// number of keys in a file from its size. The guess is on the lower side, since
+// the file also has the stale records which are not in the keyDir.
+const estimatedRecordSize = 128
+
 // DiskStore is a Log-Structured Hash Table as described in the BitCask paper. We
 // keep appending the data to a file, like a log. DiskStorage maintains an in-memory
 // hash table called KeyDir, which keeps the row's location on the disk.
@@ -60,8 +77,13 @@ const defaultWhence = 0
 //
 //		store, _ := NewDiskStore("books.db")
 //	   	store.Set("othello", "shakespeare")
-//	   	author := store.Get("othello")
+//	   	author, _ := store.Get("othello")
 type DiskStore struct {
+	// mu guards every field below. Reads take the read lock, anything which writes
+	// to the file or mutates keyDir takes the write lock
+	mu sync.RWMutex
+	// fileName is the path of the data file, Merge replaces the file at this path
+	fileName string
 	// file object pointing the file_name
 	file *os.File
 	// current cursor position in the file where the data can be written
@@ -70,140 +92,1479 @@ type DiskStore struct {
 	// of the byte offset in the file where the value exists. key_dir map acts as in-memory
 	// index to fetch the values quickly from the disk
 	keyDir map[string]KeyEntry
+	// opts are the options which the store was created with
+	opts options
+	// mmapped is the read only mapping of the file, from the beginning till the
+	// writePosition at the time of the mapping. It is nil unless WithMmap is used
+	mmapped []byte
+	// unsynced is set when there are writes which are not fsynced yet. It is only
+	// used with WithGroupCommit or WithSyncEveryN
+	unsynced atomic.Bool
+	// syncErr is the error of the first fsync of the file which failed, which
+	// every fsync after it returns again, see fsync. syncMu guards it
+	syncMu  sync.Mutex
+	syncErr error
+	// valueSizes is the histogram of the sizes of the live values, see Stats. It
+	// is kept up to date by putKey and removeKey
+	valueSizes [valueSizeBuckets]int
+	// indexMemory is the estimate of the memory keyDir takes, see
+	// WithMaxIndexMemory. It is kept up to date by putKey and removeKey
+	indexMemory int64
+	// liveBytes is the size of the records keyDir points at, kept up to date by
+	// putKey and removeKey, and bytesWritten the bytes written to the file since
+	// it was opened, on top of the ones it had, see WriteAmplification
+	liveBytes    int64
+	bytesWritten int64
+	// writeHook replaces the writes of the records to the file when it is set,
+	// which lets the tests fake a disk which fails half way through a write
+	writeHook func(p []byte) (int, error)
+	// syncHook replaces the fsyncs of the file when it is set, for the tests to
+	// fake a failed fsync
+	syncHook func() error
+	// compactHook is called before every move of InPlaceCompact when it is set, for
+	// the tests to fail the moves half way, see runCompactPlan
+	compactHook func(recovering bool) error
+	// openHook is called before replaceFile opens a data file when it is set, and
+	// the open fails with its error, for the tests to fail the swap of the files
+	openHook func(name string) error
+	// evicted are the keys evicted for WithMaxIndexMemory while the write lock is
+	// held, for unlockAndNotify to hand over to WithOnEvict
+	evicted []string
+	// lastTimestamp is the newest timestamp loaded so far, and outOfOrder is the
+	// number of records older than it, see WithAppendOnlyVerify
+	lastTimestamp int64
+	outOfOrder    int
+	// lastAccess is the time of the last read or write of every key, in unix
+	// nanoseconds, with WithAccessTracking. The map itself is guarded by mu, while
+	// the times are updated by Get with just the read lock
+	lastAccess map[string]*atomic.Int64
+	// allocated is the size of the file with WithPreallocate, which is at least the
+	// writePosition
+	allocated int64
+	// created is set when the store created the file, rather than opening an
+	// existing one
+	created bool
+	// startupDeadline is when NewDiskStore gives up loading the file, or zero, see
+	// WithMaxStartupDuration
+	startupDeadline time.Time
+	// generation is bumped every time the data file is replaced or moved around,
+	// which tells the index flush that its snapshot is of the old file
+	generation uint64
+	// readers are the extra read only descriptors of the file, see WithReaderPool,
+	// and nextReader picks the one for the next read
+	readers    []*os.File
+	nextReader atomic.Uint32
+	// writeCount is the number of writes since the last sync, with WithSyncEveryN
+	writeCount atomic.Int64
+	// closed is set once the file has been closed, so that Close and Shutdown
+	// can be called more than once, and the other methods return ErrClosed
+	closed bool
+	// done is closed by Shutdown to tell the background goroutines to stop and
+	// wg is used to wait till all of them have returned
+	done     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
 }
 
-func isFileExists(fileName string) bool {
-	// https://stackoverflow.com/a/12518877
-	if _, err := os.Stat(fileName); err == nil || errors.Is(err, fs.ErrExist) {
-		return true
+// checkBaseOffset makes sure that WithBaseOffset is not combined with any of the
+// options which assume the store has the file to itself.
+func (d *DiskStore) checkBaseOffset() error {
+	if d.opts.baseOffset == 0 {
+		return nil
+	}
+	if d.opts.baseOffset < 0 {
+		return fmt.Errorf("caskdb: the base offset %d is negative", d.opts.baseOffset)
+	}
+	conflicts := []struct {
+		set  bool
+		name string
+	}{
+		{d.opts.mmap, "WithMmap"},
+		{d.opts.preallocate > 0, "WithPreallocate"},
+		{d.opts.indexFlush > 0, "WithPeriodicIndexFlush"},
+		{d.opts.readOnly, "WithReplicaMode"},
+		{d.opts.atomicCreate, "WithAtomicCreate"},
+	}
+	for _, c := range conflicts {
+		if c.set {
+			return fmt.Errorf("caskdb: WithBaseOffset cannot be used with %s", c.name)
+		}
 	}
-	return false
+	return nil
 }
 
-func NewDiskStore(fileName string) (*DiskStore, error) {
-	ds := &DiskStore{keyDir: make(map[string]KeyEntry)}
-	// if the file exists already, then we will load the key_dir
-	if isFileExists(fileName) {
-		ds.initKeyDir(fileName)
-	}
+// startupCheckInterval is the number of records loaded between two checks of
+// WithMaxStartupDuration.
+const startupCheckInterval = 4096
+
+// estimateKeyCount guesses how many keys a file of the given size holds.
+func estimateKeyCount(fileSize int64) int {
+	return int((fileSize - fileHeaderSize) / estimatedRecordSize)
+}
+
+func NewDiskStore(fileName string, opts ...Option) (*DiskStore, error) {
 	// we open the file in following modes:
 	//	os.O_APPEND - says that the writes are append only.
 	// 	os.O_RDWR - says we can read and write to the file
 	// 	os.O_CREATE - creates the file if it does not exist
-	file, err := os.OpenFile(fileName, os.O_APPEND|os.O_RDWR|os.O_CREATE, 0666)
+	flag := os.O_APPEND | os.O_RDWR | os.O_CREATE
+	o := applyOptions(opts)
+	if o.readOnly {
+		// a replica never writes, and the file belongs to the leader which creates it
+		flag = os.O_RDONLY
+	}
+	created := false
+	if o.atomicCreate && !o.readOnly {
+		var err error
+		if created, err = createAtomically(fileName, o.alignment); err != nil {
+			return nil, err
+		}
+	}
+	if o.preallocate > 0 && !o.readOnly && !o.noIndex {
+		// the file is longer than the data, and the writes must go at the end of
+		// the data, see WithPreallocate
+		flag &^= os.O_APPEND
+	}
+	file, err := os.OpenFile(fileName, flag, 0666)
+	if err != nil {
+		return nil, err
+	}
+	ds, err := NewDiskStoreFromFile(file, opts...)
 	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	ds.created = ds.created || created
+	return ds, nil
+}
+
+// NewDiskStoreFromFile creates the store on top of a file which is already open,
+// for example a temporary file or a file managed by some other code. The file
+// must be opened for both reading and writing, preferably in the append mode just
+// like NewDiskStore does:
+//
+//	file, _ := os.OpenFile("books.db", os.O_APPEND|os.O_RDWR|os.O_CREATE, 0666)
+//	store, _ := NewDiskStoreFromFile(file)
+//
+// The store takes over the file and closes it on Close. If the file is not empty,
+// its keyDir is loaded just like NewDiskStore. Merge replaces the file at the path
+// of file.Name(), so it works only when the file has a real path. With
+// WithReplicaMode, the file only needs to be opened for reading.
+func NewDiskStoreFromFile(file *os.File, opts ...Option) (*DiskStore, error) {
+	ds := &DiskStore{fileName: file.Name(), file: file, done: make(chan struct{})}
+	for _, opt := range opts {
+		opt(&ds.opts)
+	}
+	if ds.opts.name == "" {
+		ds.opts.name = filepath.Base(ds.fileName)
+	}
+	if ds.opts.readOnly || ds.opts.noIndex {
+		ds.opts.preallocate = 0
+	}
+	if err := ds.checkBaseOffset(); err != nil {
+		return nil, err
+	}
+	ds.keyDir = make(map[string]KeyEntry, ds.opts.initialMapCapacity)
+	if ds.opts.accessTracking {
+		ds.lastAccess = make(map[string]*atomic.Int64)
+	}
+	// a crash in the middle of InPlaceCompact leaves the file half compacted, which
+	// has to be fixed before we can read it
+	if !ds.opts.readOnly {
+		if err := ds.recoverInPlaceCompact(); err != nil {
+			return nil, err
+		}
+	}
+	// if the file has data already, then we will load the key_dir
+	if ds.opts.maxStartup > 0 {
+		ds.startupDeadline = ds.now().Add(ds.opts.maxStartup)
+	}
+	if err := ds.initKeyDir(); err != nil {
+		return nil, err
+	}
+	ds.startupDeadline = time.Time{}
+	ds.bytesWritten = int64(ds.writePosition)
+	if ds.opts.readOnly {
+		// a replica must not touch the file, what looks like a torn tail might
+		// just be a record which the leader is still writing
+		if ds.opts.mmap {
+			_ = ds.remap()
+		}
+		if err := ds.openReaders(); err != nil {
+			return nil, err
+		}
+		ds.goBackground(ds.replicaLoop)
+		return ds, nil
+	}
+	if ds.writePosition == 0 {
+		// a brand new file, which needs the file header before the first record
+		header := append(encodeFileHeader(formatVersion), alignmentFiller(ds.opts.alignment)...)
+		if _, err := file.Write(header); err != nil {
+			return nil, err
+		}
+		if err := file.Sync(); err != nil {
+			return nil, err
+		}
+		if err := ds.syncDir(); err != nil {
+			return nil, err
+		}
+		ds.writePosition = len(header)
+		ds.bytesWritten = int64(len(header))
+		ds.created = true
+	}
+	// if the scan stopped at a torn tail, we cut it off. Otherwise the new records
+	// would get appended after the garbage and their positions would be wrong
+	if info, err := file.Stat(); err != nil {
+		return nil, err
+	} else if end := ds.opts.baseOffset + int64(ds.writePosition); info.Size() > end {
+		if err := file.Truncate(end); err != nil {
+			return nil, err
+		}
+	}
+	// the writes go at the cursor when the file was not opened in the append mode,
+	// so we move it to the end where the next record belongs
+	if _, err := file.Seek(ds.opts.baseOffset+int64(ds.writePosition), io.SeekStart); err != nil {
+		return nil, err
+	}
+	ds.allocated = int64(ds.writePosition)
+	if ds.opts.mmap {
+		// if the mapping fails, reads simply fall back to ReadAt
+		_ = ds.remap()
+	}
+	if err := ds.openReaders(); err != nil {
 		return nil, err
 	}
-	ds.file = file
+	if ds.opts.groupCommit > 0 {
+		ds.goBackground(ds.groupCommitLoop)
+	}
+	if ds.opts.indexFlush > 0 && !ds.opts.noIndex {
+		ds.goBackground(ds.indexFlushLoop)
+	}
 	return ds, nil
 }
 
-func (d *DiskStore) Get(key string) string {
+func (d *DiskStore) Get(key string) (string, error) {
 	// Get retrieves the value from the disk and returns. If the key does not
-	// exist then it returns an empty string
+	// exist then it returns ErrKeyNotFound. If the record on the disk is damaged,
+	// it returns an error wrapping ErrCorruptRecord, and any other error comes from
+	// reading the file
 	//
 	// How get works?
 	//	1. Check if there is any KeyEntry record for the key in keyDir
-	//	2. Return an empty string if key doesn't exist
+	//	2. Return ErrKeyNotFound if key doesn't exist
 	//	3. If it exists, then read KeyEntry.totalSize bytes starting from the
 	//     KeyEntry.position from the disk
 	//	4. Decode the bytes into valid KV pair and return the value
 	//
-	kEntry, ok := d.keyDir[key]
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return "", ErrClosed
+	}
+	if d.opts.noIndex {
+		return "", ErrNoIndex
+	}
+	kEntry, ok := d.lookup(key)
+	if !ok {
+		return "", ErrKeyNotFound
+	}
+	d.touch(key)
+	return d.readValue(key, kEntry)
+}
+
+// GetUncached is Get, which always reads the value from the record on the disk,
+// even if the store keeps a copy of it in the memory, see WithInlineValues. It lets
+// the callers confirm what the file holds when they suspect the copy is stale,
+// which tells a bug of the copy apart from a damaged record. CheckConsistency goes
+// to the disk in the same way, and compares the copies with the records.
+func (d *DiskStore) GetUncached(key string) (string, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return "", ErrClosed
+	}
+	if d.opts.noIndex {
+		return "", ErrNoIndex
+	}
+	kEntry, ok := d.lookup(key)
 	if !ok {
-		return ""
+		return "", ErrKeyNotFound
+	}
+	d.touch(key)
+	data, err := d.readEntry(key, kEntry)
+	if err != nil {
+		return "", err
+	}
+	_, _, value, err := decodeKV(data)
+	return value, err
+}
+
+// Created reports whether the store created a new database when it was opened,
+// rather than opening an existing one. This lets the callers seed a new database
+// exactly once, without checking whether the file exists before opening it, which
+// would race with other processes. A file which exists but is empty counts as a
+// new database too, since it has not even got its file header yet.
+func (d *DiskStore) Created() bool {
+	return d.created
+}
+
+// GetWithTimeout is Get, which gives up after timeout and returns
+// context.DeadlineExceeded. This bounds the latency of a lookup on a degraded
+// disk, where a single read can hang for seconds. The read itself cannot be
+// cancelled, it goes on in the background and its result is thrown away.
+func (d *DiskStore) GetWithTimeout(key string, timeout time.Duration) (string, error) {
+	type result struct {
+		value string
+		err   error
+	}
+	// the channel is buffered, so that the straggler can always deliver its result
+	// and exit, even after we stopped waiting for it
+	done := make(chan result, 1)
+	go func() {
+		value, err := d.Get(key)
+		done <- result{value, err}
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.value, r.err
+	case <-timer.C:
+		return "", context.DeadlineExceeded
 	}
-	// move the current pointer to the right offset
-	// TODO: handle errors
-	d.file.Seek(int64(kEntry.position), defaultWhence)
-	data := make([]byte, kEntry.totalSize)
-	// TODO: handle errors
-	_, err := io.ReadFull(d.file, data)
+}
+
+// Result is the outcome of looking up a single key with GetMany.
+type Result struct {
+	// Value is the value of the key, empty if the key was not found
+	Value string
+	// Found reports whether the key exists in the store
+	Found bool
+}
+
+// GetMany looks up all the keys under a single read lock, so the results are
+// consistent with each other, i.e. no write lands in between two of the lookups.
+// The results are in the same order as the keys, out[i] being the result for
+// keys[i]. The keys which do not exist are not an error, their result just has
+// Found set to false. If reading any of the values fails, GetMany returns the
+// error and no results.
+func (d *DiskStore) GetMany(keys []string) ([]Result, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return nil, ErrClosed
+	}
+	if d.opts.noIndex {
+		return nil, ErrNoIndex
+	}
+	out := make([]Result, len(keys))
+	for i, key := range keys {
+		kEntry, ok := d.lookup(key)
+		if !ok {
+			continue
+		}
+		d.touch(key)
+		value, err := d.readValue(key, kEntry)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = Result{Value: value, Found: true}
+	}
+	return out, nil
+}
+
+// AppendRaw stores the key and value just like Set, and returns the byte offset
+// in the file at which the record was written. This is for the users who build
+// their own indexes pointing into the file. Note that Merge rewrites the file, so
+// the offsets are valid only till the next Merge.
+func (d *DiskStore) AppendRaw(key string, value string) (offset int64, err error) {
+	d.mu.Lock()
+	defer d.unlockAndNotify()
+	if d.closed {
+		return 0, ErrClosed
+	}
+	offset = int64(d.writePosition)
+	if err := d.set(key, value); err != nil {
+		return 0, err
+	}
+	return offset, nil
+}
+
+// ReadRecordAt decodes the record which starts at the offset in the file, whether
+// or not it is the latest record of its key, and returns the offset of the record
+// which follows it. Starting at the offset of the first record and following next
+// till it reaches the end of the file walks through the whole log, which is the
+// building block for dumps, change feeds and repair tools.
+//
+// The checksum of the record is verified. If the offset is not the start of a
+// record, ReadRecordAt returns ErrCorruptRecord. A transaction, see Txn, is a
+// single record with an empty key, whose value holds the records of its writes.
+func (d *DiskStore) ReadRecordAt(offset int64) (r Record, next int64, err error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return Record{}, 0, ErrClosed
+	}
+	record, err := d.readRecordAt(offset)
+	if err != nil {
+		return Record{}, 0, err
+	}
+	r, err = decodeRecord(record)
 	if err != nil {
-		panic("read error")
+		return Record{}, 0, err
 	}
-	_, _, value := decodeKV(data)
-	return value
+	return r, offset + int64(len(record)), nil
 }
 
-func (d *DiskStore) Set(key string, value string) {
-	// Set stores the key and value on the disk
+// GetAtOffset returns the key and the value of the record at the offset, like
+// the ones returned by AppendRaw, even if the key has been overwritten since. It is
+// a shorthand for ReadRecordAt, for the tools looking at the older values of a key.
+// If the record is a tombstone, GetAtOffset returns its key along with
+// ErrKeyNotFound.
+func (d *DiskStore) GetAtOffset(offset int64) (key string, value string, err error) {
+	r, _, err := d.ReadRecordAt(offset)
+	if err != nil {
+		return "", "", err
+	}
+	if r.Tombstone {
+		return r.Key, "", ErrKeyNotFound
+	}
+	return r.Key, string(r.Value), nil
+}
+
+// Swap stores the value for the key, just like Set, and returns the value which
+// the key held before. existed is false when the key was not present. Both the
+// read and the write happen under the same lock, so no other writer can sneak in
+// between them.
+func (d *DiskStore) Swap(key string, value string) (old string, existed bool, err error) {
+	d.mu.Lock()
+	defer d.unlockAndNotify()
+	if d.closed {
+		return "", false, ErrClosed
+	}
+	if d.opts.noIndex {
+		return "", false, ErrNoIndex
+	}
+	kEntry, existed := d.lookup(key)
+	if existed {
+		if old, err = d.readValue(key, kEntry); err != nil {
+			return "", false, err
+		}
+	}
+	if err := d.set(key, value); err != nil {
+		return "", false, err
+	}
+	return old, existed, nil
+}
+
+// SwapValues exchanges the values of the two keys, which must both exist, or it
+// returns ErrKeyNotFound. Both values are read and written under the same lock,
+// and the two writes go to the file as a single batch record, just like a Txn,
+// so even a crash never leaves one key with the value of the other. Like Set, the
+// writes clear the expiries and the metadata of the keys.
+func (d *DiskStore) SwapValues(keyA string, keyB string) error {
+	d.mu.Lock()
+	defer d.unlockAndNotify()
+	if d.closed {
+		return ErrClosed
+	}
+	if d.opts.noIndex {
+		return ErrNoIndex
+	}
+	entryA, okA := d.lookup(keyA)
+	entryB, okB := d.lookup(keyB)
+	if !okA || !okB {
+		return ErrKeyNotFound
+	}
+	if keyA == keyB {
+		return nil
+	}
+	valueA, err := d.readValue(keyA, entryA)
+	if err != nil {
+		return err
+	}
+	valueB, err := d.readValue(keyB, entryB)
+	if err != nil {
+		return err
+	}
+	tx := &Txn{d: d, writes: make(map[string]*string)}
+	tx.Set(keyA, valueB)
+	tx.Set(keyB, valueA)
+	return tx.commit()
+}
+
+func (d *DiskStore) Set(key string, value string) error {
+	// Set stores the key and value on the disk. It returns ErrClosed once the store
+	// is closed, or the error of the write, e.g. ErrDiskFull
 	//
 	// The steps to save a KV to disk is simple:
 	// 1. Encode the KV into bytes
 	// 2. Write the bytes to disk by appending to the file
 	// 3. Update KeyDir with the KeyEntry of this key
-	timestamp := uint32(time.Now().Unix())
-	size, data := encodeKV(timestamp, key, value)
-	d.write(data)
-	d.keyDir[key] = NewKeyEntry(timestamp, uint32(d.writePosition), uint32(size))
-	// update last write position, so that next record can be written from this point
-	d.writePosition += size
+	d.mu.Lock()
+	defer d.unlockAndNotify()
+	if d.closed {
+		return ErrClosed
+	}
+	return d.set(key, value)
+}
+
+// Delete removes the key from the store. Since the file is append only, it writes
+// a tombstone record for the key which tells the startup scan that the key is
+// gone. Deleting a key which does not exist is a no-op.
+func (d *DiskStore) Delete(key string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return ErrClosed
+	}
+	return d.delete(key)
+}
+
+// Rename moves the value of oldKey to newKey and removes oldKey, overwriting
+// newKey if it exists already. It returns ErrKeyNotFound if oldKey does not
+// exist. Both the steps happen under the same lock, so other goroutines see
+// either the old key or the new one, never both or neither. However, they are
+// still two records on the disk, and a crash between them leaves both the keys
+// in the file.
+func (d *DiskStore) Rename(oldKey string, newKey string) error {
+	d.mu.Lock()
+	defer d.unlockAndNotify()
+	if d.closed {
+		return ErrClosed
+	}
+	if d.opts.noIndex {
+		return ErrNoIndex
+	}
+	kEntry, ok := d.lookup(oldKey)
+	if !ok {
+		return ErrKeyNotFound
+	}
+	if oldKey == newKey {
+		return nil
+	}
+	data, err := d.readEntry(oldKey, kEntry)
+	if err != nil {
+		return err
+	}
+	// the new key keeps the expiry and the metadata of the old one
+	_, _, value, err := decodeKV(data)
+	if err != nil {
+		return err
+	}
+	if err := d.setExtended(newKey, value, decodeExtension(data)); err != nil {
+		return err
+	}
+	return d.delete(oldKey)
+}
+
+// DeleteIf deletes the key only if its current value is expected, and reports
+// whether it did. The check and the delete happen under the same lock, so a
+// caller deletes exactly the value it saw, and not the one another writer put
+// there in between. Nothing is written when the value differs or the key is not
+// there.
+func (d *DiskStore) DeleteIf(key string, expected string) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return false, ErrClosed
+	}
+	if d.opts.noIndex {
+		return false, ErrNoIndex
+	}
+	kEntry, ok := d.lookup(key)
+	if !ok {
+		return false, nil
+	}
+	value, err := d.readValue(key, kEntry)
+	if err != nil {
+		return false, err
+	}
+	if value != expected {
+		return false, nil
+	}
+	if err := d.delete(key); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// delete writes the tombstone for the key and removes it from keyDir. The caller
+// must hold the write lock.
+func (d *DiskStore) delete(key string) error {
+	// without the index we cannot tell whether the key exists, so the tombstone is
+	// always written
+	if _, ok := d.keyDir[key]; !ok && !d.opts.noIndex {
+		return nil
+	}
+	timestamp := d.now().UnixNano()
+	_, data := encodeTombstone(timestamp, key)
+	data = d.align(data)
+	if err := d.write(data); err != nil {
+		return err
+	}
+	d.removeKey(key)
+	d.writePosition += len(data)
+	return nil
 }
 
 func (d *DiskStore) Close() bool {
+	// Close waits for the background goroutines without any deadline. Use
+	// Shutdown if you need to bound the time spent here. Closing the store again
+	// is a no-op, so the shutdown paths with several defers are safe. Once the
+	// store is closed, its methods return ErrClosed
+	if err := d.Shutdown(context.Background()); err != nil {
+		// TODO: log the error
+		return false
+	}
+	return true
+}
+
+// Shutdown stops the store gracefully. It signals all the background goroutines
+// to stop and waits for them to return, then flushes the file to the disk and
+// closes it. If ctx expires before the goroutines have returned, Shutdown returns
+// ctx.Err() and leaves the file open, since closing it underneath a goroutine
+// which is still writing would lose data. Shutdown can be called again later to
+// finish the job.
+func (d *DiskStore) Shutdown(ctx context.Context) error {
+	d.stopOnce.Do(func() { close(d.done) })
+	stopped := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if d.opts.indexFlush > 0 && !d.opts.readOnly && !d.opts.noIndex {
+		// the next start only has to load what is written after this
+		if err := d.flushIndex(); err != nil {
+			d.logf("failed to write the hint file: %v", err)
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return nil
+	}
 	// before we close the file, we need to safely write the contents in the buffers
 	// to the disk. Check documentation of DiskStore.write() to understand
 	// following the operations
-	// TODO: handle errors
-	d.file.Sync()
+	if !d.opts.readOnly {
+		if d.allocated > int64(d.writePosition) {
+			if err := d.file.Truncate(int64(d.writePosition)); err != nil {
+				return err
+			}
+		}
+		if err := d.fsync(); err != nil {
+			return err
+		}
+	}
+	if d.mmapped != nil {
+		if err := munmap(d.mmapped); err != nil {
+			return err
+		}
+		d.mmapped = nil
+	}
+	if err := d.closeReaders(); err != nil {
+		return err
+	}
 	if err := d.file.Close(); err != nil {
-		// TODO: log the error
-		return false
+		return err
 	}
-	return true
+	d.closed = true
+	return nil
+}
+
+// remap maps everything written so far into the memory, replacing the previous
+// mapping. The caller must hold the write lock, since readers might be using the
+// old mapping.
+func (d *DiskStore) remap() error {
+	if d.writePosition == 0 {
+		return nil
+	}
+	data, err := mmap(d.file, d.writePosition)
+	if err != nil {
+		return err
+	}
+	old := d.mmapped
+	d.mmapped = data
+	if old != nil {
+		return munmap(old)
+	}
+	return nil
+}
+
+// logf logs a message about the store with the standard logger, prefixed with the
+// name of the store, see WithName.
+func (d *DiskStore) logf(format string, args ...interface{}) {
+	log.Printf("caskdb[%s]: "+format, append([]interface{}{d.opts.name}, args...)...)
+}
+
+// now returns the current time as per the clock of the store, see WithClock.
+func (d *DiskStore) now() time.Time {
+	if d.opts.clock != nil {
+		return d.opts.clock()
+	}
+	return time.Now()
+}
+
+// goBackground runs fn in a new goroutine which Shutdown waits for. fn must
+// return soon after done is closed.
+func (d *DiskStore) goBackground(fn func(done <-chan struct{})) {
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		fn(d.done)
+	}()
+}
+
+// set writes the KV to the disk and updates keyDir. The caller must hold the
+// write lock.
+func (d *DiskStore) set(key string, value string) error {
+	return d.setExtended(key, value, extension{})
 }
 
-func (d *DiskStore) write(data []byte) {
+// setExtended is set for a record whose header is extended as per ext, see
+// SetWithExpiry and SetWithMeta.
+func (d *DiskStore) setExtended(key string, value string, ext extension) error {
+	if err := d.validate(key, value); err != nil {
+		return err
+	}
+	var memory int64
+	evict := false
+	if _, ok := d.keyDir[key]; !ok {
+		if err := d.checkRecordLimit(1); err != nil {
+			return err
+		}
+		memory = entryMemory(key, d.newKeyEntry(0, 0, 0, value))
+		room, err := d.checkIndexRoom(memory)
+		if err != nil {
+			return err
+		}
+		evict = room
+	}
+	timestamp := d.now().UnixNano()
+	_, data := encodeExtendedKV(timestamp, key, value, ext)
+	data = d.align(data)
+	if err := d.write(data); err != nil {
+		return err
+	}
+	size := len(data)
+	kEntry := d.newKeyEntry(timestamp, d.writePosition, size, value)
+	kEntry.expireAt = ext.expireAt
+	d.putKey(key, kEntry)
+	// update last write position, so that next record can be written from this point
+	d.writePosition += size
+	d.maybeRemap()
+	if evict {
+		d.makeIndexRoom(memory, key)
+	}
+	return nil
+}
+
+// preallocate grows the file with WithPreallocate, if it does not have room for n
+// more bytes at the writePosition. The caller must hold the write lock.
+func (d *DiskStore) preallocate(n int) error {
+	if d.opts.preallocate == 0 || int64(d.writePosition+n) <= d.allocated {
+		return nil
+	}
+	size := int64(d.writePosition+n) + d.opts.preallocate
+	if err := allocate(d.file, d.allocated, size-d.allocated); err != nil {
+		return err
+	}
+	d.allocated = size
+	return nil
+}
+
+// validate runs the validator of WithValueValidator on the key and value.
+func (d *DiskStore) validate(key string, value string) error {
+	if d.opts.validator == nil {
+		return nil
+	}
+	if err := d.opts.validator(key, value); err != nil {
+		return fmt.Errorf("caskdb: invalid value for the key %q: %w", key, err)
+	}
+	return nil
+}
+
+// checkRecordLimit returns ErrRecordLimit if adding the given number of keys
+// would take the store over WithMaxRecordCount. The caller must hold the lock.
+func (d *DiskStore) checkRecordLimit(newKeys int) error {
+	if d.opts.maxRecordCount > 0 && len(d.keyDir)+newKeys > d.opts.maxRecordCount {
+		return ErrRecordLimit
+	}
+	return nil
+}
+
+// syncDir fsyncs the directory of the file with WithFsyncDir, after the file was
+// created or replaced.
+func (d *DiskStore) syncDir() error {
+	if !d.opts.fsyncDir {
+		return nil
+	}
+	return syncDir(filepath.Dir(d.fileName))
+}
+
+// align pads the record which is about to be written at the writePosition, as per
+// WithAlignment.
+func (d *DiskStore) align(record []byte) []byte {
+	return alignRecord(record, int64(d.writePosition), d.opts.alignment)
+}
+
+// newKeyEntry creates the KeyEntry of the record at the position, keeping a copy
+// of the value if it is small enough for WithInlineValues.
+func (d *DiskStore) newKeyEntry(timestamp int64, position int, size int, value string) KeyEntry {
+	kEntry := NewKeyEntry(timestamp, uint32(position), uint32(size))
+	if d.opts.inlineValues > 0 && len(value) <= d.opts.inlineValues {
+		kEntry.value = []byte(value)
+	}
+	return kEntry
+}
+
+// putKey points the key at kEntry in keyDir, and updates the stats. The caller
+// must hold the write lock.
+func (d *DiskStore) putKey(key string, kEntry KeyEntry) {
+	if d.opts.noIndex {
+		return
+	}
+	if old, ok := d.keyDir[key]; ok {
+		d.valueSizes[valueSizeBucket(key, old)]--
+		d.indexMemory -= entryMemory(key, old)
+		d.liveBytes -= int64(old.totalSize)
+	}
+	d.keyDir[key] = kEntry
+	d.valueSizes[valueSizeBucket(key, kEntry)]++
+	d.indexMemory += entryMemory(key, kEntry)
+	d.liveBytes += int64(kEntry.totalSize)
+	if d.opts.accessTracking {
+		if d.lastAccess[key] == nil {
+			d.lastAccess[key] = new(atomic.Int64)
+		}
+		d.lastAccess[key].Store(d.now().UnixNano())
+	}
+}
+
+// setKeyDir replaces keyDir with one built from scratch, like by Merge, and
+// brings the stats in line with it. The caller must hold the write lock.
+func (d *DiskStore) setKeyDir(keyDir map[string]KeyEntry) {
+	d.keyDir = keyDir
+	d.valueSizes = [valueSizeBuckets]int{}
+	d.indexMemory = 0
+	d.liveBytes = 0
+	for key, kEntry := range keyDir {
+		d.valueSizes[valueSizeBucket(key, kEntry)]++
+		d.indexMemory += entryMemory(key, kEntry)
+		d.liveBytes += int64(kEntry.totalSize)
+	}
+	for key := range d.lastAccess {
+		if _, ok := keyDir[key]; !ok {
+			delete(d.lastAccess, key)
+		}
+	}
+}
+
+// removeKey removes the key from keyDir, and updates the stats. The caller must
+// hold the write lock.
+func (d *DiskStore) removeKey(key string) {
+	if old, ok := d.keyDir[key]; ok {
+		d.valueSizes[valueSizeBucket(key, old)]--
+		d.indexMemory -= entryMemory(key, old)
+		d.liveBytes -= int64(old.totalSize)
+		delete(d.keyDir, key)
+		delete(d.lastAccess, key)
+	}
+}
+
+// maybeRemap maps the file again with WithMmap, once enough new records are
+// written after the last mapping. The caller must hold the write lock.
+func (d *DiskStore) maybeRemap() {
+	if d.opts.mmap && d.writePosition-len(d.mmapped) >= mmapRemapSize {
+		// if the mapping fails, we keep the old one and read the tail with ReadAt
+		_ = d.remap()
+	}
+}
+
+// readValue reads the record of the key, which kEntry points at, and returns its
+// value. The caller must hold the lock.
+func (d *DiskStore) readValue(key string, kEntry KeyEntry) (string, error) {
+	return d.readValueFrom(d.reader(), key, kEntry)
+}
+
+// readValueFrom is readValue, which reads the record through the file. The caller
+// must hold the lock.
+func (d *DiskStore) readValueFrom(file io.ReaderAt, key string, kEntry KeyEntry) (string, error) {
+	if kEntry.value != nil {
+		return string(kEntry.value), nil
+	}
+	data, err := d.readEntryFrom(file, key, kEntry)
+	if err != nil {
+		return "", err
+	}
+	_, _, value, err := decodeKV(data)
+	return value, err
+}
+
+// readEntry reads and verifies the record of the key, which kEntry points at,
+// even if its value is kept inline. The caller must hold the lock.
+func (d *DiskStore) readEntry(key string, kEntry KeyEntry) ([]byte, error) {
+	return d.readEntryFrom(d.reader(), key, kEntry)
+}
+
+// readEntryFrom is readEntry, which reads the record through the file, unless it
+// is mapped. The caller must hold the lock.
+func (d *DiskStore) readEntryFrom(file io.ReaderAt, key string, kEntry KeyEntry) ([]byte, error) {
+	// an entry which points past the end of the file must not turn into a short
+	// read, or into whatever garbage the file has there. This happens when the file
+	// was truncated under our feet
+	end := int64(kEntry.position) + int64(kEntry.totalSize)
+	if end > int64(d.writePosition) {
+		return nil, fmt.Errorf("%w: the record of the key %q at offset %d goes past the end of the file", ErrCorruptRecord, key, kEntry.position)
+	}
+	// we use ReadAt instead of seeking to the offset and reading, since ReadAt does
+	// not move the shared cursor of the file. This lets multiple readers hold the
+	// read lock at the same time
+	var data []byte
+	if end <= int64(len(d.mmapped)) {
+		// the callers copy out what they need before they let go of the lock, so it
+		// stays valid after we unmap
+		data = d.mmapped[kEntry.position:end]
+	} else {
+		data = make([]byte, kEntry.totalSize)
+		err := d.retryIO(func() error {
+			_, err := file.ReadAt(data, int64(kEntry.position))
+			return err
+		})
+		if err == io.EOF {
+			return nil, fmt.Errorf("%w: the file ends before the record of the key %q at offset %d, it must have been truncated", ErrCorruptRecord, key, kEntry.position)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	// the damaged records are reported as ErrCorruptRecord, so that the callers can
+	// tell them apart from the missing keys and from the errors of the disk itself,
+	// which are returned as they are
+	if size, ok := recordSize(data); !ok || size != int64(len(data)) {
+		return nil, fmt.Errorf("%w: the sizes in the record of the key %q at offset %d do not add up", ErrCorruptRecord, key, kEntry.position)
+	}
+	if !validChecksum(data) {
+		return nil, fmt.Errorf("%w: checksum mismatch in the record of the key %q at offset %d", ErrCorruptRecord, key, kEntry.position)
+	}
+	if d.opts.strictReads {
+		if _, recordKey, _, err := decodeKV(data); err != nil {
+			return nil, err
+		} else if recordKey != key {
+			return nil, fmt.Errorf("%w: the record at offset %d is of the key %q, not %q", ErrCorruptRecord, kEntry.position, recordKey, key)
+		}
+	}
+	return data, nil
+}
+
+// readRecordAt reads the raw bytes of the whole record which starts at the offset
+// and verifies its checksum. The caller must hold the lock.
+func (d *DiskStore) readRecordAt(offset int64) ([]byte, error) {
+	return d.readRecordFrom(d.reader(), offset)
+}
+
+// readRecordFrom is readRecordAt, which reads the record through the file. The
+// caller must hold the lock.
+func (d *DiskStore) readRecordFrom(file io.ReaderAt, offset int64) ([]byte, error) {
+	if offset < fileHeaderSize || offset+headerSize > int64(d.writePosition) {
+		return nil, fmt.Errorf("%w: offset %d is outside of the records", ErrCorruptRecord, offset)
+	}
+	// the file is shorter than we think when it was truncated under our feet
+	readAt := func(b []byte, off int64) error {
+		err := d.retryIO(func() error {
+			_, err := file.ReadAt(b, off)
+			return err
+		})
+		if err == io.EOF {
+			return fmt.Errorf("%w: the file ends before the record at offset %d, it must have been truncated", ErrCorruptRecord, offset)
+		} else if err != nil {
+			return err
+		}
+		return nil
+	}
+	header := make([]byte, headerSize)
+	if err := readAt(header, offset); err != nil {
+		return nil, err
+	}
+	_, keySize, valueSize := decodeHeader(header)
+	// a wrong offset gives us garbage sizes, which must not make us allocate
+	// gigabytes of memory
+	totalSize := int64(headerSize) + int64(keySize) + int64(valueSize)
+	if isPadded(header) && offset+totalSize+padSizeSize <= int64(d.writePosition) {
+		padSize := make([]byte, padSizeSize)
+		if err := readAt(padSize, offset+totalSize); err != nil {
+			return nil, err
+		}
+		totalSize += padSizeSize + int64(binary.LittleEndian.Uint32(padSize))
+	}
+	if offset+totalSize > int64(d.writePosition) {
+		return nil, fmt.Errorf("%w: the record at offset %d goes past the end of the file", ErrCorruptRecord, offset)
+	}
+	record := make([]byte, totalSize)
+	copy(record, header)
+	if err := readAt(record[headerSize:], offset+headerSize); err != nil {
+		return nil, err
+	}
+	if !validChecksum(record) {
+		return nil, fmt.Errorf("%w: checksum mismatch in the record at offset %d", ErrCorruptRecord, offset)
+	}
+	return record, nil
+}
+
+func (d *DiskStore) write(data []byte) error {
 	// saving stuff to a file reliably is hard!
 	// if you would like to explore and learn more, then
 	// start from here: https://danluu.com/file-consistency/
 	// and read this too: https://lwn.net/Articles/457667/
-	if _, err := d.file.Write(data); err != nil {
-		panic(err)
+	if d.opts.readOnly {
+		return ErrReadOnly
+	}
+	if err := d.preallocate(len(data)); err != nil {
+		return diskFull(err)
+	}
+	// a short write goes on from where it stopped, see WithIORetry
+	written := 0
+	err := d.retryIO(func() error {
+		n, err := d.appendData(data[written:])
+		written += n
+		return err
+	})
+	if err != nil {
+		if written > 0 {
+			// the part of the record which made it to the file is cut off, or the
+			// next record would be appended after it and the file would not
+			// load past the torn record anymore
+			if err := d.rollback(); err != nil {
+				d.bytesWritten += int64(written)
+				return err
+			}
+		}
+		return diskFull(err)
+	}
+	// only the records which made it to the file go to the tee, see WithWriteTee.
+	// If the tee fails the write, the record is cut off the file again
+	if err := d.tee(data); err != nil {
+		if err := d.rollback(); err != nil {
+			d.bytesWritten += int64(written)
+			return err
+		}
+		return err
 	}
+	d.bytesWritten += int64(written)
 	// calling fsync after every write is important, this assures that our writes
-	// are actually persisted to the disk
-	if err := d.file.Sync(); err != nil {
-		panic(err)
+	// are actually persisted to the disk. Unless the user asked us to sync less
+	// often, see WithGroupCommit and WithSyncEveryN
+	if d.opts.groupCommit == 0 && d.opts.syncEveryN == 0 {
+		return d.fsync()
 	}
+	// the callers update the keyDir only once we return, see WithVisibleAfterSync.
+	// A single fsync covers the writes waiting for the group commit as well
+	if d.opts.visibleAfterSync {
+		d.unsynced.Store(false)
+		d.writeCount.Store(0)
+		return d.fsync()
+	}
+	d.unsynced.Store(true)
+	if d.opts.syncEveryN > 0 && d.writeCount.Add(1) >= int64(d.opts.syncEveryN) {
+		d.writeCount.Store(0)
+		d.unsynced.Store(false)
+		return d.fsync()
+	}
+	return nil
+}
+
+// fsync syncs the file to the disk. Once an fsync fails, the kernel may have
+// dropped the dirty pages already, and the next fsync would report success
+// without them ever getting to the disk. So the first error is kept, and every
+// fsync after it returns that error again rather than trying once more, see
+// WithIORetry.
+func (d *DiskStore) fsync() error {
+	d.syncMu.Lock()
+	defer d.syncMu.Unlock()
+	if d.syncErr != nil {
+		return d.syncErr
+	}
+	syncer := d.file.Sync
+	if d.syncHook != nil {
+		syncer = d.syncHook
+	}
+	if err := syncer(); err != nil {
+		d.syncErr = err
+		return err
+	}
+	return nil
+}
+
+// failedSync returns the error of the fsync which failed, if any did, see fsync.
+func (d *DiskStore) failedSync() error {
+	d.syncMu.Lock()
+	defer d.syncMu.Unlock()
+	return d.syncErr
+}
+
+// diskFull wraps the error of a write in ErrDiskFull when the disk ran out of
+// space.
+func diskFull(err error) error {
+	if errors.Is(err, syscall.ENOSPC) {
+		return fmt.Errorf("%w: %v", ErrDiskFull, err)
+	}
+	return err
+}
+
+// appendData writes p at the end of the file, or to writeHook when it is set.
+func (d *DiskStore) appendData(p []byte) (int, error) {
+	if d.writeHook != nil {
+		return d.writeHook(p)
+	}
+	return d.file.Write(p)
 }
 
-func (d *DiskStore) initKeyDir(existingFile string) {
+// rollback truncates the file back to the writePosition, after a write which did
+// not make it to the file in full. The caller must hold the write lock.
+func (d *DiskStore) rollback() error {
+	end := d.opts.baseOffset + int64(d.writePosition)
+	if err := d.file.Truncate(end); err != nil {
+		return err
+	}
+	// without the append mode, the writes go at the cursor
+	if _, err := d.file.Seek(end, io.SeekStart); err != nil {
+		return err
+	}
+	d.allocated = int64(d.writePosition)
+	return nil
+}
+
+func (d *DiskStore) initKeyDir() error {
+	return d.buildKeyDir(true)
+}
+
+// buildKeyDir loads the keyDir from the file, starting from the hint file when
+// useHint is set and there is one, see WithPeriodicIndexFlush.
+func (d *DiskStore) buildKeyDir(useHint bool) error {
 	// we will initialise the keyDir by reading the contents of the file, record by
 	// record. As we read each record, we will also update our keyDir with the
 	// corresponding KeyEntry
 	//
 	// NOTE: this method is a blocking one, if the DB size is yuge then it will take
 	// a lot of time to startup
-	file, _ := os.Open(existingFile)
-	defer file.Close()
-	for {
+	info, err := d.file.Stat()
+	if err != nil {
+		return err
+	}
+	// fileSize is the size of the store, which starts at the base offset, see
+	// WithBaseOffset
+	fileSize := info.Size() - d.opts.baseOffset
+	if fileSize < 0 {
+		return &CorruptError{Offset: info.Size(), Reason: fmt.Sprintf("the file ends before the base offset %d", d.opts.baseOffset)}
+	}
+	if fileSize == 0 {
+		return nil
+	}
+	// the section reader reads with ReadAt and leaves the cursor of the file alone,
+	// the buffer saves us a syscall for every header, key and value
+	file := bufio.NewReader(io.NewSectionReader(d.file, d.opts.baseOffset, fileSize))
+	fileHeader := make([]byte, fileHeaderSize)
+	if _, err := io.ReadFull(file, fileHeader); err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	version, ok := decodeFileHeader(fileHeader)
+	if !ok {
+		return &CorruptError{Offset: 0, Reason: "not a caskdb file, the magic bytes are missing"}
+	}
+	if version != formatVersion {
+		reason := fmt.Sprintf("unsupported format version %d", version)
+		if version < formatVersion {
+			reason += ", the file has to be migrated first, see Migrate"
+		}
+		return &CorruptError{Offset: 4, Reason: reason}
+	}
+	if d.opts.noIndex {
+		// we trust the file to end with a complete record, see WithNoIndex
+		d.writePosition = int(fileSize)
+		return nil
+	}
+	// growing a map means rehashing all of its entries, which adds up when we
+	// insert millions of keys one by one. So we size the map upfront
+	if d.opts.initialMapCapacity == 0 {
+		d.keyDir = make(map[string]KeyEntry, estimateKeyCount(fileSize))
+	}
+	d.writePosition = fileHeaderSize
+	d.lastTimestamp, d.outOfOrder = 0, 0
+	// the hint has no copies of the values, so WithInlineValues has to read them
+	// from the records anyway
+	if useHint && d.opts.inlineValues == 0 {
+		if position, ok := d.loadHint(fileSize); ok {
+			d.writePosition = position
+			file = bufio.NewReader(io.NewSectionReader(d.file, d.opts.baseOffset+int64(position), fileSize-int64(position)))
+		}
+	}
+	if err := d.loadRecords(file, fileSize, d.opts.startupProgress); err != nil {
+		return err
+	}
+	if d.opts.startupProgress != nil {
+		d.opts.startupProgress(fileSize, fileSize)
+	}
+	return nil
+}
+
+// loadRecords reads the records from the reader, which must be positioned at the
+// writePosition, and applies them to the keyDir. It stops at the end of the file
+// or at a torn tail, leaving the writePosition at the end of the last good
+// record.
+func (d *DiskStore) loadRecords(file *bufio.Reader, fileSize int64, progress func(bytesScanned, totalBytes int64)) error {
+	for i := 0; ; i++ {
+		if !d.startupDeadline.IsZero() && i%startupCheckInterval == 0 && d.now().After(d.startupDeadline) {
+			return fmt.Errorf("%w: loaded %d of %d bytes in %v", ErrStartupTimeout, d.writePosition, fileSize, d.opts.maxStartup)
+		}
+		if progress != nil && i > 0 && i%startupCheckInterval == 0 {
+			progress(int64(d.writePosition), fileSize)
+		}
 		header := make([]byte, headerSize)
 		_, err := io.ReadFull(file, header)
 		if err == io.EOF {
 			break
 		}
-		// TODO: handle errors
-		if err != nil {
+		// a partially written header at the end of the file, the process must
+		// have crashed while writing it. We stop here and ignore the torn tail
+		if err == io.ErrUnexpectedEOF {
 			break
 		}
-		timestamp, keySize, valueSize := decodeHeader(header)
-		key := make([]byte, keySize)
-		value := make([]byte, valueSize)
-		_, err = io.ReadFull(file, key)
-		// TODO: handle errors
 		if err != nil {
-			break
+			return err
 		}
-		_, err = io.ReadFull(file, value)
-		// TODO: handle errors
-		if err != nil {
+		// the zeroes of the preallocated space after the last record, see
+		// WithPreallocate
+		if isZeroes(header) {
 			break
 		}
-		totalSize := headerSize + keySize + valueSize
-		d.keyDir[string(key)] = NewKeyEntry(timestamp, uint32(d.writePosition), totalSize)
+		timestamp, keySize, valueSize := decodeHeader(header)
+		// garbage in the sizes would overflow a uint32, so they add up in an int64
+		totalSize := int64(headerSize) + int64(keySize) + int64(valueSize)
+		end := int64(d.writePosition) + totalSize
+		// sizes which go beyond the end of the file are a torn tail as well, unless
+		// they are corrupt themselves
+		if end > fileSize {
+			next, ok, err := d.sizesOutOfRange(header, headerSize, file)
+			if !ok {
+				return err
+			}
+			file = next
+			continue
+		}
+		record := make([]byte, totalSize)
+		copy(record, header)
+		if _, err = io.ReadFull(file, record[headerSize:]); err != nil {
+			return err
+		}
+		if isPadded(header) {
+			// the padding is only as long as its pad_size says, which a torn tail
+			// might not even have
+			padSize := make([]byte, padSizeSize)
+			if _, err := io.ReadFull(file, padSize); err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			} else if err != nil {
+				return err
+			}
+			padding := int64(padSizeSize) + int64(binary.LittleEndian.Uint32(padSize))
+			if end += padding; end > fileSize {
+				next, ok, err := d.sizesOutOfRange(header, int(totalSize)+padSizeSize, file)
+				if !ok {
+					return err
+				}
+				file = next
+				continue
+			}
+			record = append(record, make([]byte, padding)...)
+			copy(record[totalSize:], padSize)
+			if _, err = io.ReadFull(file, record[totalSize+padSizeSize:]); err != nil {
+				return err
+			}
+			totalSize += padding
+		}
+		// verifying every record makes the startup slower, so by default we trust
+		// the sizes and only check the last record of the file. A crash in the
+		// middle of a write leaves a bad crc there, and we treat it as the torn tail
+		// with WithPreallocate, the record before the zeroes is the last one, and it
+		// might be torn just the same
+		last := end == fileSize || d.opts.preallocate > 0 && zeroesNext(file)
+		if last || d.opts.verifyOnStartup || d.opts.preallocate > 0 {
+			if !validChecksum(record) {
+				if last {
+					break
+				}
+				if skip, err := d.corruptRecord("checksum mismatch"); !skip {
+					return err
+				}
+				d.writePosition += int(totalSize)
+				continue
+			}
+		}
+		if d.opts.verifyTimestamps {
+			d.checkTimestamp(timestamp)
+		}
+		// without the checksum, the flags are trusted as well, and they may say that
+		// the header is extended by more than the value holds, see decodeKV
+		if isBatch(record) {
+			offsets, ok := splitBatch(record[headerSize+keySize : headerSize+keySize+valueSize])
+			for _, offset := range offsets {
+				ok = ok && fieldsFit(record[headerSize+int(keySize)+offset:])
+			}
+			if !ok {
+				if skip, err := d.corruptRecord("malformed batch of records"); !skip {
+					return err
+				}
+				d.writePosition += int(totalSize)
+				continue
+			}
+			start := d.writePosition + headerSize + int(keySize)
+			for _, offset := range offsets {
+				d.loadRecord(record[headerSize+int(keySize)+offset:], start+offset, 0)
+			}
+		} else if !fieldsFit(record) {
+			if skip, err := d.corruptRecord("the header extensions do not fit in the value"); !skip {
+				return err
+			}
+		} else {
+			d.loadRecord(record, d.writePosition, len(record))
+		}
 		d.writePosition += int(totalSize)
-		fmt.Printf("loaded key=%s, value=%s\n", key, value)
+	}
+	return nil
+}
+
+// corruptRecord handles the corrupt record at the writePosition as per
+// WithCorruptionPolicy. It returns true if loading goes on past the record, or
+// else the error to stop with, which is nil when the file is to be cut off at the
+// record.
+func (d *DiskStore) corruptRecord(reason string) (bool, error) {
+	switch d.opts.corruptionPolicy {
+	case CorruptionSkipRecord:
+		d.logf("skipping the corrupt record at offset %d: %s", d.writePosition, reason)
+		return true, nil
+	case CorruptionTruncateTail:
+		// everything from here on is cut off by NewDiskStore
+		d.logf("truncating the file at the corrupt record at offset %d: %s", d.writePosition, reason)
+		return false, nil
+	default:
+		return false, &CorruptError{Offset: int64(d.writePosition), Reason: reason}
+	}
+}
+
+// tornTailLimit is how much of the file sizesOutOfRange looks through for good
+// records. A longer tail is not taken for a torn record.
+const tornTailLimit = 1 << 20
+
+// sizesOutOfRange handles the record at the writePosition, whose sizes run past
+// the end of the file, after n bytes of it have been read. A crash only tears the
+// last write, so no good records follow a torn one, and loading stops there with
+// false and no error. If good records do follow, or the tail is longer than
+// tornTailLimit, it is the sizes which are corrupt, and the corruption policy
+// says what happens. With CorruptionSkipRecord, loading goes on at the next good
+// record, from the reader returned with true.
+//
+// A transaction which is torn right between two of its records looks just like
+// good records following it, so transactions are always taken to be torn.
+func (d *DiskStore) sizesOutOfRange(header []byte, n int, file *bufio.Reader) (*bufio.Reader, bool, error) {
+	rest, err := io.ReadAll(io.LimitReader(file, tornTailLimit+1))
+	if err != nil {
+		return nil, false, err
+	}
+	next := -1
+	if len(rest) <= tornTailLimit {
+		if isBatch(header) {
+			return nil, false, nil
+		}
+		for i := range rest {
+			if goodRecordsNext(rest[i:]) {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			return nil, false, nil
+		}
+	}
+	switch d.opts.corruptionPolicy {
+	case CorruptionSkipRecord:
+		if next >= 0 {
+			d.logf("skipping the record with corrupt sizes at offset %d", d.writePosition)
+			d.writePosition += n + next
+			return bufio.NewReader(io.MultiReader(bytes.NewReader(rest[next:]), file)), true, nil
+		}
+	case CorruptionTruncateTail:
+		d.logf("truncating the file at the record with corrupt sizes at offset %d", d.writePosition)
+		return nil, false, nil
+	}
+	return nil, false, &CorruptError{Offset: int64(d.writePosition), Reason: "record sizes out of range"}
+}
+
+// goodRecordsNext reports whether data is made of good records, with their
+// checksums verified, up to its end or to the zeroes of the preallocated space.
+func goodRecordsNext(data []byte) bool {
+	for first := true; len(data) > 0; first = false {
+		if !first && isZeroes(data) {
+			return true
+		}
+		size, ok := recordSize(data)
+		if !ok || size > int64(len(data)) || !validChecksum(data[:size]) {
+			return false
+		}
+		data = data[size:]
+	}
+	return true
+}
+
+// checkTimestamp flags the record at the writePosition if its timestamp is older
+// than the newest one so far by more than the skew, see WithAppendOnlyVerify.
+func (d *DiskStore) checkTimestamp(timestamp int64) {
+	if timestamp+int64(d.opts.timestampSkew) < d.lastTimestamp {
+		d.outOfOrder++
+		d.logf("the record at offset %d has the timestamp %d, older than %d before it", d.writePosition, timestamp, d.lastTimestamp)
+		return
+	}
+	if timestamp > d.lastTimestamp {
+		d.lastTimestamp = timestamp
+	}
+}
+
+// isZeroes reports whether all of the bytes are zero.
+func isZeroes(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// zeroesNext reports whether the reader is at the end, or at a record header of
+// zeroes.
+func zeroesNext(r *bufio.Reader) bool {
+	next, _ := r.Peek(headerSize)
+	return isZeroes(next)
+}
+
+// loadRecord applies the record, which is at the position in the file, to the
+// keyDir. data may go on after the end of the record, in which case size must be
+// zero and the record must not be padded. The caller must have checked that the
+// fields of the record fit, see fieldsFit.
+func (d *DiskStore) loadRecord(data []byte, position int, size int) {
+	timestamp, key, value, _ := decodeKV(data)
+	if size == 0 {
+		n, _ := recordSize(data)
+		size = int(n)
+	}
+	if isTombstone(data) {
+		d.removeKey(key)
+	} else {
+		kEntry := d.newKeyEntry(timestamp, position, size, value)
+		kEntry.expireAt = recordExpiry(data)
+		d.putKey(key, kEntry)
 	}
 }
@@ -1,8 +1,16 @@
 package caskdb
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"os"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func TestDiskStore_Get(t *testing.T) {
@@ -12,7 +20,7 @@ func TestDiskStore_Get(t *testing.T) {
 	}
 	defer os.Remove("test.db")
 	store.Set("name", "jojo")
-	if val := store.Get("name"); val != "jojo" {
+	if val, _ := store.Get("name"); val != "jojo" {
 		t.Errorf("Get() = %v, want %v", val, "jojo")
 	}
 }
@@ -23,8 +31,8 @@ func TestDiskStore_GetInvalid(t *testing.T) {
 		t.Fatalf("failed to create disk store: %v", err)
 	}
 	defer os.Remove("test.db")
-	if val := store.Get("some key"); val != "" {
-		t.Errorf("Get() = %v, want %v", val, "")
+	if val, err := store.Get("some key"); val != "" || !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Get() = (%v, %v), want ('', %v)", val, err, ErrKeyNotFound)
 	}
 }
 
@@ -46,8 +54,8 @@ func TestDiskStore_SetWithPersistence(t *testing.T) {
 	}
 	for key, val := range tests {
 		store.Set(key, val)
-		if store.Get(key) != val {
-			t.Errorf("Get() = %v, want %v", store.Get(key), val)
+		if got, _ := store.Get(key); got != val {
+			t.Errorf("Get() = %v, want %v", got, val)
 		}
 	}
 	store.Close()
@@ -56,8 +64,8 @@ func TestDiskStore_SetWithPersistence(t *testing.T) {
 		t.Fatalf("failed to create disk store: %v", err)
 	}
 	for key, val := range tests {
-		if store.Get(key) != val {
-			t.Errorf("Get() = %v, want %v", store.Get(key), val)
+		if got, _ := store.Get(key); got != val {
+			t.Errorf("Get() = %v, want %v", got, val)
 		}
 	}
 	store.Close()
@@ -93,12 +101,1291 @@ func TestDiskStore_Delete(t *testing.T) {
 		t.Fatalf("failed to create disk store: %v", err)
 	}
 	for key := range tests {
-		if store.Get(key) != "" {
-			t.Errorf("Get() = %v, want '' (empty)", store.Get(key))
+		if got, _ := store.Get(key); got != "" {
+			t.Errorf("Get() = %v, want '' (empty)", got)
 		}
 	}
-	if store.Get("end") != "yes" {
-		t.Errorf("Get() = %v, want %v", store.Get("end"), "yes")
+	if got, _ := store.Get("end"); got != "yes" {
+		t.Errorf("Get() = %v, want %v", got, "yes")
 	}
 	store.Close()
 }
+
+func TestDiskStore_Shutdown(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+
+	// a background writer which keeps writing till it is asked to stop. If
+	// Shutdown closed the file before the writer returned, Set would fail
+	stopped := false
+	store.goBackground(func(done <-chan struct{}) {
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				stopped = true
+				return
+			default:
+				store.Set("counter", fmt.Sprint(i))
+			}
+		}
+	})
+	if err := store.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+	if !stopped {
+		t.Errorf("Shutdown() returned before the background goroutine stopped")
+	}
+	// the second call is a no-op
+	if err := store.Shutdown(context.Background()); err != nil {
+		t.Errorf("Shutdown() error = %v, want nil", err)
+	}
+}
+
+func TestDiskStore_ShutdownDeadline(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+
+	release := make(chan struct{})
+	store.goBackground(func(done <-chan struct{}) {
+		<-done
+		// pretend that we are flushing something slow
+		<-release
+		store.Set("name", "jojo")
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := store.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Shutdown() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	// the file must still be usable since the goroutine did not finish yet
+	close(release)
+	if err := store.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	if val, _ := store.Get("name"); val != "jojo" {
+		t.Errorf("Get() = %v, want %v", val, "jojo")
+	}
+	store.Close()
+}
+
+func TestDiskStore_Swap(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	old, existed, err := store.Swap("name", "jojo")
+	if err != nil {
+		t.Fatalf("Swap() error = %v", err)
+	}
+	if old != "" || existed {
+		t.Errorf("Swap() = (%v, %v), want ('', false)", old, existed)
+	}
+	old, existed, err = store.Swap("name", "dio")
+	if err != nil {
+		t.Fatalf("Swap() error = %v", err)
+	}
+	if old != "jojo" || !existed {
+		t.Errorf("Swap() = (%v, %v), want (jojo, true)", old, existed)
+	}
+	if val, _ := store.Get("name"); val != "dio" {
+		t.Errorf("Get() = %v, want %v", val, "dio")
+	}
+}
+
+func TestDiskStore_SwapValues(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+
+	store.Set("front", "buffer one")
+	store.Set("back", "buffer two")
+	if err := store.SwapValues("front", "missing"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("SwapValues() error = %v, want %v", err, ErrKeyNotFound)
+	}
+	if err := store.SwapValues("front", "back"); err != nil {
+		t.Fatalf("SwapValues() error = %v", err)
+	}
+	store.Close()
+
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	tests := map[string]string{"front": "buffer two", "back": "buffer one"}
+	for key, val := range tests {
+		if got, _ := store.Get(key); got != val {
+			t.Errorf("Get() = %v, want %v", got, val)
+		}
+	}
+}
+
+func TestDiskStore_DiskFull(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+
+	store.Set("othello", "shakespeare")
+	size := fileSize(t, "test.db")
+	written := store.bytesWritten
+	// the disk takes the first few bytes of the record, and then it is full
+	room := 10
+	store.writeHook = func(p []byte) (int, error) {
+		n := len(p)
+		if n > room {
+			n = room
+		}
+		room -= n
+		written, err := store.file.Write(p[:n])
+		if err == nil && n < len(p) {
+			err = &os.PathError{Op: "write", Path: "test.db", Err: syscall.ENOSPC}
+		}
+		return written, err
+	}
+	if err := store.Set("othello", "marlowe"); !errors.Is(err, ErrDiskFull) {
+		t.Errorf("Set() error = %v, want %v", err, ErrDiskFull)
+	}
+	if got := fileSize(t, "test.db"); got != size {
+		t.Errorf("file size after the failed write = %d, want %d", got, size)
+	}
+	// the bytes which were cut off again do not count as written
+	if store.bytesWritten != written {
+		t.Errorf("bytesWritten after the failed write = %d, want %d", store.bytesWritten, written)
+	}
+	room = 10
+	if err := store.SetDurable("othello", "marlowe"); !errors.Is(err, ErrDiskFull) {
+		t.Errorf("SetDurable() error = %v, want %v", err, ErrDiskFull)
+	}
+	if val, _ := store.Get("othello"); val != "shakespeare" {
+		t.Errorf("Get() = %v, want %v", val, "shakespeare")
+	}
+
+	// once there is room again, the writes go right after the last record
+	store.writeHook = nil
+	store.Set("dune", "frank herbert")
+	store.Close()
+	store, err = NewDiskStore("test.db", WithVerifyOnStartup())
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	tests := map[string]string{"othello": "shakespeare", "dune": "frank herbert"}
+	for key, val := range tests {
+		if got, _ := store.Get(key); got != val {
+			t.Errorf("Get() = %v, want %v", got, val)
+		}
+	}
+}
+
+func TestDiskStore_TornTail(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	store.Set("othello", "shakespeare")
+	store.Set("dune", "frank herbert")
+	store.Close()
+
+	// simulate a crash in the middle of writing a record
+	_, data := encodeKV(0, "hamlet", "shakespeare")
+	file, err := os.OpenFile("test.db", os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		t.Fatalf("failed to open the file: %v", err)
+	}
+	file.Write(data[:len(data)-3])
+	file.Close()
+
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	if val, _ := store.Get("hamlet"); val != "" {
+		t.Errorf("Get() = %v, want '' (empty)", val)
+	}
+	store.Set("hamlet", "shakespeare")
+	store.Close()
+
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	for key, val := range map[string]string{"othello": "shakespeare", "dune": "frank herbert", "hamlet": "shakespeare"} {
+		if got, _ := store.Get(key); got != val {
+			t.Errorf("Get() = %v, want %v", got, val)
+		}
+	}
+	store.Close()
+}
+
+func TestDiskStore_CorruptSizes(t *testing.T) {
+	defer os.Remove("test.db")
+	// the first one overflows a uint32 when it is added to the header and the key
+	for _, valueSize := range []uint32{0xfffffff0, 1000} {
+		store, err := NewDiskStore("test.db")
+		if err != nil {
+			t.Fatalf("failed to create disk store: %v", err)
+		}
+		store.Set("othello", "shakespeare")
+		store.Set("dune", "frank herbert")
+		store.Close()
+
+		// corrupt the value_size of the first record, which is not the last one
+		data, err := os.ReadFile("test.db")
+		if err != nil {
+			t.Fatalf("failed to read the file: %v", err)
+		}
+		binary.LittleEndian.PutUint32(data[fileHeaderSize+16:], valueSize)
+		if err := os.WriteFile("test.db", data, 0666); err != nil {
+			t.Fatalf("failed to write the file: %v", err)
+		}
+
+		_, err = NewDiskStore("test.db")
+		var corruptErr *CorruptError
+		if !errors.As(err, &corruptErr) || corruptErr.Offset != fileHeaderSize {
+			t.Errorf("NewDiskStore() error = %v, want a CorruptError at offset %v", err, fileHeaderSize)
+		}
+
+		store, err = NewDiskStore("test.db", WithCorruptionPolicy(CorruptionSkipRecord))
+		if err != nil {
+			t.Fatalf("failed to create disk store: %v", err)
+		}
+		if val, _ := store.Get("othello"); val != "" {
+			t.Errorf("Get() = %v, want '' (empty)", val)
+		}
+		if val, _ := store.Get("dune"); val != "frank herbert" {
+			t.Errorf("Get() = %v, want %v", val, "frank herbert")
+		}
+		store.Close()
+		os.Remove("test.db")
+	}
+}
+
+func TestDiskStore_CorruptFlags(t *testing.T) {
+	defer os.Remove("test.db")
+	for _, flag := range []byte{flagExpiry, flagMeta} {
+		store, err := NewDiskStore("test.db")
+		if err != nil {
+			t.Fatalf("failed to create disk store: %v", err)
+		}
+		store.Set("othello", "ab")
+		store.Set("dune", "frank herbert")
+		store.Close()
+
+		// the flags of the first record say its header is extended, which its
+		// value has no room for. The crc of a record which is not the last one is
+		// not checked by default
+		data, err := os.ReadFile("test.db")
+		if err != nil {
+			t.Fatalf("failed to read the file: %v", err)
+		}
+		data[fileHeaderSize+flagsOffset] |= flag
+		if err := os.WriteFile("test.db", data, 0666); err != nil {
+			t.Fatalf("failed to write the file: %v", err)
+		}
+
+		_, err = NewDiskStore("test.db")
+		var corruptErr *CorruptError
+		if !errors.As(err, &corruptErr) || corruptErr.Offset != fileHeaderSize {
+			t.Errorf("NewDiskStore() with the flags %d error = %v, want a CorruptError at offset %v", flag, err, fileHeaderSize)
+		}
+
+		store, err = NewDiskStore("test.db", WithCorruptionPolicy(CorruptionSkipRecord))
+		if err != nil {
+			t.Fatalf("failed to create disk store: %v", err)
+		}
+		if val, _ := store.Get("othello"); val != "" {
+			t.Errorf("Get() = %v, want '' (empty)", val)
+		}
+		if val, _ := store.Get("dune"); val != "frank herbert" {
+			t.Errorf("Get() = %v, want %v", val, "frank herbert")
+		}
+		store.Close()
+		os.Remove("test.db")
+	}
+}
+
+func TestDiskStore_VerifyOnStartup(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	store.Set("othello", "shakespeare")
+	store.Set("dune", "frank herbert")
+	store.Close()
+
+	// flip a byte in the value of the first record
+	data, err := os.ReadFile("test.db")
+	if err != nil {
+		t.Fatalf("failed to read the file: %v", err)
+	}
+	data[fileHeaderSize+headerSize+len("othello")] ^= 0xff
+	if err := os.WriteFile("test.db", data, 0666); err != nil {
+		t.Fatalf("failed to write the file: %v", err)
+	}
+
+	// without verification the corrupt record goes unnoticed at startup
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Close()
+
+	_, err = NewDiskStore("test.db", WithVerifyOnStartup())
+	var corruptErr *CorruptError
+	if !errors.As(err, &corruptErr) || corruptErr.Offset != fileHeaderSize {
+		t.Errorf("NewDiskStore() error = %v, want a CorruptError at offset %v", err, fileHeaderSize)
+	}
+}
+
+func TestDiskStore_AppendOnlyVerify(t *testing.T) {
+	now := time.Unix(1000, 0)
+	store, err := NewDiskStore("test.db", WithClock(func() time.Time { return now }))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	store.Set("othello", "shakespeare")
+	// a small step back is within the skew
+	now = now.Add(-time.Second)
+	store.Set("dune", "frank herbert")
+	now = now.Add(-time.Minute)
+	store.Set("hamlet", "shakespeare")
+	store.Close()
+
+	store, err = NewDiskStore("test.db", WithAppendOnlyVerify(5*time.Second))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	if n := store.Stats().OutOfOrder; n != 1 {
+		t.Errorf("Stats().OutOfOrder = %v, want %v", n, 1)
+	}
+	if val, _ := store.Get("hamlet"); val != "shakespeare" {
+		t.Errorf("Get() = %v, want %v", val, "shakespeare")
+	}
+}
+
+func TestDiskStore_MaxStartupDuration(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	store.Set("othello", "shakespeare")
+	store.Close()
+
+	// every look at the clock takes an hour
+	now := time.Unix(1000, 0)
+	slowClock := func() time.Time {
+		now = now.Add(time.Hour)
+		return now
+	}
+	_, err = NewDiskStore("test.db", WithClock(slowClock), WithMaxStartupDuration(time.Minute))
+	if !errors.Is(err, ErrStartupTimeout) {
+		t.Errorf("NewDiskStore() error = %v, want %v", err, ErrStartupTimeout)
+	}
+	store, err = NewDiskStore("test.db", WithMaxStartupDuration(time.Minute))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Close()
+}
+
+func TestDiskStore_StartupProgress(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	store.BulkLoad(func(emit func(key, value string)) error {
+		for i := 0; i < 3*startupCheckInterval; i++ {
+			emit(fmt.Sprint(i), "value")
+		}
+		return nil
+	})
+	store.Close()
+
+	var calls [][2]int64
+	store, err = NewDiskStore("test.db", WithStartupProgress(func(bytesScanned, totalBytes int64) {
+		calls = append(calls, [2]int64{bytesScanned, totalBytes})
+	}))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	if len(calls) < 3 {
+		t.Fatalf("progress called %d times, want at least 3", len(calls))
+	}
+	size := fileSize(t, "test.db")
+	for i, call := range calls {
+		if call[1] != size || (i > 0 && call[0] < calls[i-1][0]) {
+			t.Errorf("progress calls = %v, want increasing bytes out of %d", calls, size)
+		}
+	}
+	if last := calls[len(calls)-1]; last[0] != size {
+		t.Errorf("last progress call = %v, want all of the %d bytes", last, size)
+	}
+}
+
+func TestDiskStore_Created(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	if !store.Created() {
+		t.Errorf("Created() = false for a new database")
+	}
+	store.Close()
+
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	if store.Created() {
+		t.Errorf("Created() = true for an existing database")
+	}
+}
+
+func TestDiskStore_DeleteWithPersistence(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	store.Set("othello", "shakespeare")
+	store.Set("dune", "frank herbert")
+	if err := store.Delete("othello"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, existed, _ := store.Swap("othello", "shakespeare"); existed {
+		t.Errorf("Swap() existed = true after Delete(), want false")
+	}
+	if err := store.Delete("othello"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	store.Close()
+
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	if _, ok := store.keyDir["othello"]; ok {
+		t.Errorf("deleted key othello was loaded back")
+	}
+	if val, _ := store.Get("dune"); val != "frank herbert" {
+		t.Errorf("Get() = %v, want %v", val, "frank herbert")
+	}
+	store.Close()
+}
+
+func TestDiskStore_NotCaskFile(t *testing.T) {
+	if err := os.WriteFile("test.db", []byte("this is not a database"), 0666); err != nil {
+		t.Fatalf("failed to write the file: %v", err)
+	}
+	defer os.Remove("test.db")
+	_, err := NewDiskStore("test.db")
+	var corruptErr *CorruptError
+	if !errors.As(err, &corruptErr) || corruptErr.Offset != 0 {
+		t.Errorf("NewDiskStore() error = %v, want a CorruptError at offset 0", err)
+	}
+}
+
+func TestDiskStore_DeleteIf(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	store.Set("othello", "shakespeare")
+	size := fileSize(t, "test.db")
+	for _, key := range []string{"othello", "dune"} {
+		if deleted, err := store.DeleteIf(key, "marlowe"); deleted || err != nil {
+			t.Errorf("DeleteIf(%q) = %v, %v, want false", key, deleted, err)
+		}
+	}
+	if got := fileSize(t, "test.db"); got != size {
+		t.Errorf("file size after DeleteIf() did nothing = %v, want %v", got, size)
+	}
+	if deleted, err := store.DeleteIf("othello", "shakespeare"); !deleted || err != nil {
+		t.Errorf("DeleteIf() = %v, %v, want true", deleted, err)
+	}
+	if _, err := store.Get("othello"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Get() error = %v, want %v", err, ErrKeyNotFound)
+	}
+}
+
+func TestDiskStore_Rename(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+
+	store.Set("hamlet", "shakespeare")
+	if err := store.Rename("hamlet", "macbeth"); err != nil {
+		t.Fatalf("Rename() error = %v", err)
+	}
+	if err := store.Rename("hamlet", "othello"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Rename() error = %v, want %v", err, ErrKeyNotFound)
+	}
+	store.Close()
+
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	if val, _ := store.Get("macbeth"); val != "shakespeare" {
+		t.Errorf("Get() = %v, want %v", val, "shakespeare")
+	}
+	if _, ok := store.keyDir["hamlet"]; ok {
+		t.Errorf("the old key hamlet still exists after Rename()")
+	}
+	store.Close()
+}
+
+func benchmarkNewDiskStore(b *testing.B, opts ...Option) {
+	// the records are not synced one by one to keep the setup quick
+	store, err := NewDiskStore("bench.db", WithGroupCommit(time.Hour))
+	if err != nil {
+		b.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("bench.db")
+	const numKeys = 100000
+	for i := 0; i < numKeys; i++ {
+		store.Set(fmt.Sprint(i), "value")
+	}
+	store.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		store, err := NewDiskStore("bench.db", opts...)
+		if err != nil {
+			b.Fatalf("failed to create disk store: %v", err)
+		}
+		store.Close()
+	}
+}
+
+func BenchmarkNewDiskStore(b *testing.B) {
+	benchmarkNewDiskStore(b)
+}
+
+func BenchmarkNewDiskStore_InitialMapCapacity(b *testing.B) {
+	benchmarkNewDiskStore(b, WithInitialMapCapacity(100000))
+}
+
+func TestDiskStore_StrictReads(t *testing.T) {
+	store, err := NewDiskStore("test.db", WithStrictReads())
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	store.Set("othello", "shakespeare")
+	store.Set("dune", "frank herbert")
+	// make the entry of othello point at the record of dune by mistake
+	store.keyDir["othello"] = store.keyDir["dune"]
+	if _, err := store.Get("othello"); !errors.Is(err, ErrCorruptRecord) {
+		t.Errorf("Get() error = %v, want %v", err, ErrCorruptRecord)
+	}
+	if val, err := store.Get("dune"); val != "frank herbert" || err != nil {
+		t.Errorf("Get() = (%v, %v), want (frank herbert, nil)", val, err)
+	}
+}
+
+func TestDiskStore_FromFile(t *testing.T) {
+	file, err := os.CreateTemp("", "caskdb-*.db")
+	if err != nil {
+		t.Fatalf("failed to create the file: %v", err)
+	}
+	defer os.Remove(file.Name())
+	store, err := NewDiskStoreFromFile(file)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("othello", "shakespeare")
+	if val, _ := store.Get("othello"); val != "shakespeare" {
+		t.Errorf("Get() = %v, want %v", val, "shakespeare")
+	}
+	store.Close()
+
+	store, err = NewDiskStore(file.Name())
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	if val, _ := store.Get("othello"); val != "shakespeare" {
+		t.Errorf("Get() = %v, want %v", val, "shakespeare")
+	}
+	store.Close()
+}
+
+func TestDiskStore_CorruptionPolicy(t *testing.T) {
+	tests := []struct {
+		policy CorruptionPolicy
+		want   map[string]string
+	}{
+		{CorruptionSkipRecord, map[string]string{"othello": "shakespeare", "dune": "", "hamlet": "shakespeare"}},
+		{CorruptionTruncateTail, map[string]string{"othello": "shakespeare", "dune": "", "hamlet": ""}},
+	}
+	for _, tt := range tests {
+		store, err := NewDiskStore("test.db")
+		if err != nil {
+			t.Fatalf("failed to create disk store: %v", err)
+		}
+		store.Set("othello", "shakespeare")
+		store.Set("dune", "frank herbert")
+		store.Set("hamlet", "shakespeare")
+		offset := store.keyDir["dune"].position
+		store.Close()
+
+		// flip a byte in the value of the middle record
+		data, err := os.ReadFile("test.db")
+		if err != nil {
+			t.Fatalf("failed to read the file: %v", err)
+		}
+		data[int(offset)+headerSize+len("dune")] ^= 0xff
+		if err := os.WriteFile("test.db", data, 0666); err != nil {
+			t.Fatalf("failed to write the file: %v", err)
+		}
+
+		store, err = NewDiskStore("test.db", WithVerifyOnStartup(), WithCorruptionPolicy(tt.policy))
+		if err != nil {
+			t.Fatalf("NewDiskStore() error = %v", err)
+		}
+		for key, val := range tt.want {
+			if got, _ := store.Get(key); got != val {
+				t.Errorf("policy %v: Get(%v) = %v, want %v", tt.policy, key, got, val)
+			}
+		}
+		store.Close()
+		os.Remove("test.db")
+	}
+}
+
+func TestDiskStore_AppendRaw(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	store.Set("othello", "shakespeare")
+	offset, err := store.AppendRaw("dune", "frank herbert")
+	if err != nil {
+		t.Fatalf("AppendRaw() error = %v", err)
+	}
+	if want := int64(fileHeaderSize + headerSize + len("othello") + len("shakespeare")); offset != want {
+		t.Errorf("AppendRaw() offset = %v, want %v", offset, want)
+	}
+	record, err := store.readRecordAt(offset)
+	if err != nil {
+		t.Fatalf("failed to read the record: %v", err)
+	}
+	if _, key, value, _ := decodeKV(record); key != "dune" || value != "frank herbert" {
+		t.Errorf("record at the offset = (%v, %v), want (dune, frank herbert)", key, value)
+	}
+}
+
+func TestDiskStore_GetAtOffset(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	first, _ := store.AppendRaw("othello", "marlowe")
+	store.Set("othello", "shakespeare")
+	deleted := int64(store.writePosition)
+	store.Delete("othello")
+	if key, value, err := store.GetAtOffset(first); err != nil || key != "othello" || value != "marlowe" {
+		t.Errorf("GetAtOffset() = %v, %v, %v, want othello, marlowe", key, value, err)
+	}
+	if key, _, err := store.GetAtOffset(deleted); key != "othello" || !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("GetAtOffset() on a tombstone = %v, %v, want othello, %v", key, err, ErrKeyNotFound)
+	}
+	if _, _, err := store.GetAtOffset(first + 1); !errors.Is(err, ErrCorruptRecord) {
+		t.Errorf("GetAtOffset() error = %v, want %v", err, ErrCorruptRecord)
+	}
+}
+
+func TestDiskStore_ReadRecordAt(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	store.Set("othello", "marlowe")
+	store.Set("othello", "shakespeare")
+	store.Delete("othello")
+	type record struct {
+		key, value string
+		tombstone  bool
+	}
+	want := []record{{"othello", "marlowe", false}, {"othello", "shakespeare", false}, {"othello", "", true}}
+	var got []record
+	for offset := int64(fileHeaderSize); offset < int64(store.writePosition); {
+		r, next, err := store.ReadRecordAt(offset)
+		if err != nil {
+			t.Fatalf("ReadRecordAt() error = %v", err)
+		}
+		got = append(got, record{r.Key, string(r.Value), r.Tombstone})
+		offset = next
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("ReadRecordAt() records = %v, want %v", got, want)
+	}
+	if _, _, err := store.ReadRecordAt(fileHeaderSize + 1); !errors.Is(err, ErrCorruptRecord) {
+		t.Errorf("ReadRecordAt() error = %v, want %v", err, ErrCorruptRecord)
+	}
+}
+
+func TestDiskStore_GetMany(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	store.Set("othello", "shakespeare")
+	store.Set("dune", "frank herbert")
+	got, err := store.GetMany([]string{"dune", "hamlet", "othello", "dune"})
+	if err != nil {
+		t.Fatalf("GetMany() error = %v", err)
+	}
+	want := []Result{{"frank herbert", true}, {"", false}, {"shakespeare", true}, {"frank herbert", true}}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("GetMany() = %v, want %v", got, want)
+	}
+}
+
+func TestDiskStore_Alignment(t *testing.T) {
+	store, err := NewDiskStore("test.db", WithAlignment(512))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+
+	store.Set("othello", "marlowe")
+	store.Set("othello", "shakespeare")
+	store.Set("dune", strings.Repeat("a", 600))
+	store.Set("hamlet", "shakespeare")
+	store.Delete("hamlet")
+	checkAligned := func() {
+		t.Helper()
+		for key, kEntry := range store.keyDir {
+			if kEntry.position%512 != 0 {
+				t.Errorf("position of %v = %v, want a multiple of 512", key, kEntry.position)
+			}
+		}
+		if store.writePosition%512 != 0 {
+			t.Errorf("writePosition = %v, want a multiple of 512", store.writePosition)
+		}
+	}
+	checkAligned()
+	if err := store.Merge(); err != nil {
+		t.Fatalf("Merge() error = %v", err)
+	}
+	checkAligned()
+	store.Close()
+
+	// the padding is read back without the option
+	store, err = NewDiskStore("test.db", WithVerifyOnStartup())
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	tests := map[string]string{"othello": "shakespeare", "dune": strings.Repeat("a", 600), "hamlet": ""}
+	for key, val := range tests {
+		if got, _ := store.Get(key); got != val {
+			t.Errorf("Get() = %v, want %v", got, val)
+		}
+	}
+}
+
+func TestDiskStore_GetCorrupt(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	store.Set("othello", "shakespeare")
+	store.Set("dune", "frank herbert")
+	// flip a byte of the value of othello
+	file, err := os.OpenFile("test.db", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("failed to open the file: %v", err)
+	}
+	file.WriteAt([]byte("S"), int64(store.keyDir["othello"].position)+headerSize+int64(len("othello")))
+	file.Close()
+	if _, err := store.Get("othello"); !errors.Is(err, ErrCorruptRecord) {
+		t.Errorf("Get() error = %v, want %v", err, ErrCorruptRecord)
+	}
+	// an entry whose size does not match the record
+	kEntry := store.keyDir["dune"]
+	kEntry.totalSize--
+	store.keyDir["dune"] = kEntry
+	if _, err := store.Get("dune"); !errors.Is(err, ErrCorruptRecord) {
+		t.Errorf("Get() error = %v, want %v", err, ErrCorruptRecord)
+	}
+	if _, err := store.Get("hamlet"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Get() error = %v, want %v", err, ErrKeyNotFound)
+	}
+}
+
+func TestDiskStore_FsyncDir(t *testing.T) {
+	store, err := NewDiskStore("test.db", WithFsyncDir())
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	store.Set("othello", "marlowe")
+	store.Set("othello", "shakespeare")
+	if err := store.Merge(); err != nil {
+		t.Fatalf("Merge() error = %v", err)
+	}
+	if err := store.InPlaceCompact(); err != nil {
+		t.Fatalf("InPlaceCompact() error = %v", err)
+	}
+	if val, _ := store.Get("othello"); val != "shakespeare" {
+		t.Errorf("Get() = %v, want %v", val, "shakespeare")
+	}
+}
+
+func TestDiskStore_AtomicCreate(t *testing.T) {
+	store, err := NewDiskStore("test.db", WithAtomicCreate())
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	if _, err := os.Stat("test.db" + createSuffix); !os.IsNotExist(err) {
+		t.Errorf("the temporary file is left behind: %v", err)
+	}
+	if size := fileSize(t, "test.db"); size != fileHeaderSize {
+		t.Errorf("file size after creating = %v, want %v", size, fileHeaderSize)
+	}
+	if !store.Created() {
+		t.Errorf("Created() = false for a new database")
+	}
+	store.Set("othello", "shakespeare")
+	store.Close()
+
+	// an existing file is opened as it is
+	store, err = NewDiskStore("test.db", WithAtomicCreate())
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	if store.Created() {
+		t.Errorf("Created() = true for an existing database")
+	}
+	if val, _ := store.Get("othello"); val != "shakespeare" {
+		t.Errorf("Get() = %v, want %v", val, "shakespeare")
+	}
+}
+
+func TestDiskStore_MaxRecordCount(t *testing.T) {
+	store, err := NewDiskStore("test.db", WithMaxRecordCount(2))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	store.Set("othello", "shakespeare")
+	store.Set("dune", "frank herbert")
+	size := fileSize(t, "test.db")
+	if _, err := store.AppendRaw("hamlet", "shakespeare"); !errors.Is(err, ErrRecordLimit) {
+		t.Errorf("AppendRaw() over the limit error = %v, want %v", err, ErrRecordLimit)
+	}
+	err = store.Txn(func(tx *Txn) error {
+		tx.Set("othello", "marlowe")
+		tx.Set("hamlet", "shakespeare")
+		return nil
+	})
+	if !errors.Is(err, ErrRecordLimit) {
+		t.Errorf("Txn() over the limit error = %v, want %v", err, ErrRecordLimit)
+	}
+	if got := fileSize(t, "test.db"); got != size {
+		t.Errorf("file size after the rejected writes = %v, want %v", got, size)
+	}
+	// overwrites are fine, and a delete makes room for a new key
+	if _, err := store.AppendRaw("othello", "marlowe"); err != nil {
+		t.Errorf("AppendRaw() of an existing key error = %v", err)
+	}
+	err = store.Txn(func(tx *Txn) error {
+		tx.Delete("dune")
+		tx.Set("hamlet", "shakespeare")
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Txn() error = %v", err)
+	}
+	if val, _ := store.Get("hamlet"); val != "shakespeare" {
+		t.Errorf("Get() = %v, want %v", val, "shakespeare")
+	}
+}
+
+func TestDiskStore_OverwriteWithShorterValue(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	long := strings.Repeat("shakespeare", 100)
+	store.Set("othello", long)
+	store.Set("othello", "bacon")
+	if size := store.keyDir["othello"].totalSize; size != uint32(headerSize+len("othello")+len("bacon")) {
+		t.Errorf("totalSize = %v, want the size of the new record %v", size, headerSize+len("othello")+len("bacon"))
+	}
+	if val, _ := store.Get("othello"); val != "bacon" {
+		t.Errorf("Get() = %v, want %v", val, "bacon")
+	}
+	reclaimable, _, dead, err := store.CompactDryRun()
+	if err != nil {
+		t.Fatalf("CompactDryRun() error = %v", err)
+	}
+	if want := int64(headerSize + len("othello") + len(long)); reclaimable != want || dead != 1 {
+		t.Errorf("CompactDryRun() = %v, %v, want %v, 1", reclaimable, dead, want)
+	}
+}
+
+func TestDiskStore_Preallocate(t *testing.T) {
+	store, err := NewDiskStore("test.db", WithPreallocate(4096))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+
+	store.Set("othello", "shakespeare")
+	store.Set("dune", "frank herbert")
+	end := store.writePosition
+	if size := fileSize(t, "test.db"); size <= int64(end) {
+		t.Errorf("file size = %v, want it preallocated past %v", size, end)
+	}
+	// a crash leaves the preallocated space behind, with a torn record in it
+	crashed, err := os.ReadFile("test.db")
+	if err != nil {
+		t.Fatalf("failed to read the file: %v", err)
+	}
+	_, torn := encodeKV(0, "hamlet", "shakespeare")
+	copy(crashed[end:], torn[:len(torn)-4])
+	store.Close()
+	if size := fileSize(t, "test.db"); size != int64(end) {
+		t.Errorf("file size after Close() = %v, want %v", size, end)
+	}
+	if err := os.WriteFile("test.db", crashed, 0666); err != nil {
+		t.Fatalf("failed to write the file: %v", err)
+	}
+
+	store, err = NewDiskStore("test.db", WithPreallocate(4096))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	if store.writePosition != end {
+		t.Errorf("writePosition = %v, want %v", store.writePosition, end)
+	}
+	// the writes go at the end of the data on the merged file as well
+	if err := store.Merge(); err != nil {
+		t.Fatalf("Merge() error = %v", err)
+	}
+	store.Set("anna karenina", "tolstoy")
+	store.Close()
+
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	tests := map[string]string{"othello": "shakespeare", "dune": "frank herbert", "anna karenina": "tolstoy", "hamlet": ""}
+	for key, val := range tests {
+		if got, _ := store.Get(key); got != val {
+			t.Errorf("Get() = %v, want %v", got, val)
+		}
+	}
+}
+
+func TestDiskStore_ValueValidator(t *testing.T) {
+	errEmpty := errors.New("empty value")
+	validate := func(key, value string) error {
+		if value == "" {
+			return errEmpty
+		}
+		return nil
+	}
+	store, err := NewDiskStore("test.db", WithValueValidator(validate))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	store.Set("othello", "shakespeare")
+	size := fileSize(t, "test.db")
+	if _, err := store.AppendRaw("othello", ""); !errors.Is(err, errEmpty) {
+		t.Errorf("AppendRaw() error = %v, want %v", err, errEmpty)
+	}
+	err = store.Txn(func(tx *Txn) error {
+		tx.Set("dune", "frank herbert")
+		tx.Set("hamlet", "")
+		return nil
+	})
+	if !errors.Is(err, errEmpty) {
+		t.Errorf("Txn() error = %v, want %v", err, errEmpty)
+	}
+	err = store.BulkLoad(func(emit func(key, value string)) error {
+		emit("dune", "frank herbert")
+		emit("hamlet", "")
+		return nil
+	})
+	if !errors.Is(err, errEmpty) {
+		t.Errorf("BulkLoad() error = %v, want %v", err, errEmpty)
+	}
+	if got := fileSize(t, "test.db"); got != size {
+		t.Errorf("file size after the rejected writes = %v, want %v", got, size)
+	}
+	tests := map[string]string{"othello": "shakespeare", "dune": ""}
+	for key, val := range tests {
+		if got, _ := store.Get(key); got != val {
+			t.Errorf("Get() = %v, want %v", got, val)
+		}
+	}
+}
+
+func TestDiskStore_InlineValues(t *testing.T) {
+	store, err := NewDiskStore("test.db", WithInlineValues(16))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+
+	store.Set("othello", "shakespeare")
+	store.Set("dune", strings.Repeat("a", 17))
+	store.Set("empty", "")
+	if store.keyDir["othello"].value == nil || store.keyDir["empty"].value == nil || store.keyDir["dune"].value != nil {
+		t.Errorf("inline values = %v, want only the values of up to 16 bytes", store.keyDir)
+	}
+	store.Set("othello", "marlowe")
+	store.Close()
+
+	store, err = NewDiskStore("test.db", WithInlineValues(16))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	if string(store.keyDir["othello"].value) != "marlowe" {
+		t.Errorf("inline value after reopening = %q, want %q", store.keyDir["othello"].value, "marlowe")
+	}
+	if val, err := store.GetUncached("othello"); val != "marlowe" || err != nil {
+		t.Errorf("GetUncached() = (%v, %v), want (marlowe, nil)", val, err)
+	}
+	// Get does not read the disk for the inline values
+	kEntry := store.keyDir["othello"]
+	kEntry.position = 0
+	store.keyDir["othello"] = kEntry
+	if val, err := store.Get("othello"); val != "marlowe" || err != nil {
+		t.Errorf("Get() = (%v, %v), want (marlowe, nil)", val, err)
+	}
+	// while GetUncached does, and finds the file header there
+	if _, err := store.GetUncached("othello"); !errors.Is(err, ErrCorruptRecord) {
+		t.Errorf("GetUncached() error = %v, want %v", err, ErrCorruptRecord)
+	}
+}
+
+func TestDiskStore_GetTruncated(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	store.Set("othello", "shakespeare")
+	store.Set("dune", "frank herbert")
+	// somebody else cuts the file in the middle of the record of dune
+	if err := os.Truncate("test.db", int64(store.keyDir["dune"].position)+10); err != nil {
+		t.Fatalf("failed to truncate the file: %v", err)
+	}
+	if _, err := store.Get("dune"); !errors.Is(err, ErrCorruptRecord) {
+		t.Errorf("Get() error = %v, want %v", err, ErrCorruptRecord)
+	}
+	if _, _, err := store.ReadRecordAt(int64(store.keyDir["dune"].position)); !errors.Is(err, ErrCorruptRecord) {
+		t.Errorf("ReadRecordAt() error = %v, want %v", err, ErrCorruptRecord)
+	}
+	if val, _ := store.Get("othello"); val != "shakespeare" {
+		t.Errorf("Get() = %v, want %v", val, "shakespeare")
+	}
+}
+
+func TestDiskStore_GetWithTimeout(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	store.Set("othello", "shakespeare")
+	if val, err := store.GetWithTimeout("othello", time.Second); val != "shakespeare" || err != nil {
+		t.Errorf("GetWithTimeout() = (%v, %v), want (shakespeare, nil)", val, err)
+	}
+	// a writer holding the lock stands in for a hanging disk
+	store.mu.Lock()
+	_, err = store.GetWithTimeout("othello", 10*time.Millisecond)
+	store.mu.Unlock()
+	if err != context.DeadlineExceeded {
+		t.Errorf("GetWithTimeout() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestDiskStore_NoIndex(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	store.Set("othello", "marlowe")
+	store.Close()
+
+	store, err = NewDiskStore("test.db", WithNoIndex())
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("othello", "shakespeare")
+	store.Set("dune", "frank herbert")
+	if err := store.Delete("dune"); err != nil {
+		t.Errorf("Delete() error = %v", err)
+	}
+	if _, err := store.Get("othello"); !errors.Is(err, ErrNoIndex) {
+		t.Errorf("Get() error = %v, want %v", err, ErrNoIndex)
+	}
+	if err := store.Merge(); !errors.Is(err, ErrNoIndex) {
+		t.Errorf("Merge() error = %v, want %v", err, ErrNoIndex)
+	}
+	store.Close()
+
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	tests := map[string]string{"othello": "shakespeare", "dune": ""}
+	for key, val := range tests {
+		if got, _ := store.Get(key); got != val {
+			t.Errorf("Get() = %v, want %v", got, val)
+		}
+	}
+}
+
+func TestDiskStore_CloseTwice(t *testing.T) {
+	store, err := NewDiskStore("test.db", WithGroupCommit(time.Millisecond), WithInlineValues(64))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+	store.Set("othello", "shakespeare")
+	if !store.Close() {
+		t.Fatalf("Close() failed")
+	}
+	if !store.Close() {
+		t.Errorf("second Close() failed")
+	}
+	// the value is inline, so nothing would stop Get from returning it otherwise
+	if _, err := store.Get("othello"); !errors.Is(err, ErrClosed) {
+		t.Errorf("Get() error = %v, want %v", err, ErrClosed)
+	}
+	if err := store.Delete("othello"); !errors.Is(err, ErrClosed) {
+		t.Errorf("Delete() error = %v, want %v", err, ErrClosed)
+	}
+	if err := store.SyncAndWait(); !errors.Is(err, ErrClosed) {
+		t.Errorf("SyncAndWait() error = %v, want %v", err, ErrClosed)
+	}
+}
+
+func TestDiskStore_BaseOffset(t *testing.T) {
+	prefix := bytes.Repeat([]byte("container "), 10)
+	if err := os.WriteFile("test.db", prefix, 0666); err != nil {
+		t.Fatalf("failed to write the file: %v", err)
+	}
+	defer os.Remove("test.db")
+	base := WithBaseOffset(int64(len(prefix)))
+	if _, err := NewDiskStore("test.db", base, WithMmap()); err == nil {
+		t.Errorf("NewDiskStore() with WithMmap did not fail")
+	}
+	store, err := NewDiskStore("test.db", base)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	if !store.Created() {
+		t.Errorf("Created() = false for an empty region")
+	}
+	store.Set("othello", "shakespeare")
+	store.Set("dune", "frank herbert")
+	store.Delete("dune")
+	if err := store.Merge(); !errors.Is(err, ErrBaseOffset) {
+		t.Errorf("Merge() error = %v, want %v", err, ErrBaseOffset)
+	}
+	store.Close()
+
+	data, err := os.ReadFile("test.db")
+	if err != nil {
+		t.Fatalf("failed to read the file: %v", err)
+	}
+	if !bytes.Equal(data[:len(prefix)], prefix) {
+		t.Errorf("the bytes before the base offset changed")
+	}
+	if version, ok := decodeFileHeader(data[len(prefix):]); !ok || version != formatVersion {
+		t.Errorf("no file header at the base offset")
+	}
+
+	store, err = NewDiskStore("test.db", base, WithReaderPool(2), WithVerifyOnStartup())
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	tests := map[string]string{"othello": "shakespeare", "dune": ""}
+	for key, val := range tests {
+		if got, _ := store.Get(key); got != val {
+			t.Errorf("Get() = %v, want %v", got, val)
+		}
+	}
+	if found, err := store.CheckConsistency(); err != nil || len(found) != 0 {
+		t.Errorf("CheckConsistency() = %v, %v", found, err)
+	}
+}
@@ -0,0 +1,77 @@
+package caskdb
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrKeyNotFound is returned when the key does not exist in the store.
+var ErrKeyNotFound = errors.New("caskdb: key not found")
+
+// ErrCorruptRecord is returned when a record read from the disk turns out to be
+// damaged, or is not the record we were looking for.
+var ErrCorruptRecord = errors.New("caskdb: corrupt record")
+
+// ErrReadOnly is returned by the writes to a store which was opened with
+// WithReplicaMode.
+var ErrReadOnly = errors.New("caskdb: the store is read only")
+
+// ErrNoIndex is returned by the reads, and everything else which needs the keyDir,
+// on a store which was opened with WithNoIndex.
+var ErrNoIndex = errors.New("caskdb: the store has no index")
+
+// ErrRecordLimit is returned by the writes which would take the number of keys in
+// the store over the limit set by WithMaxRecordCount.
+var ErrRecordLimit = errors.New("caskdb: the store holds the maximum number of keys")
+
+// ErrClosed is returned by the methods of a store which has been closed, see
+// Close.
+var ErrClosed = errors.New("caskdb: the store is closed")
+
+// ErrIndexMemory is returned by the writes of new keys which would take the keyDir
+// over the memory allowed by WithMaxIndexMemory.
+var ErrIndexMemory = errors.New("caskdb: the index would take more memory than allowed")
+
+// ErrBaseOffset is returned by Merge, InPlaceCompact, PurgeKeys and ReplaceAll on
+// a store opened with WithBaseOffset, since they would rewrite the whole file the
+// store is embedded in.
+var ErrBaseOffset = errors.New("caskdb: the file cannot be rewritten, the store is embedded at a base offset")
+
+// ErrDuplicateKey is returned by BulkLoad when fn emits the same key twice, on a
+// store opened with WithBulkLoadDuplicates(DuplicateFail).
+var ErrDuplicateKey = errors.New("caskdb: the key was emitted more than once")
+
+// ErrDiskFull is returned by the writes which ran out of space on the disk. The
+// part of the record which was written is cut off the file, so the store is left
+// as it was before the write.
+var ErrDiskFull = errors.New("caskdb: the disk is full")
+
+// ErrOwnDataFile is returned by WriteCompactedTo when the path is the data file of
+// the store itself, under whatever name.
+var ErrOwnDataFile = errors.New("caskdb: the path is the data file of the store")
+
+// ErrStartupTimeout is returned by NewDiskStore when loading the file takes longer
+// than WithMaxStartupDuration allows.
+var ErrStartupTimeout = errors.New("caskdb: loading the file took too long")
+
+// ErrNoShards is returned by NewMultiStore when it is given no shards.
+var ErrNoShards = errors.New("caskdb: the multi store has no shards")
+
+// ErrShardOutOfRange is returned by the methods of MultiStore when the shard
+// function maps the key to an index which is not one of the shards.
+var ErrShardOutOfRange = errors.New("caskdb: the shard of the key is out of range")
+
+// CorruptError is returned by NewDiskStore when it cannot load the file, because
+// the file is not a caskdb file or one of its records is damaged. Offset tells
+// where in the file the problem was found, so that the user can inspect the file
+// and decide what to do with it.
+type CorruptError struct {
+	// Offset is the byte offset in the file at which the loading failed
+	Offset int64
+	// Reason describes what is wrong with the data at the offset
+	Reason string
+}
+
+func (e *CorruptError) Error() string {
+	return fmt.Sprintf("caskdb: corrupt file at offset %d: %s", e.Offset, e.Reason)
+}
@@ -0,0 +1,146 @@
+package caskdb
+
+import (
+	"errors"
+	"sort"
+)
+
+// errNoAccessTracking is returned by EvictLRU on a store which does not track the
+// accesses.
+var errNoAccessTracking = errors.New("caskdb: EvictLRU needs WithAccessTracking")
+
+// touch records that the key was just used, with WithAccessTracking. The caller
+// must hold the lock.
+func (d *DiskStore) touch(key string) {
+	if access := d.lastAccess[key]; access != nil {
+		access.Store(d.now().UnixNano())
+	}
+}
+
+// EvictLRU deletes the least recently used keys, till the live records take at
+// most targetBytes on the disk, and returns the number of keys it deleted. This
+// turns the store into a persistent cache bounded in size. The store must be
+// opened with WithAccessTracking.
+//
+// The live size counts only the latest record of every key. The deleted records
+// and the tombstones which EvictLRU writes take space in the file till the next
+// Merge, so run Merge after evicting to actually shrink the file. See WithOnEvict
+// to be told about the keys which are deleted.
+func (d *DiskStore) EvictLRU(targetBytes int64) (int, error) {
+	evicted, err := d.evictLRU(targetBytes)
+	if d.opts.onEvict != nil {
+		for _, key := range evicted {
+			d.opts.onEvict(key, EvictCapacity)
+		}
+	}
+	return len(evicted), err
+}
+
+// evictLRU deletes the least recently used keys for EvictLRU, and returns them.
+func (d *DiskStore) evictLRU(targetBytes int64) ([]string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return nil, ErrClosed
+	}
+	if !d.opts.accessTracking {
+		return nil, errNoAccessTracking
+	}
+	var liveBytes int64
+	keys := make([]string, 0, len(d.keyDir))
+	for key, kEntry := range d.keyDir {
+		liveBytes += int64(kEntry.totalSize)
+		keys = append(keys, key)
+	}
+	if liveBytes <= targetBytes {
+		return nil, nil
+	}
+	lastAccess := func(key string) int64 {
+		if access := d.lastAccess[key]; access != nil {
+			return access.Load()
+		}
+		return 0
+	}
+	sort.Slice(keys, func(i, j int) bool { return lastAccess(keys[i]) < lastAccess(keys[j]) })
+	var evicted []string
+	for _, key := range keys {
+		if liveBytes <= targetBytes {
+			break
+		}
+		size := int64(d.keyDir[key].totalSize)
+		if err := d.delete(key); err != nil {
+			return evicted, err
+		}
+		liveBytes -= size
+		evicted = append(evicted, key)
+	}
+	return evicted, nil
+}
+
+// indexLowWatermark is the share of WithMaxIndexMemory the keyDir is brought down
+// to, once IndexMemoryEvictOldest has to evict.
+const indexLowWatermark = 0.9
+
+// checkIndexRoom tells whether the keyDir can grow by the given memory without
+// going over WithMaxIndexMemory. If it cannot, it returns ErrIndexMemory, or
+// true when the oldest keys have to be evicted, as per the policy. Nothing is
+// evicted yet, so that a write which fails after the check loses no keys: the
+// caller evicts with makeIndexRoom once its write is in. The caller must hold the
+// write lock.
+func (d *DiskStore) checkIndexRoom(memory int64) (bool, error) {
+	if d.opts.maxIndexMemory <= 0 || d.indexMemory+memory <= d.opts.maxIndexMemory {
+		return false, nil
+	}
+	if d.opts.indexMemoryPolicy != IndexMemoryEvictOldest || memory > d.opts.maxIndexMemory {
+		return false, ErrIndexMemory
+	}
+	return true, nil
+}
+
+// makeIndexRoom evicts the oldest keys, after a write which grew the keyDir by
+// the given memory past WithMaxIndexMemory, see checkIndexRoom. The keys of the
+// write itself are kept. The write is in already, so a failed eviction does not
+// fail it, and is only logged. The caller must hold the write lock, and must
+// release it with unlockAndNotify.
+func (d *DiskStore) makeIndexRoom(memory int64, written ...string) {
+	keep := make(map[string]bool, len(written))
+	for _, key := range written {
+		keep[key] = true
+	}
+	keys := make([]string, 0, len(d.keyDir))
+	for key := range d.keyDir {
+		if !keep[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return d.keyDir[keys[i]].timestamp < d.keyDir[keys[j]].timestamp })
+	// the keyDir comes down to the low watermark, as if the write had come after
+	// the eviction
+	target := int64(float64(d.opts.maxIndexMemory)*indexLowWatermark) + memory
+	if target > d.opts.maxIndexMemory {
+		target = d.opts.maxIndexMemory
+	}
+	for _, key := range keys {
+		if d.indexMemory <= target {
+			break
+		}
+		if err := d.delete(key); err != nil {
+			d.logf("failed to evict the key %q: %v", key, err)
+			return
+		}
+		if d.opts.onEvict != nil {
+			d.evicted = append(d.evicted, key)
+		}
+	}
+}
+
+// unlockAndNotify releases the write lock, and then calls WithOnEvict with the
+// keys makeIndexRoom evicted while it was held.
+func (d *DiskStore) unlockAndNotify() {
+	evicted := d.evicted
+	d.evicted = nil
+	d.mu.Unlock()
+	for _, key := range evicted {
+		d.opts.onEvict(key, EvictIndexMemory)
+	}
+}
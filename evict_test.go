@@ -0,0 +1,156 @@
+package caskdb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiskStore_EvictLRU(t *testing.T) {
+	now := time.Unix(1000, 0)
+	store, err := NewDiskStore("test.db", WithAccessTracking(), WithClock(func() time.Time { return now }))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	for _, key := range []string{"othello", "dune", "hamlet"} {
+		store.Set(key, "value")
+		now = now.Add(time.Second)
+	}
+	// othello is the oldest write, but it was read last
+	store.Get("othello")
+	size := int64(store.keyDir["othello"].totalSize)
+	evicted, err := store.EvictLRU(size * 2)
+	if err != nil {
+		t.Fatalf("EvictLRU() error = %v", err)
+	}
+	if evicted != 1 {
+		t.Errorf("EvictLRU() evicted %v keys, want 1", evicted)
+	}
+	tests := map[string]string{"othello": "value", "dune": "", "hamlet": "value"}
+	for key, val := range tests {
+		if got, _ := store.Get(key); got != val {
+			t.Errorf("Get() = %v, want %v", got, val)
+		}
+	}
+	if evicted, _ := store.EvictLRU(size * 2); evicted != 0 {
+		t.Errorf("EvictLRU() under the target evicted %v keys", evicted)
+	}
+}
+
+func TestDiskStore_EvictLRUWithoutTracking(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+	if _, err := store.EvictLRU(0); !errors.Is(err, errNoAccessTracking) {
+		t.Errorf("EvictLRU() error = %v, want %v", err, errNoAccessTracking)
+	}
+}
+
+func TestDiskStore_OnEvict(t *testing.T) {
+	var store *DiskStore
+	var evicted []string
+	onEvict := func(key string, reason EvictReason) {
+		if reason != EvictCapacity {
+			t.Errorf("OnEvict() reason = %v, want %v", reason, EvictCapacity)
+		}
+		// the store is not locked anymore
+		if _, err := store.Get(key); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Get() of an evicted key error = %v, want %v", err, ErrKeyNotFound)
+		}
+		evicted = append(evicted, key)
+	}
+	store, err := NewDiskStore("test.db", WithAccessTracking(), WithOnEvict(onEvict))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	store.Set("othello", "shakespeare")
+	store.Delete("othello")
+	store.Set("dune", "frank herbert")
+	if _, err := store.EvictLRU(0); err != nil {
+		t.Fatalf("EvictLRU() error = %v", err)
+	}
+	if len(evicted) != 1 || evicted[0] != "dune" {
+		t.Errorf("OnEvict() called with %v, want [dune]", evicted)
+	}
+}
+
+func TestDiskStore_MaxIndexMemory(t *testing.T) {
+	entry := entryMemory("key0", KeyEntry{})
+	store, err := NewDiskStore("test.db", WithMaxIndexMemory(entry*3, IndexMemoryReject))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	for i := 0; i < 3; i++ {
+		store.Set(fmt.Sprint("key", i), "value")
+	}
+	if _, _, err := store.Swap("key3", "value"); !errors.Is(err, ErrIndexMemory) {
+		t.Errorf("Swap() of a new key error = %v, want %v", err, ErrIndexMemory)
+	}
+	if _, _, err := store.Swap("key0", "new value"); err != nil {
+		t.Errorf("Swap() of an existing key error = %v", err)
+	}
+	store.Close()
+
+	var evicted []string
+	onEvict := func(key string, reason EvictReason) {
+		if reason != EvictIndexMemory {
+			t.Errorf("onEvict() reason = %v, want %v", reason, EvictIndexMemory)
+		}
+		evicted = append(evicted, key)
+	}
+	store, err = NewDiskStore("test.db", WithMaxIndexMemory(entry*3, IndexMemoryEvictOldest), WithOnEvict(onEvict))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	// key0 was overwritten last, so key1 is the oldest
+	store.Set("key3", "value")
+	if fmt.Sprint(evicted) != "[key1]" {
+		t.Errorf("evicted %v, want [key1]", evicted)
+	}
+
+	// a write which fails evicts nothing, while the tombstones would go through
+	evicted = nil
+	store.writeHook = func(p []byte) (int, error) {
+		if strings.Contains(string(p), "key4") {
+			return 0, errors.New("write failed")
+		}
+		return store.file.Write(p)
+	}
+	if err := store.Set("key4", "value"); err == nil {
+		t.Errorf("Set() with a failing write did not fail")
+	}
+	store.writeHook = nil
+	if len(evicted) != 0 {
+		t.Errorf("evicted %v for a failed write, want none", evicted)
+	}
+	if val, _ := store.Get("key2"); val != "value" {
+		t.Errorf("Get(%q) = %v, want %v", "key2", val, "value")
+	}
+	store.Close()
+
+	// the evicted key stays deleted
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	tests := map[string]string{"key0": "new value", "key1": "", "key2": "value", "key3": "value"}
+	for key, val := range tests {
+		if got, _ := store.Get(key); got != val {
+			t.Errorf("Get(%q) = %v, want %v", key, got, val)
+		}
+	}
+}
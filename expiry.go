@@ -0,0 +1,65 @@
+package caskdb
+
+import "time"
+
+// SetWithExpiry stores the value for the key, just like Set, along with the time
+// at which the key expires. Once expireAt has passed, as per the clock of
+// WithClock, the reads like Get treat the key as missing. This suits the callers
+// which get their expiries from a schedule, rather than as durations from now.
+// With the zero time, the key never expires.
+//
+// The expiry is stored in the record itself, see flagExpiry, so it survives a
+// restart. An expired key still takes its space in keyDir and in the file till
+// the next Merge or InPlaceCompact, which drop it along with all its records. No
+// tombstone is written for it, so, like with PurgeKeys, whatever follows the log
+// never finds out that the key is gone. Overwriting the key with Set clears its
+// expiry, while Rename carries it over to the new key.
+func (d *DiskStore) SetWithExpiry(key string, value string, expireAt time.Time) error {
+	d.mu.Lock()
+	defer d.unlockAndNotify()
+	if d.closed {
+		return ErrClosed
+	}
+	if expireAt.IsZero() {
+		return d.set(key, value)
+	}
+	return d.setExtended(key, value, extension{expireAt: expireAt.UnixNano()})
+}
+
+// ExpiresAt returns the time at which the key expires, and false if it never
+// does. It returns ErrKeyNotFound if the key does not exist or has expired
+// already.
+func (d *DiskStore) ExpiresAt(key string) (time.Time, bool, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return time.Time{}, false, ErrClosed
+	}
+	if d.opts.noIndex {
+		return time.Time{}, false, ErrNoIndex
+	}
+	kEntry, ok := d.lookup(key)
+	if !ok {
+		return time.Time{}, false, ErrKeyNotFound
+	}
+	if kEntry.expireAt == 0 {
+		return time.Time{}, false, nil
+	}
+	return time.Unix(0, kEntry.expireAt), true, nil
+}
+
+// lookup returns the KeyEntry of the key, and false if the key is not there or
+// has expired. The caller must hold the lock.
+func (d *DiskStore) lookup(key string) (KeyEntry, bool) {
+	kEntry, ok := d.keyDir[key]
+	if !ok || (kEntry.expireAt != 0 && kEntry.expired(d.now().UnixNano())) {
+		return KeyEntry{}, false
+	}
+	return kEntry, true
+}
+
+// expired reports whether the key has expired as of now, in unix epoch
+// nanoseconds.
+func (k KeyEntry) expired(now int64) bool {
+	return k.expireAt != 0 && now >= k.expireAt
+}
@@ -0,0 +1,61 @@
+package caskdb
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDiskStore_SetWithExpiry(t *testing.T) {
+	now := time.Unix(1000, 0)
+	clock := WithClock(func() time.Time { return now })
+	store, err := NewDiskStore("test.db", clock)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+
+	expireAt := now.Add(time.Minute)
+	if err := store.SetWithExpiry("othello", "shakespeare", expireAt); err != nil {
+		t.Fatalf("SetWithExpiry() error = %v", err)
+	}
+	store.Set("dune", "frank herbert")
+	if got, _ := store.Get("othello"); got != "shakespeare" {
+		t.Errorf("Get() = %v, want shakespeare", got)
+	}
+	if _, ok, err := store.ExpiresAt("dune"); ok || err != nil {
+		t.Errorf("ExpiresAt() of a key without expiry = %v, %v", ok, err)
+	}
+	store.Close()
+
+	// the expiry survives a restart
+	store, err = NewDiskStore("test.db", clock, WithVerifyOnStartup())
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	if got, ok, err := store.ExpiresAt("othello"); !ok || err != nil || !got.Equal(expireAt) {
+		t.Errorf("ExpiresAt() = %v, %v, %v, want %v", got, ok, err, expireAt)
+	}
+	if found, err := store.CheckConsistency(); err != nil || len(found) != 0 {
+		t.Errorf("CheckConsistency() = %v, %v", found, err)
+	}
+
+	now = expireAt
+	if _, err := store.Get("othello"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Get() of an expired key error = %v, want %v", err, ErrKeyNotFound)
+	}
+	if _, _, err := store.ExpiresAt("othello"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("ExpiresAt() of an expired key error = %v, want %v", err, ErrKeyNotFound)
+	}
+	if err := store.Merge(); err != nil {
+		t.Fatalf("Merge() error = %v", err)
+	}
+	if _, ok := store.keyDir["othello"]; ok {
+		t.Errorf("Merge() kept the expired key")
+	}
+	if got, _ := store.Get("dune"); got != "frank herbert" {
+		t.Errorf("Get() = %v, want frank herbert", got)
+	}
+}
@@ -33,79 +33,460 @@ package caskdb
 //
 //For the workshop, the functions will have the following signature:
 //
-//    func encodeKV(timestamp uint32, key string, value string) (int, []byte)
-//    func decodeKV(data []byte) (uint32, string, string)
+//    func encodeKV(timestamp int64, key string, value string) (int, []byte)
+//    func decodeKV(data []byte) (int64, string, string)
 
-import "encoding/binary"
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+// fileHeaderSize is the size of the header at the very beginning of the file,
+// before any of the records:
+//
+//	┌───────────┬─────────────┐
+//	│ magic(4B) │ version(4B) │
+//	└───────────┴─────────────┘
+//
+// The magic bytes tell us that the file is a caskdb file at all, so that we never
+// try to parse some random file as records. The version is the version of the
+// record format, which lets us change the format later and still know how to read
+// the older files.
+const fileHeaderSize = 8
+
+// fileMagic identifies a caskdb file.
+const fileMagic = "CASK"
+
+// formatVersion is the version of the record format this package writes.
+const formatVersion = 2
 
 // headerSize specifies the total header size. Our key value pair, when stored on disk
 // looks like this:
 //
-//	┌───────────┬──────────┬────────────┬─────┬───────┐
-//	│ timestamp │ key_size │ value_size │ key │ value │
-//	└───────────┴──────────┴────────────┴─────┴───────┘
+//	┌─────┬───────────┬──────────┬────────────┬───────┬─────┬───────┐
+//	│ crc │ timestamp │ key_size │ value_size │ flags │ key │ value │
+//	└─────┴───────────┴──────────┴────────────┴───────┴─────┴───────┘
 //
 // This is analogous to a typical database's row (or a record). The total length of
 // the row is variable, depending on the contents of the key and value.
 //
-// The first three fields form the header:
+// The first five fields form the header:
 //
-//	┌───────────────┬──────────────┬────────────────┐
-//	│ timestamp(4B) │ key_size(4B) │ value_size(4B) │
-//	└───────────────┴──────────────┴────────────────┘
+//	┌─────────┬───────────────┬──────────────┬────────────────┬───────────┐
+//	│ crc(4B) │ timestamp(8B) │ key_size(4B) │ value_size(4B) │ flags(1B) │
+//	└─────────┴───────────────┴──────────────┴────────────────┴───────────┘
 //
-// These three fields store unsigned integers of size 4 bytes, giving our header a
-// fixed length of 12 bytes. Timestamp field stores the time the record we
-// inserted in unix epoch seconds. Key size and value size fields store the length of
-// bytes occupied by the key and value. The maximum integer
-// stored by 4 bytes is 4,294,967,295 (2 ** 32 - 1), roughly ~4.2GB. So, the size of
-// each key or value cannot exceed this. Theoretically, a single row can be as large
-// as ~8.4GB.
-const headerSize = 12
+// The timestamp takes 8 bytes, the other three fields store unsigned integers of
+// size 4 bytes and the flags take one more byte, giving our header a fixed length
+// of 21 bytes. The flags field is a bit set describing the record, check
+// flagTombstone, flagBatch, flagPadded, flagExpiry and flagMeta. The crc field
+// stores the CRC-32 checksum of everything which follows it in the row, i.e. rest
+// of the header, key and value. It lets us catch the rows which got corrupted on
+// the disk or were only partially written when the process crashed. Timestamp field
+// stores the time the record we inserted in unix epoch nanoseconds, so that even
+// the writes within the same second are ordered. The format version 1 had it in
+// seconds, in 4 bytes, see Migrate. Key size and value size fields store the length
+// of bytes occupied by the key and value. The maximum integer stored by 4 bytes is
+// 4,294,967,295 (2 ** 32 - 1), roughly ~4.2GB. So, the size of each key or value
+// cannot exceed this. Theoretically, a single row can be as large as ~8.4GB.
+const headerSize = 21
+
+// flagsOffset is the offset of the flags in the record header.
+const flagsOffset = 20
+
+// flagTombstone marks a record as a tombstone. When a key is deleted, we cannot
+// remove its old records from the file, since the file is append only. Instead,
+// we append a tombstone record for the key, which has no value. While building
+// the keyDir, a tombstone removes the key, so the deletion survives a restart.
+// The stale records and the tombstones are reclaimed later by Merge.
+const flagTombstone = 1 << 0
+
+// flagBatch marks a record which holds all the writes of a transaction, see Txn.
+// Its key is empty and its value is the records of the writes, one after the
+// other, each one complete with its own header and crc. The crc of the outer
+// record covers all of them, so a crash in the middle of writing the batch leaves
+// a torn tail, and either every write of the transaction is loaded or none. The
+// keyDir points straight at the inner records, which are read just like any
+// other record.
+const flagBatch = 1 << 1
+
+// flagPadded marks a record which is followed by padding, see WithAlignment. The
+// padding comes right after the value, and starts with its own size:
+//
+//	┌────────┬─────┬───────┬───────────────┬─────────┐
+//	│ header │ key │ value │ pad_size(4B)  │ padding │
+//	└────────┴─────┴───────┴───────────────┴─────────┘
+//
+// The crc covers the padding as well, and the padding is ignored otherwise. The
+// records without this flag have no padding at all, so the files written without
+// WithAlignment look exactly the same as before.
+const flagPadded = 1 << 2
+
+// padSizeSize is the size of the pad_size field of a padded record.
+const padSizeSize = 4
+
+// flagExpiry marks a record whose header is extended with the time at which the
+// key expires, see SetWithExpiry. The extension comes right before the value, and
+// value_size counts it too:
+//
+//	┌────────┬─────┬───────────────┬───────┐
+//	│ header │ key │ expire_at(8B) │ value │
+//	└────────┴─────┴───────────────┴───────┘
+//
+// expire_at is in unix epoch nanoseconds, just like the timestamp. Keeping the
+// fixed header as it is means that the records without the flag look exactly the
+// same as before, and that everything which only sizes the records, like Merge
+// or the startup scan, does not have to know about the extension at all.
+const flagExpiry = 1 << 3
+
+// expirySize is the size of the expire_at field of an expiring record.
+const expirySize = 8
+
+// flagMeta marks a record whose header is extended with the metadata of the
+// application, see SetWithMeta. Just like expire_at, the metadata comes right
+// before the value, after the expire_at if the record has one, and starts with
+// its own size:
+//
+//	┌────────┬─────┬───────────────┬──────┬───────┐
+//	│ header │ key │ meta_size(2B) │ meta │ value │
+//	└────────┴─────┴───────────────┴──────┴───────┘
+//
+// The crc covers the metadata as well, and the records without the flag decode
+// just like before.
+const flagMeta = 1 << 4
+
+// metaSizeSize is the size of the meta_size field of a record with metadata.
+const metaSizeSize = 2
+
+// maxMetaSize is the largest metadata a record can have.
+const maxMetaSize = 1<<16 - 1
+
+// extension is what the header of a record can be extended with, see flagExpiry
+// and flagMeta. The zero extension leaves the header as it is.
+type extension struct {
+	// expireAt is the time at which the key expires in unix epoch nanoseconds, or
+	// zero if it never does
+	expireAt int64
+	// meta is the metadata of the application, nil if there is none
+	meta []byte
+}
+
+// Record is a single record of the log, as read by ReadRecordAt and
+// ScanPhysical, or written by AppendBatch.
+type Record struct {
+	Key   string
+	Value []byte
+	// Timestamp is when the record was written, in unix epoch nanoseconds
+	Timestamp int64
+	// Tombstone reports whether the record deletes its key, in which case it has
+	// no value, see flagTombstone
+	Tombstone bool
+	// Meta is the metadata the record was stored with by SetWithMeta, nil if there
+	// is none
+	Meta []byte
+}
 
 // KeyEntry keeps the metadata about the KV, specially the position of
 // the byte offset in the file. Whenever we insert/update a key, we create a new
 // KeyEntry object and insert that into keyDir.
 type KeyEntry struct {
 	// Timestamp at which we wrote the KV pair to the disk. The value
-	// is current time in seconds since the epoch.
-	timestamp uint32
+	// is current time in nanoseconds since the epoch.
+	timestamp int64
 	// The position is the byte offset in the file where the data
 	// exists
 	position uint32
 	// Total size of bytes of the value. We use this value to know
 	// how many bytes we need to read from the file
 	totalSize uint32
+	// value is a copy of the value kept in the memory, so that Get does not have
+	// to read it from the disk. It is nil unless WithInlineValues is used and the
+	// value is small enough
+	value []byte
+	// expireAt is the time at which the key expires in unix epoch nanoseconds, or
+	// zero if it never does, see SetWithExpiry
+	expireAt int64
 }
 
-func NewKeyEntry(timestamp uint32, position uint32, totalSize uint32) KeyEntry {
-	return KeyEntry{timestamp, position, totalSize}
+func NewKeyEntry(timestamp int64, position uint32, totalSize uint32) KeyEntry {
+	return KeyEntry{timestamp: timestamp, position: position, totalSize: totalSize}
 }
 
-func encodeHeader(timestamp uint32, keySize uint32, valueSize uint32) []byte {
+func encodeFileHeader(version uint32) []byte {
+	header := make([]byte, fileHeaderSize)
+	copy(header[0:4], fileMagic)
+	binary.LittleEndian.PutUint32(header[4:8], version)
+	return header
+}
+
+// decodeFileHeader returns the format version of the file, and false if the header
+// does not have the caskdb magic bytes.
+func decodeFileHeader(header []byte) (uint32, bool) {
+	if string(header[0:4]) != fileMagic {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint32(header[4:8]), true
+}
+
+func encodeHeader(timestamp int64, keySize uint32, valueSize uint32) []byte {
 	header := make([]byte, headerSize)
-	binary.LittleEndian.PutUint32(header[0:4], timestamp)
-	binary.LittleEndian.PutUint32(header[4:8], keySize)
-	binary.LittleEndian.PutUint32(header[8:12], valueSize)
+	binary.LittleEndian.PutUint64(header[4:12], uint64(timestamp))
+	binary.LittleEndian.PutUint32(header[12:16], keySize)
+	binary.LittleEndian.PutUint32(header[16:20], valueSize)
 	return header
 }
 
-func decodeHeader(header []byte) (uint32, uint32, uint32) {
-	timestamp := binary.LittleEndian.Uint32(header[0:4])
-	keySize := binary.LittleEndian.Uint32(header[4:8])
-	valueSize := binary.LittleEndian.Uint32(header[8:12])
+func decodeHeader(header []byte) (int64, uint32, uint32) {
+	timestamp := int64(binary.LittleEndian.Uint64(header[4:12]))
+	keySize := binary.LittleEndian.Uint32(header[12:16])
+	valueSize := binary.LittleEndian.Uint32(header[16:20])
 	return timestamp, keySize, valueSize
 }
 
-func encodeKV(timestamp uint32, key string, value string) (int, []byte) {
+func encodeKV(timestamp int64, key string, value string) (int, []byte) {
+	return encodeRecord(timestamp, key, value, 0)
+}
+
+// encodeTombstone encodes the record which marks the key as deleted.
+func encodeTombstone(timestamp int64, key string) (int, []byte) {
+	return encodeRecord(timestamp, key, "", flagTombstone)
+}
+
+func encodeRecord(timestamp int64, key string, value string, flags byte) (int, []byte) {
 	header := encodeHeader(timestamp, uint32(len(key)), uint32(len(value)))
+	header[flagsOffset] = flags
 	data := append([]byte(key), []byte(value)...)
-	return headerSize + len(data), append(header, data...)
+	record := append(header, data...)
+	binary.LittleEndian.PutUint32(record[0:4], crc32.ChecksumIEEE(record[4:]))
+	return headerSize + len(data), record
+}
+
+// encodeExtendedKV encodes the record with its header extended as per ext. A
+// zero ext gives the same record as encodeKV.
+func encodeExtendedKV(timestamp int64, key string, value string, ext extension) (int, []byte) {
+	var extended []byte
+	var flags byte
+	if ext.expireAt != 0 {
+		extended = binary.LittleEndian.AppendUint64(extended, uint64(ext.expireAt))
+		flags |= flagExpiry
+	}
+	if ext.meta != nil {
+		extended = binary.LittleEndian.AppendUint16(extended, uint16(len(ext.meta)))
+		extended = append(extended, ext.meta...)
+		flags |= flagMeta
+	}
+	return encodeRecord(timestamp, key, string(extended)+value, flags)
 }
 
-func decodeKV(data []byte) (uint32, string, string) {
-	timestamp, keySize, valueSize := decodeHeader(data[0:headerSize])
+// errBadRecord is returned by decodeKV for a record whose fields do not fit in its
+// sizes. Only a corrupt record does that, which the checksum catches, unless the
+// record was loaded without checking it, see WithVerifyOnStartup.
+var errBadRecord = fmt.Errorf("%w: the fields of the record do not fit in its sizes", ErrCorruptRecord)
+
+// decodeKV decodes the record, leaving out the extensions of its header, see
+// decodeExtension. It returns errBadRecord if the key, the value or the
+// extensions run past the sizes of the record.
+func decodeKV(data []byte) (int64, string, string, error) {
+	timestamp, keySize, _ := decodeHeader(data[0:headerSize])
+	field, ok := valueField(data)
+	if !ok {
+		return 0, "", "", errBadRecord
+	}
+	_, size, ok := parseExtension(field, data[flagsOffset])
+	if !ok {
+		return 0, "", "", errBadRecord
+	}
 	key := string(data[headerSize : headerSize+keySize])
-	value := string(data[headerSize+keySize : headerSize+keySize+valueSize])
-	return timestamp, key, value
+	return timestamp, key, string(field[size:]), nil
+}
+
+// decodeRecord decodes the record, like decodeKV, along with its flags and its
+// metadata.
+func decodeRecord(data []byte) (Record, error) {
+	timestamp, key, value, err := decodeKV(data)
+	if err != nil {
+		return Record{}, err
+	}
+	return Record{
+		Key:       key,
+		Value:     []byte(value),
+		Timestamp: timestamp,
+		Tombstone: isTombstone(data),
+		Meta:      decodeExtension(data).meta,
+	}, nil
+}
+
+// fieldsFit reports whether the key, the value and the extensions of the record
+// fit in its sizes, i.e. whether decodeKV succeeds.
+func fieldsFit(data []byte) bool {
+	field, ok := valueField(data)
+	if !ok {
+		return false
+	}
+	_, _, ok = parseExtension(field, data[flagsOffset])
+	return ok
+}
+
+// valueField returns the value field of the record, the extensions of its header
+// included, or false if its sizes run past the end of data.
+func valueField(data []byte) ([]byte, bool) {
+	_, keySize, valueSize := decodeHeader(data)
+	start := int64(headerSize) + int64(keySize)
+	if start+int64(valueSize) > int64(len(data)) {
+		return nil, false
+	}
+	return data[start : start+int64(valueSize)], true
+}
+
+// parseExtension reads the extensions at the start of the value field, as per the
+// flags, and returns them along with how many bytes they take. The metadata is
+// not copied out of the field. It returns false if the extensions do not fit in
+// the field.
+func parseExtension(field []byte, flags byte) (extension, int, bool) {
+	var ext extension
+	size := 0
+	if flags&flagExpiry != 0 {
+		if len(field) < expirySize {
+			return extension{}, 0, false
+		}
+		ext.expireAt = int64(binary.LittleEndian.Uint64(field[:expirySize]))
+		size += expirySize
+	}
+	if flags&flagMeta != 0 {
+		if len(field)-size < metaSizeSize {
+			return extension{}, 0, false
+		}
+		metaSize := int(binary.LittleEndian.Uint16(field[size : size+metaSizeSize]))
+		size += metaSizeSize
+		if len(field)-size < metaSize {
+			return extension{}, 0, false
+		}
+		ext.meta = field[size : size+metaSize]
+		size += metaSize
+	}
+	return ext, size, true
+}
+
+// decodeExtension returns what the header of the record is extended with, or
+// nothing if the extensions do not fit in the record, see decodeKV.
+func decodeExtension(data []byte) extension {
+	field, ok := valueField(data)
+	if !ok {
+		return extension{}
+	}
+	ext, _, ok := parseExtension(field, data[flagsOffset])
+	if !ok {
+		return extension{}
+	}
+	if ext.meta != nil {
+		ext.meta = append([]byte{}, ext.meta...)
+	}
+	return ext
+}
+
+// recordExpiry returns the expire_at of the record, or zero if it has none.
+func recordExpiry(data []byte) int64 {
+	if data[flagsOffset]&flagExpiry == 0 {
+		return 0
+	}
+	return decodeExtension(data).expireAt
+}
+
+// isTombstone reports whether the record, or just its header, is a tombstone.
+func isTombstone(data []byte) bool {
+	return data[flagsOffset]&flagTombstone != 0
+}
+
+// isPadded reports whether the record, or just its header, is followed by
+// padding.
+func isPadded(data []byte) bool {
+	return data[flagsOffset]&flagPadded != 0
+}
+
+// recordSize returns the total size of the record at the beginning of data,
+// padding included. data must have at least the header, and the pad_size too if
+// the record is padded, otherwise recordSize returns false.
+func recordSize(data []byte) (int64, bool) {
+	if len(data) < headerSize {
+		return 0, false
+	}
+	_, keySize, valueSize := decodeHeader(data)
+	size := int64(headerSize) + int64(keySize) + int64(valueSize)
+	if !isPadded(data) {
+		return size, true
+	}
+	if int64(len(data)) < size+padSizeSize {
+		return 0, false
+	}
+	return size + padSizeSize + int64(binary.LittleEndian.Uint32(data[size:size+padSizeSize])), true
+}
+
+// alignRecord pads the record, so that the record which follows it starts at a
+// multiple of alignment, given the record itself is written at the position. Any
+// padding the record had already is replaced. Without an alignment, the record is
+// returned as it is.
+func alignRecord(record []byte, position int64, alignment int) []byte {
+	if isPadded(record) {
+		_, keySize, valueSize := decodeHeader(record)
+		record = append([]byte{}, record[:headerSize+keySize+valueSize]...)
+		record[flagsOffset] &^= flagPadded
+		binary.LittleEndian.PutUint32(record[0:4], crc32.ChecksumIEEE(record[4:]))
+	}
+	if alignment <= 1 {
+		return record
+	}
+	size := int64(len(record)) + padSizeSize
+	pad := (int64(alignment) - (position+size)%int64(alignment)) % int64(alignment)
+	padded := make([]byte, size+pad)
+	copy(padded, record)
+	padded[flagsOffset] |= flagPadded
+	binary.LittleEndian.PutUint32(padded[len(record):size], uint32(pad))
+	binary.LittleEndian.PutUint32(padded[0:4], crc32.ChecksumIEEE(padded[4:]))
+	return padded
+}
+
+// alignmentFiller returns the record which goes right after the file header, so
+// that the first real record starts at a multiple of alignment. It is an empty
+// batch, which changes nothing when loaded. It returns nil when the file header
+// is aligned already.
+func alignmentFiller(alignment int) []byte {
+	if alignment <= 1 || fileHeaderSize%alignment == 0 {
+		return nil
+	}
+	_, filler := encodeRecord(0, "", "", flagBatch)
+	return alignRecord(filler, fileHeaderSize, alignment)
+}
+
+// isBatch reports whether the record, or just its header, holds a batch of
+// records.
+func isBatch(data []byte) bool {
+	return data[flagsOffset]&flagBatch != 0
+}
+
+// splitBatch returns the offsets of the records inside the value of a batch
+// record, relative to the start of the value. It returns false if the records do
+// not add up to the value exactly, or if one of them is a batch itself or is
+// padded.
+func splitBatch(value []byte) ([]int, bool) {
+	var offsets []int
+	for offset := 0; offset < len(value); {
+		if len(value)-offset < headerSize {
+			return nil, false
+		}
+		_, keySize, valueSize := decodeHeader(value[offset:])
+		size := int64(headerSize) + int64(keySize) + int64(valueSize)
+		if size > int64(len(value)-offset) || isBatch(value[offset:]) || isPadded(value[offset:]) {
+			return nil, false
+		}
+		offsets = append(offsets, offset)
+		offset += int(size)
+	}
+	return offsets, true
+}
+
+// validChecksum checks the crc stored in the header of the row against the rest
+// of the row.
+func validChecksum(data []byte) bool {
+	return binary.LittleEndian.Uint32(data[0:4]) == crc32.ChecksumIEEE(data[4:])
 }
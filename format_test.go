@@ -1,12 +1,14 @@
 package caskdb
 
 import (
+	"bytes"
+	"errors"
 	"testing"
 )
 
 func Test_encodeHeader(t *testing.T) {
 	tests := []struct {
-		timestamp uint32
+		timestamp int64
 		keySize   uint32
 		valueSize uint32
 	}{
@@ -31,7 +33,7 @@ func Test_encodeHeader(t *testing.T) {
 
 func Test_encodeKV(t *testing.T) {
 	tests := []struct {
-		timestamp uint32
+		timestamp int64
 		key       string
 		value     string
 		size      int
@@ -42,7 +44,7 @@ func Test_encodeKV(t *testing.T) {
 	}
 	for _, tt := range tests {
 		size, data := encodeKV(tt.timestamp, tt.key, tt.value)
-		timestamp, key, value := decodeKV(data)
+		timestamp, key, value, _ := decodeKV(data)
 		if timestamp != tt.timestamp {
 			t.Errorf("encodeKV() timestamp = %v, want %v", timestamp, tt.timestamp)
 		}
@@ -57,3 +59,100 @@ func Test_encodeKV(t *testing.T) {
 		}
 	}
 }
+
+func Test_encodeExtendedKV(t *testing.T) {
+	tests := []extension{
+		{},
+		{expireAt: 1000},
+		{meta: []byte("text/plain")},
+		{expireAt: 1000, meta: []byte("text/plain")},
+	}
+	for _, tt := range tests {
+		_, data := encodeExtendedKV(10, "hello", "world", tt)
+		if _, key, value, _ := decodeKV(data); key != "hello" || value != "world" {
+			t.Errorf("decodeKV() of %+v = (%v, %v), want (hello, world)", tt, key, value)
+		}
+		if ext := decodeExtension(data); ext.expireAt != tt.expireAt || string(ext.meta) != string(tt.meta) {
+			t.Errorf("decodeExtension() = %+v, want %+v", ext, tt)
+		}
+		if !validChecksum(data) {
+			t.Errorf("validChecksum() of %+v = false, want true", tt)
+		}
+	}
+}
+
+func Test_validChecksum(t *testing.T) {
+	_, data := encodeKV(10, "hello", "world")
+	if !validChecksum(data) {
+		t.Errorf("validChecksum() = false, want true")
+	}
+	data[len(data)-1] ^= 0xff
+	if validChecksum(data) {
+		t.Errorf("validChecksum() = true for a corrupted row, want false")
+	}
+}
+
+func Test_encodeTombstone(t *testing.T) {
+	size, data := encodeTombstone(10, "hello")
+	if size != headerSize+5 {
+		t.Errorf("encodeTombstone() size = %v, want %v", size, headerSize+5)
+	}
+	if !isTombstone(data) {
+		t.Errorf("isTombstone() = false, want true")
+	}
+	if _, data := encodeKV(10, "hello", ""); isTombstone(data) {
+		t.Errorf("isTombstone() = true for a regular record, want false")
+	}
+	if _, key, _, _ := decodeKV(data); key != "hello" {
+		t.Errorf("decodeKV() key = %v, want %v", key, "hello")
+	}
+}
+
+func Test_encodeFileHeader(t *testing.T) {
+	version, ok := decodeFileHeader(encodeFileHeader(formatVersion))
+	if !ok || version != formatVersion {
+		t.Errorf("decodeFileHeader() = (%v, %v), want (%v, true)", version, ok, formatVersion)
+	}
+	if _, ok := decodeFileHeader([]byte("not caskdb")); ok {
+		t.Errorf("decodeFileHeader() = true for a random file, want false")
+	}
+}
+
+func Test_alignRecord(t *testing.T) {
+	_, record := encodeKV(10, "othello", "shakespeare")
+	if got := alignRecord(record, 8, 1); !bytes.Equal(got, record) {
+		t.Errorf("alignRecord() without alignment changed the record")
+	}
+	padded := alignRecord(record, 8, 64)
+	if (8+len(padded))%64 != 0 || !isPadded(padded) || !validChecksum(padded) {
+		t.Errorf("alignRecord() = %v bytes, padded %v, valid %v", len(padded), isPadded(padded), validChecksum(padded))
+	}
+	if size, ok := recordSize(padded); !ok || size != int64(len(padded)) {
+		t.Errorf("recordSize() = %v, %v, want %v", size, ok, len(padded))
+	}
+	if _, key, value, _ := decodeKV(padded); key != "othello" || value != "shakespeare" {
+		t.Errorf("decodeKV() = (%v, %v), want (othello, shakespeare)", key, value)
+	}
+	// padding again replaces the old padding
+	if got := alignRecord(padded, 0, 1); !bytes.Equal(got, record) {
+		t.Errorf("alignRecord() did not strip the padding")
+	}
+}
+
+func TestDecodeKV_BadExtension(t *testing.T) {
+	// a value which is too short for the extensions the flags say it has
+	for _, flag := range []byte{flagExpiry, flagMeta, flagExpiry | flagMeta} {
+		_, data := encodeRecord(10, "hello", "wo", flag)
+		if _, _, _, err := decodeKV(data); !errors.Is(err, ErrCorruptRecord) {
+			t.Errorf("decodeKV() with the flags %d error = %v, want %v", flag, err, ErrCorruptRecord)
+		}
+		if ext := decodeExtension(data); ext.expireAt != 0 || ext.meta != nil {
+			t.Errorf("decodeExtension() with the flags %d = %+v, want nothing", flag, ext)
+		}
+	}
+	// a meta_size which runs past the value
+	_, data := encodeRecord(10, "hello", "\xff\x00world", flagMeta)
+	if _, _, _, err := decodeKV(data); !errors.Is(err, ErrCorruptRecord) {
+		t.Errorf("decodeKV() error = %v, want %v", err, ErrCorruptRecord)
+	}
+}
@@ -0,0 +1,65 @@
+package caskdb
+
+import "time"
+
+// SyncAndWait flushes all the writes which are waiting for the next group commit
+// to the disk, and returns once they are durable. Without WithGroupCommit or
+// WithSyncEveryN every write is already synced and this is a no-op. Once an fsync
+// of the file has failed, this and SetDurable return its error from then on.
+func (d *DiskStore) SyncAndWait() error {
+	return d.syncFile()
+}
+
+// SetDurable stores the value for the key, just like Set, and returns only once
+// the record is on the disk, whatever WithGroupCommit or WithSyncEveryN say. The
+// writes which were waiting for the next group commit are synced along with it,
+// since a single fsync covers the whole file. This lets the important writes be
+// durable right away, while the rest are still synced in batches.
+func (d *DiskStore) SetDurable(key string, value string) error {
+	d.mu.Lock()
+	defer d.unlockAndNotify()
+	if d.closed {
+		return ErrClosed
+	}
+	if err := d.set(key, value); err != nil {
+		return err
+	}
+	if !d.unsynced.Swap(false) {
+		return d.failedSync()
+	}
+	d.writeCount.Store(0)
+	return d.fsync()
+}
+
+// groupCommitLoop fsyncs the file once every window, if there were any writes in
+// the meantime.
+func (d *DiskStore) groupCommitLoop(done <-chan struct{}) {
+	ticker := time.NewTicker(d.opts.groupCommit)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			// Shutdown syncs the file one last time after we return
+			return
+		case <-ticker.C:
+			// there is nobody to report the error to, it is kept and returned
+			// by the next SyncAndWait or SetDurable, see fsync
+			_ = d.syncFile()
+		}
+	}
+}
+
+// syncFile fsyncs the file if there are unsynced writes. It takes only the read
+// lock, which is enough to keep the file from being swapped by Merge and keeps
+// the writers out, while the readers can go on.
+func (d *DiskStore) syncFile() error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return ErrClosed
+	}
+	if !d.unsynced.Swap(false) {
+		return d.failedSync()
+	}
+	return d.fsync()
+}
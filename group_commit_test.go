@@ -0,0 +1,176 @@
+package caskdb
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDiskStore_GroupCommit(t *testing.T) {
+	store, err := NewDiskStore("test.db", WithGroupCommit(time.Millisecond))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+
+	store.Set("othello", "shakespeare")
+	deadline := time.Now().Add(time.Second)
+	for store.unsynced.Load() {
+		if time.Now().After(deadline) {
+			t.Fatalf("the background goroutine did not sync the write")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if !store.Close() {
+		t.Fatalf("Close() failed")
+	}
+
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	if val, _ := store.Get("othello"); val != "shakespeare" {
+		t.Errorf("Get() = %v, want %v", val, "shakespeare")
+	}
+	store.Close()
+}
+
+func TestDiskStore_SyncAndWait(t *testing.T) {
+	// the window is long enough that only SyncAndWait can sync the write
+	store, err := NewDiskStore("test.db", WithGroupCommit(time.Hour))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	store.Set("othello", "shakespeare")
+	if !store.unsynced.Load() {
+		t.Errorf("Set() synced the write, want it to wait for the group commit")
+	}
+	if err := store.SyncAndWait(); err != nil {
+		t.Fatalf("SyncAndWait() error = %v", err)
+	}
+	if store.unsynced.Load() {
+		t.Errorf("SyncAndWait() left unsynced writes behind")
+	}
+}
+
+func TestDiskStore_SetDurable(t *testing.T) {
+	store, err := NewDiskStore("test.db", WithGroupCommit(time.Hour))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	store.Set("dune", "frank herbert")
+	if err := store.SetDurable("othello", "shakespeare"); err != nil {
+		t.Fatalf("SetDurable() error = %v", err)
+	}
+	if store.unsynced.Load() {
+		t.Errorf("SetDurable() left unsynced writes behind")
+	}
+	store.Set("hamlet", "shakespeare")
+	if !store.unsynced.Load() {
+		t.Errorf("Set() after SetDurable() synced the write, want it to wait for the group commit")
+	}
+	if val, _ := store.Get("othello"); val != "shakespeare" {
+		t.Errorf("Get() = %v, want %v", val, "shakespeare")
+	}
+}
+
+func TestDiskStore_SyncErrorSticky(t *testing.T) {
+	store, err := NewDiskStore("test.db", WithGroupCommit(time.Hour))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	failed := errors.New("fsync failed")
+	syncs := 0
+	store.syncHook = func() error {
+		syncs++
+		return failed
+	}
+	store.Set("othello", "shakespeare")
+	if err := store.SyncAndWait(); !errors.Is(err, failed) {
+		t.Errorf("SyncAndWait() error = %v, want %v", err, failed)
+	}
+	// the error sticks, with or without new writes, and fsync is not tried again
+	if err := store.SyncAndWait(); !errors.Is(err, failed) {
+		t.Errorf("SyncAndWait() after a failed fsync error = %v, want %v", err, failed)
+	}
+	store.syncHook = nil
+	if err := store.SetDurable("dune", "frank herbert"); !errors.Is(err, failed) {
+		t.Errorf("SetDurable() after a failed fsync error = %v, want %v", err, failed)
+	}
+	if syncs != 1 {
+		t.Errorf("fsync tried %d times, want once", syncs)
+	}
+}
+
+func TestDiskStore_SyncEveryN(t *testing.T) {
+	store, err := NewDiskStore("test.db", WithSyncEveryN(3))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	store.Set("othello", "shakespeare")
+	store.Set("dune", "frank herbert")
+	if !store.unsynced.Load() {
+		t.Errorf("Set() synced before the 3rd write")
+	}
+	store.Set("hamlet", "shakespeare")
+	if store.unsynced.Load() {
+		t.Errorf("Set() did not sync on the 3rd write")
+	}
+	store.Set("macbeth", "shakespeare")
+	if !store.unsynced.Load() {
+		t.Errorf("Set() synced before the 3rd write after the last sync")
+	}
+}
+
+func TestDiskStore_VisibleAfterSync(t *testing.T) {
+	store, err := NewDiskStore("test.db", WithGroupCommit(time.Hour), WithVisibleAfterSync())
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	// the fsync runs under the write lock, so the hook looks at keyDir directly
+	visible := false
+	store.syncHook = func() error {
+		_, visible = store.keyDir["othello"]
+		return store.file.Sync()
+	}
+	if err := store.Set("othello", "shakespeare"); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	if visible {
+		t.Errorf("Set() made the key visible before the fsync")
+	}
+	if val, _ := store.Get("othello"); val != "shakespeare" {
+		t.Errorf("Get() = %v, want %v", val, "shakespeare")
+	}
+	if store.unsynced.Load() {
+		t.Errorf("Set() left unsynced writes behind")
+	}
+
+	// a write whose fsync fails never becomes visible
+	failed := errors.New("fsync failed")
+	store.syncHook = func() error {
+		return failed
+	}
+	if err := store.Set("dune", "frank herbert"); !errors.Is(err, failed) {
+		t.Errorf("Set() error = %v, want %v", err, failed)
+	}
+	if _, err := store.Get("dune"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Get() error = %v, want %v", err, ErrKeyNotFound)
+	}
+}
@@ -0,0 +1,246 @@
+package caskdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// hintSuffix is the suffix of the hint file, which WithPeriodicIndexFlush keeps
+// next to the data file.
+const hintSuffix = ".hint"
+
+// hintHeaderSize is the size of the header of the hint file:
+//
+//	┌─────────┬────────────────────┬──────────────┬───────────┐
+//	│ crc(4B) │ write_position(8B) │ tail_crc(4B) │ count(4B) │
+//	└─────────┴────────────────────┴──────────────┴───────────┘
+//
+// The crc covers the rest of the hint file. write_position is how far into the
+// data file the hint goes, and tail_crc is the checksum of the bytes of the data
+// file right before it, see hintTailSize. count is the number of entries which
+// follow the header, one per key:
+//
+//	┌───────────────┬──────────────┬────────────────┬───────────────┬──────────────┬─────┐
+//	│ timestamp(8B) │ position(4B) │ total_size(4B) │ expire_at(8B) │ key_size(4B) │ key │
+//	└───────────────┴──────────────┴────────────────┴───────────────┴──────────────┴─────┘
+const hintHeaderSize = 20
+
+// hintEntrySize is the size of an entry of the hint file, without its key.
+const hintEntrySize = 28
+
+// hintTailSize is how many bytes before the write_position of the hint are
+// checked against its tail_crc, unless WithFullHintChecksum is set. They tell
+// whether the data file still has the records the hint was taken from, and not,
+// say, a merged file.
+const hintTailSize = 4096
+
+// indexFlushLoop writes the hint file once every interval, see
+// WithPeriodicIndexFlush.
+func (d *DiskStore) indexFlushLoop(done <-chan struct{}) {
+	ticker := time.NewTicker(d.opts.indexFlush)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			// Shutdown writes the hint one last time after we return
+			return
+		case <-ticker.C:
+			if err := d.flushIndex(); err != nil {
+				d.logf("failed to write the hint file: %v", err)
+			}
+		}
+	}
+}
+
+// flushIndex writes the keyDir to the hint file. Only the snapshot of the keyDir
+// is taken under the read lock. The hint is written to a temporary file, which
+// then replaces the hint file, unless Merge or InPlaceCompact replaced the data
+// file in the meantime.
+func (d *DiskStore) flushIndex() error {
+	d.mu.RLock()
+	if d.closed {
+		d.mu.RUnlock()
+		return nil
+	}
+	generation := d.generation
+	data, err := d.encodeHint()
+	d.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	hintFileName := d.fileName + hintSuffix
+	tmpName := hintFileName + ".tmp"
+	if err := writeFileSynced(tmpName, data); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.generation != generation {
+		// the positions in the hint are of the old file
+		return os.Remove(tmpName)
+	}
+	if err := os.Rename(tmpName, hintFileName); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return d.syncDir()
+}
+
+// encodeHint encodes the keyDir as the hint file. The records which the hint
+// covers are synced first, so that a crash cannot leave the hint pointing at
+// records which never made it to the disk. The caller must hold the lock.
+func (d *DiskStore) encodeHint() ([]byte, error) {
+	if err := d.fsync(); err != nil {
+		return nil, err
+	}
+	tailCRC, err := d.tailChecksum(int64(d.writePosition))
+	if err != nil {
+		return nil, err
+	}
+	size := hintHeaderSize
+	for key := range d.keyDir {
+		size += hintEntrySize + len(key)
+	}
+	data := make([]byte, hintHeaderSize, size)
+	binary.LittleEndian.PutUint64(data[4:12], uint64(d.writePosition))
+	binary.LittleEndian.PutUint32(data[12:16], tailCRC)
+	binary.LittleEndian.PutUint32(data[16:20], uint32(len(d.keyDir)))
+	entry := make([]byte, hintEntrySize)
+	for key, kEntry := range d.keyDir {
+		binary.LittleEndian.PutUint64(entry[0:8], uint64(kEntry.timestamp))
+		binary.LittleEndian.PutUint32(entry[8:12], kEntry.position)
+		binary.LittleEndian.PutUint32(entry[12:16], kEntry.totalSize)
+		binary.LittleEndian.PutUint64(entry[16:24], uint64(kEntry.expireAt))
+		binary.LittleEndian.PutUint32(entry[24:28], uint32(len(key)))
+		data = append(append(data, entry...), key...)
+	}
+	binary.LittleEndian.PutUint32(data[0:4], crc32.ChecksumIEEE(data[4:]))
+	return data, nil
+}
+
+// tailChecksum returns the checksum of the hintTailSize bytes of the data file
+// right before the end, or of all the records if there are fewer, or if
+// WithFullHintChecksum is set.
+func (d *DiskStore) tailChecksum(end int64) (uint32, error) {
+	start := end - hintTailSize
+	if start < fileHeaderSize || d.opts.fullHintChecksum {
+		start = fileHeaderSize
+	}
+	hash := crc32.NewIEEE()
+	if _, err := io.Copy(hash, io.NewSectionReader(d.reader(), start, end-start)); err != nil {
+		return 0, err
+	}
+	return hash.Sum32(), nil
+}
+
+// loadHint fills the keyDir from the hint file, if there is one which matches
+// the data file, and returns the position in the data file the hint goes up to.
+// The records after it have to be loaded from the data file. It returns false
+// when there is no usable hint, in which case the whole data file has to be
+// loaded. A hint which does not match is removed, so that it cannot turn up again
+// once the data file has grown past it.
+func (d *DiskStore) loadHint(fileSize int64) (int, bool) {
+	hintFileName := d.fileName + hintSuffix
+	data, err := os.ReadFile(hintFileName)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, false
+	}
+	if err != nil {
+		d.logf("failed to read the hint file %s: %v", hintFileName, err)
+		return 0, false
+	}
+	position, ok := d.decodeHint(data, fileSize)
+	if !ok {
+		d.logf("ignoring the hint file %s, which does not match the data file", hintFileName)
+		if !d.opts.readOnly {
+			os.Remove(hintFileName)
+		}
+		return 0, false
+	}
+	return position, true
+}
+
+// decodeHint applies the entries of the hint file to the keyDir, once it has
+// checked that the hint is complete and that it matches the data file.
+func (d *DiskStore) decodeHint(data []byte, fileSize int64) (int, bool) {
+	if len(data) < hintHeaderSize || binary.LittleEndian.Uint32(data[0:4]) != crc32.ChecksumIEEE(data[4:]) {
+		return 0, false
+	}
+	position := int64(binary.LittleEndian.Uint64(data[4:12]))
+	if position < fileHeaderSize || position > fileSize {
+		return 0, false
+	}
+	if tailCRC, err := d.tailChecksum(position); err != nil || tailCRC != binary.LittleEndian.Uint32(data[12:16]) {
+		return 0, false
+	}
+	// the crc makes a malformed hint unlikely, still we check all of it before the
+	// keyDir is touched
+	count := int(binary.LittleEndian.Uint32(data[16:20]))
+	entries := data[hintHeaderSize:]
+	if count > len(entries)/hintEntrySize {
+		return 0, false
+	}
+	keys := make([]string, count)
+	kEntries := make([]KeyEntry, count)
+	for i := range keys {
+		if len(entries) < hintEntrySize {
+			return 0, false
+		}
+		keySize := int(binary.LittleEndian.Uint32(entries[24:28]))
+		if len(entries) < hintEntrySize+keySize {
+			return 0, false
+		}
+		keys[i] = string(entries[hintEntrySize : hintEntrySize+keySize])
+		kEntries[i] = KeyEntry{
+			timestamp: int64(binary.LittleEndian.Uint64(entries[0:8])),
+			position:  binary.LittleEndian.Uint32(entries[8:12]),
+			totalSize: binary.LittleEndian.Uint32(entries[12:16]),
+			expireAt:  int64(binary.LittleEndian.Uint64(entries[16:24])),
+		}
+		if int64(kEntries[i].position)+int64(kEntries[i].totalSize) > position {
+			return 0, false
+		}
+		entries = entries[hintEntrySize+keySize:]
+	}
+	for i, key := range keys {
+		d.putKey(key, kEntries[i])
+		if kEntries[i].timestamp > d.lastTimestamp {
+			d.lastTimestamp = kEntries[i].timestamp
+		}
+	}
+	return int(position), true
+}
+
+// removeHint removes the hint file before the data file is replaced or moved
+// around, as its positions would not be valid anymore. The caller must hold the
+// write lock.
+func (d *DiskStore) removeHint() error {
+	d.generation++
+	if err := os.Remove(d.fileName + hintSuffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// writeFileSynced writes the data to the file and syncs it.
+func writeFileSynced(fileName string, data []byte) error {
+	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
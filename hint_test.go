@@ -0,0 +1,131 @@
+package caskdb
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDiskStore_PeriodicIndexFlush(t *testing.T) {
+	store, err := NewDiskStore("test.db", WithPeriodicIndexFlush(time.Millisecond))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer os.Remove("test.db" + hintSuffix)
+
+	store.Set("othello", "marlowe")
+	store.Set("othello", "shakespeare")
+	store.Set("dune", "frank herbert")
+	store.Delete("dune")
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, err := os.Stat("test.db" + hintSuffix); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the hint file was not written")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	store.Close()
+
+	// a record appended after the hint is loaded from the data file
+	file, err := os.OpenFile("test.db", os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		t.Fatalf("failed to open the file: %v", err)
+	}
+	_, record := encodeKV(time.Now().UnixNano(), "hamlet", "shakespeare")
+	file.Write(record)
+	file.Close()
+
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	tests := map[string]string{"othello": "shakespeare", "hamlet": "shakespeare", "dune": ""}
+	for key, val := range tests {
+		if got, _ := store.Get(key); got != val {
+			t.Errorf("Get() = %v, want %v", got, val)
+		}
+	}
+	// Merge moves the records, so the hint has to go
+	if err := store.Merge(); err != nil {
+		t.Fatalf("Merge() error = %v", err)
+	}
+	if _, err := os.Stat("test.db" + hintSuffix); !os.IsNotExist(err) {
+		t.Errorf("the hint file is left behind after Merge(): %v", err)
+	}
+	store.Close()
+}
+
+func TestDiskStore_HintMismatch(t *testing.T) {
+	store, err := NewDiskStore("test.db", WithPeriodicIndexFlush(time.Hour))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer os.Remove("test.db" + hintSuffix)
+	store.Set("othello", "shakespeare")
+	store.Close()
+
+	// the data file is written over behind the back of the hint, with a file of
+	// the same size, so that only the checksum tells them apart
+	_, record := encodeKV(time.Now().UnixNano(), "dune", "frank herbert!")
+	if err := os.WriteFile("test.db", append(encodeFileHeader(formatVersion), record...), 0666); err != nil {
+		t.Fatalf("failed to write the file: %v", err)
+	}
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	if _, err := store.Get("othello"); err != ErrKeyNotFound {
+		t.Errorf("Get() error = %v, want %v", err, ErrKeyNotFound)
+	}
+	if val, _ := store.Get("dune"); val != "frank herbert!" {
+		t.Errorf("Get() = %v, want %v", val, "frank herbert!")
+	}
+	if _, err := os.Stat("test.db" + hintSuffix); !os.IsNotExist(err) {
+		t.Errorf("the stale hint file is left behind: %v", err)
+	}
+}
+
+func TestDiskStore_FullHintChecksum(t *testing.T) {
+	opts := []Option{WithPeriodicIndexFlush(time.Hour), WithFullHintChecksum()}
+	store, err := NewDiskStore("test.db", opts...)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer os.Remove("test.db" + hintSuffix)
+	store.Set("othello", "shakespeare")
+	// enough records that the first one is outside of the tail
+	for i := 0; i < hintTailSize/16; i++ {
+		store.Set(fmt.Sprintf("key-%d", i), "value")
+	}
+	position := store.keyDir["othello"].position
+	store.Close()
+
+	// the first record is patched in place, which the tail checksum would miss
+	data, err := os.ReadFile("test.db")
+	if err != nil {
+		t.Fatalf("failed to read the file: %v", err)
+	}
+	data[position+headerSize+uint32(len("othello"))] = 'S'
+	if err := os.WriteFile("test.db", data, 0666); err != nil {
+		t.Fatalf("failed to write the file: %v", err)
+	}
+	store, err = NewDiskStore("test.db", WithFullHintChecksum())
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	if _, err := os.Stat("test.db" + hintSuffix); !os.IsNotExist(err) {
+		t.Errorf("the stale hint file is left behind: %v", err)
+	}
+	if val, _ := store.Get("key-0"); val != "value" {
+		t.Errorf("Get() = %v, want %v", val, "value")
+	}
+}
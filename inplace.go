@@ -0,0 +1,373 @@
+package caskdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+)
+
+// compactPlanSuffix is the suffix of the file which InPlaceCompact keeps next to
+// the data file while it is running.
+const compactPlanSuffix = ".compact"
+
+// compactStep describes the move of a single record by InPlaceCompact.
+type compactStep struct {
+	// src is the offset of the record before the compaction
+	src uint32
+	// size is the total size of the record
+	size uint32
+	// crc is the checksum from the header of the record, which lets the recovery
+	// tell whether a copy of the record is complete
+	crc uint32
+}
+
+// InPlaceCompact reclaims the space of the stale records, just like Merge, but
+// without writing a second file. Merge needs space for a full copy of the live
+// data, which a nearly full disk might not have. InPlaceCompact instead moves the
+// live records towards the beginning of the file, one by one and in the order of
+// their offsets, and truncates the file at the end of the last one.
+//
+// Moving the records over the old ones is not atomic, so InPlaceCompact first
+// writes the plan of all the moves, along with the checksum of every record, to a
+// file with the `.compact` suffix next to the data file. The plan takes 12 bytes
+// per live record. The moves are ordered so that a record is never overwritten
+// before its copy is synced to the disk. A record which would overwrite itself is
+// first stashed in the plan file.
+//
+// If the process crashes while compacting, the next NewDiskStore finds the plan
+// and finishes the job before loading the file: for every record, it checks the
+// checksum of the copy at the new offset, and copies the record again from the
+// old offset or from the stash if the copy is incomplete. The plan file is removed
+// only after the data file is truncated and synced, so the recovery can run any
+// number of times. Files which are opened on their own, like with
+// NewDiskStoreFromFile, must keep their path, since the plan is found by name.
+//
+// If a move fails, InPlaceCompact goes over the plan once more, like the recovery
+// does. If that fails as well, it returns the error and closes the store, whose
+// keyDir no longer matches the file, and the next NewDiskStore finishes the job.
+func (d *DiskStore) InPlaceCompact() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return ErrClosed
+	}
+	if d.opts.noIndex {
+		return ErrNoIndex
+	}
+	if d.opts.readOnly {
+		return ErrReadOnly
+	}
+	if d.opts.baseOffset > 0 {
+		return ErrBaseOffset
+	}
+
+	offsets, err := d.mergeOffsets(false)
+	if err != nil {
+		return err
+	}
+	steps := make([]compactStep, 0, len(offsets))
+	keyDir := make(map[string]KeyEntry, len(d.keyDir))
+	position := fileHeaderSize
+	file := d.scanReader()
+	for _, offset := range offsets {
+		// reading every record upfront makes sure we do not start moving the data
+		// around when some of it is corrupt
+		record, err := d.readRecordFrom(file, offset)
+		if err != nil {
+			return err
+		}
+		steps = append(steps, compactStep{
+			src:  uint32(offset),
+			size: uint32(len(record)),
+			crc:  binary.LittleEndian.Uint32(record[0:4]),
+		})
+		timestamp, key, value, err := decodeKV(record)
+		if err != nil {
+			return err
+		}
+		if !isTombstone(record) {
+			kEntry := d.newKeyEntry(timestamp, position, len(record), value)
+			kEntry.expireAt = recordExpiry(record)
+			keyDir[key] = kEntry
+		}
+		position += len(record)
+	}
+
+	// the records are about to move, so the hint would point at the wrong places
+	if err := d.removeHint(); err != nil {
+		return err
+	}
+	planFileName := d.fileName + compactPlanSuffix
+	planFile, err := os.OpenFile(planFileName, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	defer planFile.Close()
+	if _, err := planFile.Write(encodeCompactPlan(steps)); err != nil {
+		return err
+	}
+	if err := planFile.Sync(); err != nil {
+		return err
+	}
+	// the plan must survive a crash, or the recovery would not know that the file
+	// is half compacted
+	if err := d.syncDir(); err != nil {
+		return err
+	}
+
+	// WriteAt is not allowed on a file opened in the append mode, so the moves go
+	// through a second descriptor
+	if d.mmapped != nil {
+		if err := munmap(d.mmapped); err != nil {
+			return err
+		}
+		d.mmapped = nil
+	}
+	rw, err := os.OpenFile(d.fileName, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer rw.Close()
+	end, err := runCompactPlan(rw, planFile, steps, false, d.compactHook)
+	if err != nil {
+		// some of the records may have moved already, while the keyDir still points
+		// at their old offsets. So we finish the moves the way the recovery does, and
+		// if even that fails, the store is closed and the next NewDiskStore finishes
+		// them from the plan
+		d.logf("finishing the failed in place compaction of %s: %v", d.fileName, err)
+		if end, err = runCompactPlan(rw, planFile, steps, true, d.compactHook); err != nil {
+			d.abandon()
+			return err
+		}
+	}
+	planFile.Close()
+	if err := os.Remove(planFileName); err != nil {
+		return err
+	}
+
+	d.setKeyDir(keyDir)
+	d.writePosition = int(end)
+	// we count the whole file, though only the records which moved were written
+	d.bytesWritten += end
+	d.allocated = end
+	if _, err := d.file.Seek(end, io.SeekStart); err != nil {
+		return err
+	}
+	if d.opts.mmap {
+		_ = d.remap()
+	}
+	return nil
+}
+
+// recoverInPlaceCompact finishes an InPlaceCompact which was interrupted by a
+// crash. It does nothing if there is no plan file next to the data file.
+func (d *DiskStore) recoverInPlaceCompact() error {
+	planFileName := d.fileName + compactPlanSuffix
+	planData, err := os.ReadFile(planFileName)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	steps, ok := decodeCompactPlan(planData)
+	if !ok {
+		// the plan is synced before the first move, so a broken plan means that we
+		// crashed while writing it and the data file is untouched
+		d.logf("removing the incomplete compaction plan %s", planFileName)
+		return os.Remove(planFileName)
+	}
+	d.logf("finishing the interrupted in place compaction of %s", d.fileName)
+	planFile, err := os.OpenFile(planFileName, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer planFile.Close()
+	rw, err := os.OpenFile(d.fileName, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer rw.Close()
+	if _, err := runCompactPlan(rw, planFile, steps, true, nil); err != nil {
+		return err
+	}
+	planFile.Close()
+	return os.Remove(planFileName)
+}
+
+// abandon closes the store after InPlaceCompact failed half way through the moves
+// and could not finish them, since the keyDir no longer matches the file. The
+// caller must hold the write lock.
+func (d *DiskStore) abandon() {
+	d.closed = true
+	if err := d.closeReaders(); err != nil {
+		d.logf("failed to close the readers: %v", err)
+	}
+	if err := d.file.Close(); err != nil {
+		d.logf("failed to close the data file: %v", err)
+	}
+}
+
+// runCompactPlan moves the records as per the steps and truncates the file after
+// the last one. It returns the new size of the file. During the recovery, the
+// steps which were already done are detected and skipped. hook, if it is not nil,
+// is called before every move, and the move fails with its error.
+func runCompactPlan(rw *os.File, planFile *os.File, steps []compactStep, recovering bool, hook func(recovering bool) error) (int64, error) {
+	stashOffset := int64(len(encodeCompactPlan(steps)))
+	dst := int64(fileHeaderSize)
+	// pending is the first step whose copy is written but not synced yet, or -1
+	pending := -1
+	for i, step := range steps {
+		end := dst + int64(step.size)
+		if int64(step.src) == dst {
+			// the record is in the right place already
+			dst = end
+			continue
+		}
+		if recovering && hasRecord(rw, dst, step) {
+			dst = end
+			continue
+		}
+		record, err := readStepRecord(rw, planFile, stashOffset, i, step, recovering)
+		if err != nil {
+			return 0, err
+		}
+		// the copy must not overwrite the old bytes of a record whose own copy is
+		// not on the disk yet
+		if pending >= 0 && end > int64(steps[pending].src) {
+			if err := rw.Sync(); err != nil {
+				return 0, err
+			}
+			pending = -1
+		}
+		if end > int64(step.src) {
+			// the record overlaps with itself, a crash in the middle of the write
+			// would leave us with no good copy of it. So we stash it first. The
+			// previous stash might be the only good copy of its record, till the
+			// copy at the new offset is synced
+			if pending >= 0 {
+				if err := rw.Sync(); err != nil {
+					return 0, err
+				}
+				pending = -1
+			}
+			if err := writeStash(planFile, stashOffset, i, record); err != nil {
+				return 0, err
+			}
+		}
+		if hook != nil {
+			if err := hook(recovering); err != nil {
+				return 0, err
+			}
+		}
+		if _, err := rw.WriteAt(record, dst); err != nil {
+			return 0, err
+		}
+		if pending < 0 {
+			pending = i
+		}
+		dst = end
+	}
+	if err := rw.Sync(); err != nil {
+		return 0, err
+	}
+	if err := rw.Truncate(dst); err != nil {
+		return 0, err
+	}
+	return dst, rw.Sync()
+}
+
+// hasRecord checks whether the complete record of the step is at the offset.
+func hasRecord(file *os.File, offset int64, step compactStep) bool {
+	record := make([]byte, step.size)
+	if _, err := file.ReadAt(record, offset); err != nil {
+		return false
+	}
+	return isStepRecord(record, step)
+}
+
+func isStepRecord(record []byte, step compactStep) bool {
+	if len(record) != int(step.size) {
+		return false
+	}
+	size, ok := recordSize(record)
+	return ok && size == int64(step.size) &&
+		binary.LittleEndian.Uint32(record[0:4]) == step.crc && validChecksum(record)
+}
+
+// readStepRecord reads the record of the step from its old offset. During the
+// recovery the old bytes might be overwritten already, in which case the record
+// must be in the stash.
+func readStepRecord(rw *os.File, planFile *os.File, stashOffset int64, i int, step compactStep, recovering bool) ([]byte, error) {
+	record := make([]byte, step.size)
+	if _, err := rw.ReadAt(record, int64(step.src)); err != nil && !recovering {
+		return nil, err
+	}
+	if isStepRecord(record, step) {
+		return record, nil
+	}
+	if recovering {
+		stash := make([]byte, 4+step.size)
+		if _, err := planFile.ReadAt(stash, stashOffset); err == nil &&
+			binary.LittleEndian.Uint32(stash[0:4]) == uint32(i) && isStepRecord(stash[4:], step) {
+			return stash[4:], nil
+		}
+	}
+	return nil, &CorruptError{Offset: int64(step.src), Reason: "the record to compact in place is lost"}
+}
+
+func writeStash(planFile *os.File, stashOffset int64, i int, record []byte) error {
+	stash := make([]byte, 4+len(record))
+	binary.LittleEndian.PutUint32(stash[0:4], uint32(i))
+	copy(stash[4:], record)
+	if _, err := planFile.WriteAt(stash, stashOffset); err != nil {
+		return err
+	}
+	return planFile.Sync()
+}
+
+// encodeCompactPlan encodes the steps as the plan file. The plan has the count of
+// the steps followed by every step, and the stash comes after it once a record
+// needs it:
+//
+//	┌─────────┬───────────┬─────────┬──────────┬─────────┬─────┐
+//	│ crc(4B) │ count(4B) │ src(4B) │ size(4B) │ crc(4B) │ ... │
+//	└─────────┴───────────┴─────────┴──────────┴─────────┴─────┘
+func encodeCompactPlan(steps []compactStep) []byte {
+	data := make([]byte, 8+12*len(steps))
+	binary.LittleEndian.PutUint32(data[4:8], uint32(len(steps)))
+	for i, step := range steps {
+		b := data[8+12*i:]
+		binary.LittleEndian.PutUint32(b[0:4], step.src)
+		binary.LittleEndian.PutUint32(b[4:8], step.size)
+		binary.LittleEndian.PutUint32(b[8:12], step.crc)
+	}
+	binary.LittleEndian.PutUint32(data[0:4], crc32.ChecksumIEEE(data[4:]))
+	return data
+}
+
+// decodeCompactPlan decodes the plan file, and returns false when it is
+// incomplete or corrupt.
+func decodeCompactPlan(data []byte) ([]compactStep, bool) {
+	if len(data) < 8 {
+		return nil, false
+	}
+	count := int(binary.LittleEndian.Uint32(data[4:8]))
+	planSize := 8 + 12*count
+	if len(data) < planSize || binary.LittleEndian.Uint32(data[0:4]) != crc32.ChecksumIEEE(data[4:planSize]) {
+		return nil, false
+	}
+	steps := make([]compactStep, count)
+	for i := range steps {
+		b := data[8+12*i:]
+		steps[i] = compactStep{
+			src:  binary.LittleEndian.Uint32(b[0:4]),
+			size: binary.LittleEndian.Uint32(b[4:8]),
+			crc:  binary.LittleEndian.Uint32(b[8:12]),
+		}
+	}
+	return steps, true
+}
@@ -0,0 +1,177 @@
+package caskdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestDiskStore_InPlaceCompact(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+
+	for _, author := range []string{"marlowe", "bacon", "shakespeare"} {
+		store.Set("othello", author)
+	}
+	store.Set("anna karenina", "tolstoy")
+	store.Set("dune", "frank herbert")
+	store.Delete("dune")
+	if err := store.InPlaceCompact(); err != nil {
+		t.Fatalf("InPlaceCompact() error = %v", err)
+	}
+	want := int64(fileHeaderSize + headerSize*2 + len("othello") + len("shakespeare") + len("anna karenina") + len("tolstoy"))
+	if size := fileSize(t, "test.db"); size != want {
+		t.Errorf("file size after InPlaceCompact() = %v, want %v", size, want)
+	}
+	if _, err := os.Stat("test.db" + compactPlanSuffix); !os.IsNotExist(err) {
+		t.Errorf("the compaction plan is left behind: %v", err)
+	}
+	if val, _ := store.Get("othello"); val != "shakespeare" {
+		t.Errorf("Get() = %v, want %v", val, "shakespeare")
+	}
+	store.Set("hamlet", "shakespeare")
+	store.Close()
+
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	tests := map[string]string{"othello": "shakespeare", "anna karenina": "tolstoy", "hamlet": "shakespeare", "dune": ""}
+	for key, val := range tests {
+		if got, _ := store.Get(key); got != val {
+			t.Errorf("Get() = %v, want %v", got, val)
+		}
+	}
+	store.Close()
+}
+
+func TestDiskStore_InPlaceCompactFailedMove(t *testing.T) {
+	defer os.Remove("test.db")
+	defer os.Remove("test.db" + compactPlanSuffix)
+	failed := errors.New("write failed")
+	tests := map[string]string{"othello": "shakespeare", "anna karenina": "tolstoy", "dune": ""}
+	for _, retryFails := range []bool{false, true} {
+		store, err := NewDiskStore("test.db")
+		if err != nil {
+			t.Fatalf("failed to create disk store: %v", err)
+		}
+		for _, author := range []string{"marlowe", "bacon", "shakespeare"} {
+			store.Set("othello", author)
+		}
+		store.Set("anna karenina", "tolstoy")
+		store.Set("dune", "frank herbert")
+		store.Delete("dune")
+		// the first move goes through, and the second fails
+		moves := 0
+		store.compactHook = func(recovering bool) error {
+			if moves++; moves == 2 || recovering && retryFails {
+				return failed
+			}
+			return nil
+		}
+		err = store.InPlaceCompact()
+		if moves < 2 {
+			t.Fatalf("InPlaceCompact() made %d moves, want the second one to fail", moves)
+		}
+		if !retryFails {
+			// going over the plan again finishes the moves
+			if err != nil {
+				t.Fatalf("InPlaceCompact() error = %v", err)
+			}
+			store.Set("hamlet", "shakespeare")
+			if val, _ := store.Get("hamlet"); val != "shakespeare" {
+				t.Errorf("Get() = %v, want %v", val, "shakespeare")
+			}
+		} else {
+			if !errors.Is(err, failed) {
+				t.Errorf("InPlaceCompact() error = %v, want %v", err, failed)
+			}
+			// the store is closed rather than reading from the wrong offsets
+			if _, err := store.Get("othello"); !errors.Is(err, ErrClosed) {
+				t.Errorf("Get() after the failed InPlaceCompact() error = %v, want %v", err, ErrClosed)
+			}
+			if err := store.Set("hamlet", "shakespeare"); !errors.Is(err, ErrClosed) {
+				t.Errorf("Set() after the failed InPlaceCompact() error = %v, want %v", err, ErrClosed)
+			}
+		}
+		store.Close()
+
+		// the next start finishes whatever is left of the plan
+		store, err = NewDiskStore("test.db")
+		if err != nil {
+			t.Fatalf("failed to create disk store: %v", err)
+		}
+		for key, val := range tests {
+			if got, _ := store.Get(key); got != val {
+				t.Errorf("Get(%q) = %v, want %v", key, got, val)
+			}
+		}
+		store.Close()
+		os.Remove("test.db")
+	}
+}
+
+func TestDiskStore_InPlaceCompactRecovery(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer os.Remove("test.db" + compactPlanSuffix)
+
+	store.Set("othello", "marlowe")
+	store.Set("othello", "shakespeare")
+	store.Set("dune", "frank herbert")
+	offsets, err := store.mergeOffsets(false)
+	if err != nil {
+		t.Fatalf("mergeOffsets() error = %v", err)
+	}
+	var steps []compactStep
+	var records [][]byte
+	for _, offset := range offsets {
+		record, _ := store.readRecordAt(offset)
+		records = append(records, record)
+		steps = append(steps, compactStep{src: uint32(offset), size: uint32(len(record)), crc: binary.LittleEndian.Uint32(record[0:4])})
+	}
+	store.Close()
+
+	// we crash while moving dune: othello is at its new offset, while the copy of
+	// dune is torn and has overwritten its own beginning
+	plan := encodeCompactPlan(steps)
+	stash := append([]byte{1, 0, 0, 0}, records[1]...)
+	if err := os.WriteFile("test.db"+compactPlanSuffix, append(plan, stash...), 0666); err != nil {
+		t.Fatalf("failed to write the plan: %v", err)
+	}
+	file, err := os.OpenFile("test.db", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("failed to open the file: %v", err)
+	}
+	file.WriteAt(records[0], fileHeaderSize)
+	torn := append([]byte{}, records[1]...)
+	torn[len(torn)-1] ^= 0xff
+	file.WriteAt(torn, int64(fileHeaderSize+len(records[0])))
+	file.Close()
+
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	if _, err := os.Stat("test.db" + compactPlanSuffix); !os.IsNotExist(err) {
+		t.Errorf("the compaction plan is left behind: %v", err)
+	}
+	want := int64(fileHeaderSize + len(records[0]) + len(records[1]))
+	if size := fileSize(t, "test.db"); size != want {
+		t.Errorf("file size after the recovery = %v, want %v", size, want)
+	}
+	tests := map[string]string{"othello": "shakespeare", "dune": "frank herbert"}
+	for key, val := range tests {
+		if got, _ := store.Get(key); got != val {
+			t.Errorf("Get() = %v, want %v", got, val)
+		}
+	}
+}
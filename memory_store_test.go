@@ -1,19 +1,22 @@
 package caskdb
 
-import "testing"
+import (
+	"errors"
+	"testing"
+)
 
 func TestMemoryStore_Get(t *testing.T) {
 	store := NewMemoryStore()
 	store.Set("name", "jojo")
-	if val := store.Get("name"); val != "jojo" {
+	if val, _ := store.Get("name"); val != "jojo" {
 		t.Errorf("Get() = %v, want %v", val, "jojo")
 	}
 }
 
 func TestMemoryStore_InvalidGet(t *testing.T) {
 	store := NewMemoryStore()
-	if val := store.Get("some rando key"); val != "" {
-		t.Errorf("Get() = %v, want %v", val, "")
+	if val, err := store.Get("some rando key"); val != "" || !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Get() = (%v, %v), want ('', %v)", val, err, ErrKeyNotFound)
 	}
 }
 
@@ -0,0 +1,490 @@
+package caskdb
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Merge compacts the data file. Every update and delete leaves the old record
+// behind in the file, since we only ever append to it. Over time, the file is
+// mostly filled with such stale records. Merge writes only the live records, the
+// ones keyDir points at, to a new file and then atomically replaces the old file
+// with it.
+//
+// The new file is written next to the old one with a `.merge` suffix and renamed
+// over it only after it is fully written and synced. If the process crashes in
+// the middle of a merge, the old file is left untouched.
+//
+// Tombstones are dropped, unless WithTombstoneGrace is used, in which case the
+// tombstones younger than the grace period are copied over.
+//
+// Merge holds the write lock for the whole duration, so all reads and writes wait
+// till it is done. The same goes for a second Merge or InPlaceCompact, which
+// waits for the first one to finish rather than running alongside it. Once the
+// new file is in place, Merge reopens it and points keyDir at the new offsets, so
+// the same DiskStore keeps working without the callers noticing.
+func (d *DiskStore) Merge() error {
+	return d.MergeWithProgress(nil)
+}
+
+// mergeProgressInterval is the number of records Merge copies between two calls
+// of the progress callback.
+const mergeProgressInterval = 4096
+
+// MergeWithProgress is Merge, which calls fn every few thousand records to report
+// how far it has got. processedBytes is how much of the old file has been gone
+// through and totalBytes is its size, so the ratio of the two is the progress.
+// fn is called once more with processedBytes equal to totalBytes when all the
+// records are copied. fn is called with the write lock held, so it must not use
+// the store.
+func (d *DiskStore) MergeWithProgress(fn func(processedBytes, totalBytes int64)) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return ErrClosed
+	}
+	if d.opts.noIndex {
+		return ErrNoIndex
+	}
+	if d.opts.readOnly {
+		return ErrReadOnly
+	}
+	if d.opts.baseOffset > 0 {
+		return ErrBaseOffset
+	}
+	return d.merge(fn)
+}
+
+// PurgeKeys removes all of the keys at once, without writing a tombstone for
+// every one of them. Deleting a large number of keys one by one first grows the
+// file by a tombstone per key, which only the next Merge gets rid of. PurgeKeys
+// instead drops the keys from keyDir and merges the file right away, so their
+// records are simply not copied over. The keys which are not there are skipped.
+//
+// This costs a full Merge, so it pays off only for large batches of keys. As no
+// tombstones are ever written, whatever follows the log rather than the file as a
+// whole, like a ScanPhysical based change feed or a copy of the file kept in sync
+// by appending its new records, never finds out that the keys are gone. Use Delete
+// when the deletes have to be shipped elsewhere. If the merge fails, the keys are
+// left in place.
+func (d *DiskStore) PurgeKeys(keys []string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return ErrClosed
+	}
+	if d.opts.noIndex {
+		return ErrNoIndex
+	}
+	if d.opts.readOnly {
+		return ErrReadOnly
+	}
+	if d.opts.baseOffset > 0 {
+		return ErrBaseOffset
+	}
+	purged := make(map[string]KeyEntry, len(keys))
+	for _, key := range keys {
+		if kEntry, ok := d.keyDir[key]; ok {
+			purged[key] = kEntry
+			d.removeKey(key)
+		}
+	}
+	if len(purged) == 0 {
+		return nil
+	}
+	if err := d.merge(nil); err != nil {
+		for key, kEntry := range purged {
+			d.putKey(key, kEntry)
+		}
+		return err
+	}
+	return nil
+}
+
+// merge does the work of MergeWithProgress. The caller must hold the write lock.
+func (d *DiskStore) merge(fn func(processedBytes, totalBytes int64)) error {
+	offsets, err := d.mergeOffsets(d.opts.sortedCompaction)
+	if err != nil {
+		return err
+	}
+	mergeFileName := d.fileName + ".merge"
+	mergeFile, err := os.OpenFile(mergeFileName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	// if anything goes wrong, we leave the old file as it is and remove the new one
+	cleanup := func(err error) error {
+		mergeFile.Close()
+		os.Remove(mergeFileName)
+		return err
+	}
+
+	keyDir := make(map[string]KeyEntry, len(d.keyDir))
+	writer := bufio.NewWriter(mergeFile)
+	header := append(encodeFileHeader(formatVersion), alignmentFiller(d.opts.alignment)...)
+	if _, err := writer.Write(header); err != nil {
+		return cleanup(err)
+	}
+	position := len(header)
+	totalBytes := int64(d.writePosition)
+	file := d.scanReader()
+	for i, offset := range offsets {
+		if fn != nil && i > 0 && i%mergeProgressInterval == 0 {
+			processedBytes := offset
+			if d.opts.sortedCompaction {
+				// the offsets jump around, so we go by the share of the records
+				processedBytes = totalBytes * int64(i) / int64(len(offsets))
+			}
+			fn(processedBytes, totalBytes)
+		}
+		record, err := d.readRecordFrom(file, offset)
+		if err != nil {
+			return cleanup(err)
+		}
+		// the records move, so their padding has to change as well
+		record = alignRecord(record, int64(position), d.opts.alignment)
+		if _, err := writer.Write(record); err != nil {
+			return cleanup(err)
+		}
+		timestamp, key, value, err := decodeKV(record)
+		if err != nil {
+			return cleanup(err)
+		}
+		if !isTombstone(record) {
+			kEntry := d.newKeyEntry(timestamp, position, len(record), value)
+			kEntry.expireAt = recordExpiry(record)
+			keyDir[key] = kEntry
+		}
+		position += len(record)
+	}
+	if fn != nil {
+		fn(totalBytes, totalBytes)
+	}
+	if err := writer.Flush(); err != nil {
+		return cleanup(err)
+	}
+	if err := mergeFile.Sync(); err != nil {
+		return cleanup(err)
+	}
+	if err := mergeFile.Close(); err != nil {
+		return cleanup(err)
+	}
+	return d.replaceFile(mergeFileName, keyDir, position)
+}
+
+// mergeOffsets returns the offsets of all the records which Merge has to copy, in
+// the order they appear in the file. Keeping the order means that the new file
+// replays exactly like the old one did. With byKey, the offsets are in the order
+// of the keys of their records instead, see WithSortedCompaction. There is a
+// single record per key, so the new file still replays the same.
+func (d *DiskStore) mergeOffsets(byKey bool) ([]int64, error) {
+	offsets := make([]int64, 0, len(d.keyDir))
+	var keys map[int64]string
+	if byKey {
+		keys = make(map[int64]string, len(d.keyDir))
+	}
+	now := d.now().UnixNano()
+	for key, kEntry := range d.keyDir {
+		// the expired keys are dropped along with all their records, see
+		// SetWithExpiry
+		if !kEntry.expired(now) {
+			offsets = append(offsets, int64(kEntry.position))
+			if byKey {
+				keys[int64(kEntry.position)] = key
+			}
+		}
+	}
+	if d.opts.tombstoneGrace > 0 {
+		// keyDir does not know about the deleted keys, so we have to go through the
+		// file to find the tombstones. For every key, only the last tombstone matters
+		tombstones := make(map[string]int64)
+		cutoff := d.now().Add(-d.opts.tombstoneGrace).UnixNano()
+		err := d.forEachRecord(func(data []byte, offset int64) error {
+			timestamp, key, _, err := decodeKV(data)
+			if err != nil {
+				return err
+			}
+			if _, live := d.keyDir[key]; isTombstone(data) && !live && timestamp > cutoff {
+				tombstones[key] = offset
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		for key, offset := range tombstones {
+			offsets = append(offsets, offset)
+			if byKey {
+				keys[offset] = key
+			}
+		}
+	}
+	if byKey {
+		sort.Slice(offsets, func(i, j int) bool { return keys[offsets[i]] < keys[offsets[j]] })
+	} else {
+		sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	}
+	return offsets, nil
+}
+
+// forEachRecord calls fn with every record in the file and its offset, in the
+// order they were written. The records of a transaction are visited one by one,
+// instead of their batch. data may go on after the end of the record. The caller
+// must hold the lock.
+func (d *DiskStore) forEachRecord(fn func(data []byte, offset int64) error) error {
+	file := d.scanReader()
+	for offset := int64(fileHeaderSize); offset < int64(d.writePosition); {
+		record, err := d.readRecordFrom(file, offset)
+		if err != nil {
+			return err
+		}
+		if isBatch(record) {
+			_, keySize, valueSize := decodeHeader(record)
+			start := headerSize + keySize
+			inner, _ := splitBatch(record[start : start+valueSize])
+			for _, position := range inner {
+				if err := fn(record[start+uint32(position):], offset+int64(start)+int64(position)); err != nil {
+					return err
+				}
+			}
+		} else if err := fn(record, offset); err != nil {
+			return err
+		}
+		offset += int64(len(record))
+	}
+	return nil
+}
+
+// CompactDryRun reports what Merge would do right now, without writing anything:
+// the bytes it would reclaim, the number of records it would copy over and the
+// number of stale records and tombstones it would drop. It reads through the
+// whole file, so it takes about as long as the reading part of Merge, but it only
+// holds the read lock.
+func (d *DiskStore) CompactDryRun() (reclaimableBytes int64, liveRecords int, deadRecords int, err error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return 0, 0, 0, ErrClosed
+	}
+	if d.opts.noIndex {
+		return 0, 0, 0, ErrNoIndex
+	}
+	offsets, err := d.mergeOffsets(false)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	live := make(map[int64]bool, len(offsets))
+	for _, offset := range offsets {
+		live[offset] = true
+	}
+	liveBytes := int64(fileHeaderSize + len(alignmentFiller(d.opts.alignment)))
+	err = d.forEachRecord(func(data []byte, offset int64) error {
+		if !live[offset] {
+			deadRecords++
+			return nil
+		}
+		size, _ := recordSize(data)
+		liveBytes += size
+		return nil
+	})
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return int64(d.writePosition) - liveBytes, len(offsets), deadRecords, nil
+}
+
+// WriteCompactedTo writes the live keys of the store, as of now, to a new
+// standalone data file at path, one record per key, just like Merge would compact
+// them. The new file is a store of its own, which can be opened with NewDiskStore
+// and changed without touching this one, like a fixture for the tests or a fork of
+// the data to experiment on. Unlike a copy of the data file, it has none of the
+// stale records, tombstones or expired keys.
+//
+// It holds the read lock while it writes, so the file is a consistent point in
+// time, and the writers wait till it is done. The file is written next to path
+// with a `.tmp` suffix and renamed to path once it is synced, so path never holds
+// half of a store. An existing file at path is replaced, unless it is the data
+// file of the store, which fails with ErrOwnDataFile. Use Merge to compact that.
+func (d *DiskStore) WriteCompactedTo(path string) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return ErrClosed
+	}
+	if d.opts.noIndex {
+		return ErrNoIndex
+	}
+	if d.isDataFile(path) {
+		return ErrOwnDataFile
+	}
+	offsets := make([]int64, 0, len(d.keyDir))
+	now := d.now().UnixNano()
+	for _, kEntry := range d.keyDir {
+		if !kEntry.expired(now) {
+			offsets = append(offsets, int64(kEntry.position))
+		}
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+
+	tmpName := path + ".tmp"
+	file, err := os.OpenFile(tmpName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	cleanup := func(err error) error {
+		file.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	header := append(encodeFileHeader(formatVersion), alignmentFiller(d.opts.alignment)...)
+	if _, err := writer.Write(header); err != nil {
+		return cleanup(err)
+	}
+	position := len(header)
+	reader := d.scanReader()
+	for _, offset := range offsets {
+		record, err := d.readRecordFrom(reader, offset)
+		if err != nil {
+			return cleanup(err)
+		}
+		record = alignRecord(record, int64(position), d.opts.alignment)
+		if _, err := writer.Write(record); err != nil {
+			return cleanup(err)
+		}
+		position += len(record)
+	}
+	if err := writer.Flush(); err != nil {
+		return cleanup(err)
+	}
+	if err := file.Sync(); err != nil {
+		return cleanup(err)
+	}
+	if err := file.Close(); err != nil {
+		return cleanup(err)
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if d.opts.fsyncDir {
+		return syncDir(filepath.Dir(path))
+	}
+	return nil
+}
+
+// replaceFile swaps the data file with the compacted one and starts using keyDir,
+// which must describe the new file. The caller must hold the write lock.
+func (d *DiskStore) replaceFile(newFileName string, keyDir map[string]KeyEntry, writePosition int) error {
+	flag := os.O_APPEND | os.O_RDWR | os.O_CREATE
+	if d.opts.preallocate > 0 {
+		flag &^= os.O_APPEND
+	}
+	// the new file is opened while the old one is still in use, so that if it
+	// cannot be, the store carries on with the old file. The handle follows the
+	// file through the rename
+	file, err := d.openDataFile(newFileName, flag)
+	if err != nil {
+		os.Remove(newFileName)
+		return err
+	}
+	// some platforms do not let us rename over a file which is open, so we close
+	// the old file first
+	if d.mmapped != nil {
+		if err := munmap(d.mmapped); err != nil {
+			file.Close()
+			os.Remove(newFileName)
+			return err
+		}
+		d.mmapped = nil
+	}
+	if err := d.closeReaders(); err != nil {
+		d.logf("failed to close the reader pool: %v", err)
+	}
+	if err := d.file.Close(); err != nil {
+		d.logf("failed to close the old data file: %v", err)
+	}
+	// the hint points into the old file, it must be gone before the new file is
+	// in place, see WithPeriodicIndexFlush
+	renameErr := d.removeHint()
+	if renameErr == nil {
+		renameErr = os.Rename(newFileName, d.fileName)
+	}
+	if renameErr != nil {
+		// we go back to the old file, which keyDir is still valid for
+		file.Close()
+		os.Remove(newFileName)
+		file, err = d.openDataFile(d.fileName, flag)
+		if err != nil {
+			// the old file is closed and cannot be opened again, so the store is of
+			// no use anymore
+			d.closed = true
+			return fmt.Errorf("%v, and reopening the data file failed: %w", renameErr, err)
+		}
+	}
+	d.file = file
+	// without the pool, the reads simply go through the file
+	if err := d.openReaders(); err != nil {
+		d.logf("failed to open the reader pool: %v", err)
+	}
+	if d.opts.preallocate > 0 {
+		// without the append mode, the writes go at the cursor
+		end := d.writePosition
+		if renameErr == nil {
+			end = writePosition
+		}
+		if _, err := file.Seek(int64(end), io.SeekStart); err != nil {
+			return err
+		}
+	}
+	if renameErr != nil {
+		if d.opts.mmap {
+			_ = d.remap()
+		}
+		return renameErr
+	}
+	d.setKeyDir(keyDir)
+	d.writePosition = writePosition
+	d.bytesWritten += int64(writePosition)
+	d.allocated = int64(writePosition)
+	if d.opts.mmap {
+		_ = d.remap()
+	}
+	// the rename is not durable till the directory is synced, a crash would bring
+	// the old file back. Which is still consistent, so Merge does not fail here
+	if err := d.syncDir(); err != nil {
+		d.logf("failed to sync the directory of %s: %v", d.fileName, err)
+	}
+	return nil
+}
+
+// openDataFile opens the file at name as the data file of the store, see
+// openHook.
+func (d *DiskStore) openDataFile(name string, flag int) (*os.File, error) {
+	if d.openHook != nil {
+		if err := d.openHook(name); err != nil {
+			return nil, err
+		}
+	}
+	return os.OpenFile(name, flag, 0666)
+}
+
+// isDataFile reports whether path is the data file of the store, be it by the
+// same name, or through a link to it.
+func (d *DiskStore) isDataFile(path string) bool {
+	if info, err := os.Stat(path); err == nil {
+		if own, err := d.file.Stat(); err == nil && os.SameFile(info, own) {
+			return true
+		}
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	own, err := filepath.Abs(d.fileName)
+	return err == nil && abs == own
+}
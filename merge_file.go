@@ -0,0 +1,332 @@
+package caskdb
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// defaultMergeChunk is the number of records MergeFile sorts in memory at once,
+// when the caller does not say.
+const defaultMergeChunk = 1 << 20
+
+// MergeFile compacts the data file at srcPath into destPath, just like Merge,
+// without ever holding all of the keys in memory. This is for the files whose
+// keys do not fit in the memory at all, which NewDiskStore cannot load, let alone
+// Merge. The file is read twice and the record of every key is only picked out of
+// the sorted runs, so it takes more disk and time than Merge does.
+//
+// First, the file is read in chunks of chunkSize records, and the key, offset and
+// flags of the records of each chunk are sorted by key and spilled to a temporary
+// file next to destPath. Then the chunks are merged, like in an external sort, and
+// the last record of every key in the file is copied over, unless it is a
+// tombstone or it has expired. The new file has one record per key, in the order
+// of the keys, like with WithSortedCompaction. Its records are not padded, and the
+// tombstones are all dropped, whatever WithTombstoneGrace would keep.
+//
+// Like Migrate, MergeFile works on a file which no DiskStore has open, and it
+// writes destPath with a `.merge` suffix first, then renames it over destPath, so
+// destPath may be srcPath. A torn tail is left out, just like NewDiskStore does.
+// With chunkSize 0, the chunks have about a million records each.
+func MergeFile(srcPath, destPath string, chunkSize int) error {
+	if chunkSize <= 0 {
+		chunkSize = defaultMergeChunk
+	}
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	runs, err := spillRuns(src, filepath.Dir(destPath), chunkSize)
+	defer func() {
+		for _, run := range runs {
+			run.Close()
+			os.Remove(run.Name())
+		}
+	}()
+	if err != nil {
+		return err
+	}
+
+	tmpPath := destPath + ".merge"
+	dest, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	cleanup := func(err error) error {
+		dest.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	writer := bufio.NewWriter(dest)
+	if _, err := writer.Write(encodeFileHeader(formatVersion)); err != nil {
+		return cleanup(err)
+	}
+	now := time.Now().UnixNano()
+	err = mergeRuns(runs, func(s spilled) error {
+		if s.flags&flagTombstone != 0 || (s.expireAt != 0 && now >= s.expireAt) {
+			return nil
+		}
+		record := make([]byte, s.size)
+		if _, err := src.ReadAt(record, s.offset); err != nil {
+			return err
+		}
+		if isPadded(record) {
+			// the crc covers the padding, so the record has to be encoded afresh
+			timestamp, keySize, valueSize := decodeHeader(record)
+			key := string(record[headerSize : headerSize+keySize])
+			value := string(record[headerSize+keySize : headerSize+keySize+valueSize])
+			_, record = encodeRecord(timestamp, key, value, record[flagsOffset]&^flagPadded)
+		}
+		_, err := writer.Write(record)
+		return err
+	})
+	if err != nil {
+		return cleanup(err)
+	}
+	if err := writer.Flush(); err != nil {
+		return cleanup(err)
+	}
+	if err := dest.Sync(); err != nil {
+		return cleanup(err)
+	}
+	if err := dest.Close(); err != nil {
+		return cleanup(err)
+	}
+	if err := os.Rename(tmpPath, destPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// spilled is what MergeFile keeps of a record in the sorted runs: where the
+// record is in the file and whether it is still live. size leaves out the
+// padding. Its encoding in the run is:
+//
+//	┌──────────────┬─────┬────────────┬──────────┬───────────┬───────────────┐
+//	│ key_size(4B) │ key │ offset(8B) │ size(4B) │ flags(1B) │ expire_at(8B) │
+//	└──────────────┴─────┴────────────┴──────────┴───────────┴───────────────┘
+type spilled struct {
+	key      string
+	offset   int64
+	size     uint32
+	flags    byte
+	expireAt int64
+}
+
+// spilledSize is the size of a spilled record in its run, without its key.
+const spilledSize = 25
+
+// spillRuns reads the records of the file and writes them out, chunkSize at a
+// time, as runs sorted by key and then by offset. The records of a transaction
+// are spilled one by one. It returns the runs it wrote, rewound, even when it
+// fails, so that the caller can remove them.
+func spillRuns(src *os.File, dir string, chunkSize int) ([]*os.File, error) {
+	reader := bufio.NewReader(src)
+	version, offset, err := detectFormatVersion(reader)
+	if err != nil {
+		return nil, err
+	}
+	if version != formatVersion {
+		return nil, &CorruptError{Offset: 0, Reason: fmt.Sprintf("format version %d, the file has to be migrated first, see Migrate", version)}
+	}
+	var runs []*os.File
+	chunk := make([]spilled, 0, chunkSize)
+	flush := func() error {
+		if len(chunk) == 0 {
+			return nil
+		}
+		run, err := os.CreateTemp(dir, "caskdb-merge-*")
+		if err != nil {
+			return err
+		}
+		runs = append(runs, run)
+		if err := writeRun(run, chunk); err != nil {
+			return err
+		}
+		chunk = chunk[:0]
+		return nil
+	}
+	add := func(record []byte, offset int64) error {
+		_, keySize, valueSize := decodeHeader(record)
+		chunk = append(chunk, spilled{
+			key:      string(record[headerSize : headerSize+keySize]),
+			offset:   offset,
+			size:     headerSize + keySize + valueSize,
+			flags:    record[flagsOffset],
+			expireAt: recordExpiry(record),
+		})
+		if len(chunk) == chunkSize {
+			return flush()
+		}
+		return nil
+	}
+	for {
+		// the zeroes of the preallocated space after the last record, see
+		// WithPreallocate
+		if header, _ := reader.Peek(headerSize); len(header) == headerSize && isZeroes(header) {
+			break
+		}
+		record, err := readCheckedRecord(reader, headerSize, 12)
+		if err == io.EOF {
+			break
+		}
+		if err == ErrCorruptRecord {
+			return runs, &CorruptError{Offset: offset, Reason: "checksum mismatch"}
+		}
+		if err != nil {
+			return runs, err
+		}
+		if isBatch(record) {
+			_, keySize, valueSize := decodeHeader(record)
+			start := headerSize + int(keySize)
+			value := record[start : start+int(valueSize)]
+			inner, ok := splitBatch(value)
+			if !ok {
+				return runs, &CorruptError{Offset: offset, Reason: "malformed batch of records"}
+			}
+			for _, at := range inner {
+				if err := add(value[at:], offset+int64(start+at)); err != nil {
+					return runs, err
+				}
+			}
+		} else if err := add(record, offset); err != nil {
+			return runs, err
+		}
+		offset += int64(len(record))
+	}
+	if err := flush(); err != nil {
+		return runs, err
+	}
+	for _, run := range runs {
+		if _, err := run.Seek(0, io.SeekStart); err != nil {
+			return runs, err
+		}
+	}
+	return runs, nil
+}
+
+// writeRun sorts the chunk by key and then by offset, and writes it to the run.
+func writeRun(run *os.File, chunk []spilled) error {
+	sort.Slice(chunk, func(i, j int) bool {
+		if chunk[i].key != chunk[j].key {
+			return chunk[i].key < chunk[j].key
+		}
+		return chunk[i].offset < chunk[j].offset
+	})
+	writer := bufio.NewWriter(run)
+	entry := make([]byte, spilledSize)
+	for _, s := range chunk {
+		binary.LittleEndian.PutUint32(entry[0:4], uint32(len(s.key)))
+		if _, err := writer.Write(entry[0:4]); err != nil {
+			return err
+		}
+		if _, err := writer.WriteString(s.key); err != nil {
+			return err
+		}
+		binary.LittleEndian.PutUint64(entry[4:12], uint64(s.offset))
+		binary.LittleEndian.PutUint32(entry[12:16], s.size)
+		entry[16] = s.flags
+		binary.LittleEndian.PutUint64(entry[17:25], uint64(s.expireAt))
+		if _, err := writer.Write(entry[4:]); err != nil {
+			return err
+		}
+	}
+	return writer.Flush()
+}
+
+// readSpilled reads the next spilled record of a run, or returns io.EOF at its
+// end.
+func readSpilled(r *bufio.Reader) (spilled, error) {
+	entry := make([]byte, spilledSize)
+	if _, err := io.ReadFull(r, entry[0:4]); err != nil {
+		return spilled{}, err
+	}
+	key := make([]byte, binary.LittleEndian.Uint32(entry[0:4]))
+	if _, err := io.ReadFull(r, key); err != nil {
+		return spilled{}, err
+	}
+	if _, err := io.ReadFull(r, entry[4:]); err != nil {
+		return spilled{}, err
+	}
+	return spilled{
+		key:      string(key),
+		offset:   int64(binary.LittleEndian.Uint64(entry[4:12])),
+		size:     binary.LittleEndian.Uint32(entry[12:16]),
+		flags:    entry[16],
+		expireAt: int64(binary.LittleEndian.Uint64(entry[17:25])),
+	}, nil
+}
+
+// runHead is the next spilled record of a run, while the runs are merged.
+type runHead struct {
+	spilled
+	r *bufio.Reader
+}
+
+// runHeap orders the heads of the runs by key and then by offset.
+type runHeap []runHead
+
+func (h runHeap) Len() int { return len(h) }
+func (h runHeap) Less(i, j int) bool {
+	if h[i].key != h[j].key {
+		return h[i].key < h[j].key
+	}
+	return h[i].offset < h[j].offset
+}
+func (h runHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *runHeap) Push(x interface{}) { *h = append(*h, x.(runHead)) }
+func (h *runHeap) Pop() interface{} {
+	old := *h
+	head := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return head
+}
+
+// mergeRuns merges the sorted runs and calls fn with the last record of every
+// key, i.e. the one with the highest offset, in the order of the keys.
+func mergeRuns(runs []*os.File, fn func(s spilled) error) error {
+	h := make(runHeap, 0, len(runs))
+	// next reads the next record of the run into the heap, if there is one
+	next := func(r *bufio.Reader) error {
+		s, err := readSpilled(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		heap.Push(&h, runHead{s, r})
+		return nil
+	}
+	for _, run := range runs {
+		if err := next(bufio.NewReader(run)); err != nil {
+			return err
+		}
+	}
+	var last spilled
+	found := false
+	for h.Len() > 0 {
+		head := heap.Pop(&h).(runHead)
+		if found && head.key != last.key {
+			if err := fn(last); err != nil {
+				return err
+			}
+		}
+		last, found = head.spilled, true
+		if err := next(head.r); err != nil {
+			return err
+		}
+	}
+	if found {
+		return fn(last)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package caskdb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMergeFile(t *testing.T) {
+	store, err := NewDiskStore("test.db", WithAlignment(64))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+
+	want := make(map[string]string)
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key-%d", i%7)
+		value := fmt.Sprintf("value-%d", i)
+		store.Set(key, value)
+		want[key] = value
+	}
+	store.Delete("key-3")
+	delete(want, "key-3")
+	store.Txn(func(tx *Txn) error {
+		tx.Set("othello", "shakespeare")
+		tx.Delete("key-4")
+		return nil
+	})
+	want["othello"] = "shakespeare"
+	delete(want, "key-4")
+	store.SetWithExpiry("expired", "gone", time.Now().Add(-time.Minute))
+	store.SetWithExpiry("expiring", "later", time.Now().Add(time.Hour))
+	want["expiring"] = "later"
+	store.Close()
+
+	// tiny chunks, so that the records of a key end up in several runs
+	if err := MergeFile("test.db", "test.db", 3); err != nil {
+		t.Fatalf("MergeFile() error = %v", err)
+	}
+	store, err = NewDiskStore("test.db", WithVerifyOnStartup())
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	for key, val := range want {
+		if got, err := store.Get(key); err != nil || got != val {
+			t.Errorf("Get(%q) = %v, %v, want %v", key, got, err, val)
+		}
+	}
+	for _, key := range []string{"key-3", "key-4", "expired"} {
+		if _, err := store.Get(key); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Get(%q) error = %v, want %v", key, err, ErrKeyNotFound)
+		}
+	}
+	if _, ok, _ := store.ExpiresAt("expiring"); !ok {
+		t.Errorf("MergeFile() dropped the expiry of the key")
+	}
+	if reclaimable, _, dead, _ := store.CompactDryRun(); reclaimable != 0 || dead != 0 {
+		t.Errorf("CompactDryRun() of the merged file = %v bytes, %v records", reclaimable, dead)
+	}
+}
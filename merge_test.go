@@ -0,0 +1,419 @@
+package caskdb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func fileSize(t *testing.T, fileName string) int64 {
+	t.Helper()
+	info, err := os.Stat(fileName)
+	if err != nil {
+		t.Fatalf("failed to stat the file: %v", err)
+	}
+	return info.Size()
+}
+
+func TestDiskStore_Merge(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+
+	for _, author := range []string{"marlowe", "bacon", "shakespeare"} {
+		store.Set("othello", author)
+	}
+	store.Set("anna karenina", "tolstoy")
+	store.Set("dune", "frank herbert")
+	store.Delete("dune")
+	if err := store.Merge(); err != nil {
+		t.Fatalf("Merge() error = %v", err)
+	}
+	want := int64(fileHeaderSize + headerSize*2 + len("othello") + len("shakespeare") + len("anna karenina") + len("tolstoy"))
+	if size := fileSize(t, "test.db"); size != want {
+		t.Errorf("file size after Merge() = %v, want %v", size, want)
+	}
+	if val, _ := store.Get("othello"); val != "shakespeare" {
+		t.Errorf("Get() = %v, want %v", val, "shakespeare")
+	}
+	// the store keeps working on the new file
+	store.Set("hamlet", "shakespeare")
+	store.Close()
+
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	tests := map[string]string{"othello": "shakespeare", "anna karenina": "tolstoy", "hamlet": "shakespeare", "dune": ""}
+	for key, val := range tests {
+		if got, _ := store.Get(key); got != val {
+			t.Errorf("Get() = %v, want %v", got, val)
+		}
+	}
+	store.Close()
+}
+
+func TestDiskStore_MergeFailedOpen(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+
+	store.Set("othello", "marlowe")
+	store.Set("othello", "shakespeare")
+	size := fileSize(t, "test.db")
+	failed := errors.New("open failed")
+	store.openHook = func(name string) error {
+		return failed
+	}
+	if err := store.Merge(); !errors.Is(err, failed) {
+		t.Errorf("Merge() error = %v, want %v", err, failed)
+	}
+	if err := store.ReplaceAll(map[string]string{"dune": "frank herbert"}); !errors.Is(err, failed) {
+		t.Errorf("ReplaceAll() error = %v, want %v", err, failed)
+	}
+	store.openHook = nil
+	// the store carries on with the old file
+	if got := fileSize(t, "test.db"); got != size {
+		t.Errorf("file size after the failed Merge() = %v, want %v", got, size)
+	}
+	if val, _ := store.Get("othello"); val != "shakespeare" {
+		t.Errorf("Get() = %v, want %v", val, "shakespeare")
+	}
+	if err := store.Set("hamlet", "shakespeare"); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	if err := store.Merge(); err != nil {
+		t.Fatalf("Merge() error = %v", err)
+	}
+	store.Close()
+
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	tests := map[string]string{"othello": "shakespeare", "hamlet": "shakespeare", "dune": ""}
+	for key, val := range tests {
+		if got, _ := store.Get(key); got != val {
+			t.Errorf("Get() = %v, want %v", got, val)
+		}
+	}
+}
+
+func TestDiskStore_MergeWithConcurrentReads(t *testing.T) {
+	// the readers of the pool are reopened on the new file as well
+	for _, opts := range [][]Option{nil, {WithReaderPool(4)}} {
+		store, err := NewDiskStore("test.db", opts...)
+		if err != nil {
+			t.Fatalf("failed to create disk store: %v", err)
+		}
+		want := make(map[string]string)
+		for i := 0; i < 200; i++ {
+			key := fmt.Sprintf("key-%03d", i)
+			store.Set(key, "stale")
+			want[key] = fmt.Sprintf("value-%03d", i)
+			store.Set(key, want[key])
+		}
+
+		var wg sync.WaitGroup
+		done := make(chan struct{})
+		for r := 0; r < 4; r++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case <-done:
+						return
+					default:
+					}
+					for key, val := range want {
+						if got, err := store.Get(key); err != nil || got != val {
+							t.Errorf("Get() during a merge = %v, %v, want %v", got, err, val)
+							return
+						}
+					}
+				}
+			}()
+		}
+		for i := 0; i < 5; i++ {
+			if err := store.Merge(); err != nil {
+				t.Errorf("Merge() error = %v", err)
+			}
+			time.Sleep(time.Millisecond)
+		}
+		close(done)
+		wg.Wait()
+		store.Close()
+		os.Remove("test.db")
+	}
+}
+
+func TestDiskStore_ConcurrentMerges(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	for i := 0; i < 100; i++ {
+		store.Set(fmt.Sprintf("key-%03d", i), "stale")
+		store.Set(fmt.Sprintf("key-%03d", i), fmt.Sprintf("value-%03d", i))
+	}
+	var wg sync.WaitGroup
+	compactions := []func() error{store.Merge, store.Merge, store.InPlaceCompact}
+	for _, compact := range compactions {
+		wg.Add(1)
+		go func(compact func() error) {
+			defer wg.Done()
+			if err := compact(); err != nil {
+				t.Errorf("compaction error = %v", err)
+			}
+		}(compact)
+	}
+	wg.Wait()
+	if _, err := os.Stat("test.db.merge"); !os.IsNotExist(err) {
+		t.Errorf("the merge file is left behind: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		if got, _ := store.Get(fmt.Sprintf("key-%03d", i)); got != fmt.Sprintf("value-%03d", i) {
+			t.Errorf("Get() = %v, want %v", got, fmt.Sprintf("value-%03d", i))
+		}
+	}
+}
+
+func TestDiskStore_PurgeKeys(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+
+	store.Set("othello", "shakespeare")
+	store.Set("dune", "frank herbert")
+	store.Set("anna karenina", "tolstoy")
+	if err := store.PurgeKeys([]string{"dune", "anna karenina", "hamlet"}); err != nil {
+		t.Fatalf("PurgeKeys() error = %v", err)
+	}
+	// no tombstones, just the one live record
+	want := int64(fileHeaderSize + headerSize + len("othello") + len("shakespeare"))
+	if size := fileSize(t, "test.db"); size != want {
+		t.Errorf("file size after PurgeKeys() = %v, want %v", size, want)
+	}
+	store.Close()
+
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	tests := map[string]string{"othello": "shakespeare", "dune": "", "anna karenina": ""}
+	for key, val := range tests {
+		if got, _ := store.Get(key); got != val {
+			t.Errorf("Get() = %v, want %v", got, val)
+		}
+	}
+}
+
+func TestDiskStore_MergeTombstoneGrace(t *testing.T) {
+	store, err := NewDiskStore("test.db", WithTombstoneGrace(time.Hour))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+
+	store.Set("dune", "frank herbert")
+	store.Set("hamlet", "shakespeare")
+	store.Delete("dune")
+	if err := store.Merge(); err != nil {
+		t.Fatalf("Merge() error = %v", err)
+	}
+	// the recent tombstone of dune is kept along with the live record of hamlet
+	want := int64(fileHeaderSize + headerSize*2 + len("dune") + len("hamlet") + len("shakespeare"))
+	if size := fileSize(t, "test.db"); size != want {
+		t.Errorf("file size after Merge() = %v, want %v", size, want)
+	}
+	store.Close()
+
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	if val, _ := store.Get("dune"); val != "" {
+		t.Errorf("Get() = %v, want '' (empty)", val)
+	}
+	store.Close()
+}
+
+func TestDiskStore_MergeWithProgress(t *testing.T) {
+	store, err := NewDiskStore("test.db", WithSyncEveryN(1000))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	for i := 0; i < mergeProgressInterval*2+10; i++ {
+		store.Set(fmt.Sprintf("key-%d", i), "value")
+	}
+	var calls [][2]int64
+	err = store.MergeWithProgress(func(processedBytes, totalBytes int64) {
+		calls = append(calls, [2]int64{processedBytes, totalBytes})
+	})
+	if err != nil {
+		t.Fatalf("MergeWithProgress() error = %v", err)
+	}
+	if len(calls) != 3 {
+		t.Fatalf("MergeWithProgress() reported %v times, want 3", len(calls))
+	}
+	for i, call := range calls {
+		if i > 0 && call[0] <= calls[i-1][0] {
+			t.Errorf("progress went from %v to %v", calls[i-1][0], call[0])
+		}
+	}
+	if last := calls[len(calls)-1]; last[0] != last[1] {
+		t.Errorf("last progress = %v of %v, want all of it", last[0], last[1])
+	}
+}
+
+func TestDiskStore_CompactDryRun(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	for _, author := range []string{"marlowe", "bacon", "shakespeare"} {
+		store.Set("othello", author)
+	}
+	store.Set("anna karenina", "tolstoy")
+	store.Set("dune", "frank herbert")
+	store.Delete("dune")
+	size := fileSize(t, "test.db")
+	reclaimable, live, dead, err := store.CompactDryRun()
+	if err != nil {
+		t.Fatalf("CompactDryRun() error = %v", err)
+	}
+	if live != 2 || dead != 4 {
+		t.Errorf("CompactDryRun() records = %v live, %v dead, want 2 live, 4 dead", live, dead)
+	}
+	if got := fileSize(t, "test.db"); got != size {
+		t.Errorf("file size after CompactDryRun() = %v, want %v", got, size)
+	}
+	if err := store.Merge(); err != nil {
+		t.Fatalf("Merge() error = %v", err)
+	}
+	if want := size - fileSize(t, "test.db"); reclaimable != want {
+		t.Errorf("CompactDryRun() reclaimable = %v, want %v", reclaimable, want)
+	}
+}
+
+func TestDiskStore_SortedCompaction(t *testing.T) {
+	store, err := NewDiskStore("test.db", WithSortedCompaction(), WithTombstoneGrace(time.Hour))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	keys := []string{"othello", "dune", "anna karenina", "hamlet", "macbeth"}
+	for _, key := range keys {
+		store.Set(key, "value of "+key)
+	}
+	store.Set("dune", "frank herbert")
+	store.Delete("hamlet")
+	if err := store.Merge(); err != nil {
+		t.Fatalf("Merge() error = %v", err)
+	}
+	// the keys in order sit at increasing offsets after the merge
+	sorted := []string{"anna karenina", "dune", "macbeth", "othello"}
+	for i := 1; i < len(sorted); i++ {
+		if prev, next := store.keyDir[sorted[i-1]].position, store.keyDir[sorted[i]].position; prev >= next {
+			t.Errorf("%q is at offset %d, not after %q at %d", sorted[i], next, sorted[i-1], prev)
+		}
+	}
+	store.Close()
+
+	store, err = NewDiskStore("test.db", WithVerifyOnStartup())
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	tests := map[string]string{"dune": "frank herbert", "hamlet": "", "othello": "value of othello"}
+	for key, val := range tests {
+		if got, _ := store.Get(key); got != val {
+			t.Errorf("Get() = %v, want %v", got, val)
+		}
+	}
+}
+
+func TestDiskStore_WriteCompactedTo(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	store.Set("othello", "marlowe")
+	store.Set("othello", "shakespeare")
+	store.Set("dune", "frank herbert")
+	store.Delete("dune")
+	store.Txn(func(tx *Txn) error {
+		tx.Set("hamlet", "shakespeare")
+		tx.Set("anna karenina", "tolstoy")
+		return nil
+	})
+	if err := store.WriteCompactedTo("fork.db"); err != nil {
+		t.Fatalf("WriteCompactedTo() error = %v", err)
+	}
+	defer os.Remove("fork.db")
+
+	fork, err := NewDiskStore("fork.db", WithVerifyOnStartup())
+	if err != nil {
+		t.Fatalf("failed to open the fork: %v", err)
+	}
+	defer fork.Close()
+	tests := map[string]string{"othello": "shakespeare", "hamlet": "shakespeare", "anna karenina": "tolstoy"}
+	for key, val := range tests {
+		if got, _ := fork.Get(key); got != val {
+			t.Errorf("Get() = %v, want %v", got, val)
+		}
+	}
+	if _, err := fork.Get("dune"); err != ErrKeyNotFound {
+		t.Errorf("Get() error = %v, want %v", err, ErrKeyNotFound)
+	}
+	// one record per key, and nothing else
+	if reclaimable, _, dead, _ := fork.CompactDryRun(); reclaimable != 0 || dead != 0 {
+		t.Errorf("CompactDryRun() of the fork = %v bytes, %v records", reclaimable, dead)
+	}
+
+	// the fork is independent of the store
+	fork.Set("othello", "verdi")
+	if got, _ := store.Get("othello"); got != "shakespeare" {
+		t.Errorf("Get() = %v, want shakespeare", got)
+	}
+
+	// the data file of the store is never replaced, whatever it is called
+	if err := os.Symlink("test.db", "link.db"); err != nil {
+		t.Fatalf("failed to link the data file: %v", err)
+	}
+	defer os.Remove("link.db")
+	for _, path := range []string{"test.db", "./test.db", "link.db"} {
+		if err := store.WriteCompactedTo(path); !errors.Is(err, ErrOwnDataFile) {
+			t.Errorf("WriteCompactedTo(%q) error = %v, want %v", path, err, ErrOwnDataFile)
+		}
+	}
+	if got, _ := store.Get("othello"); got != "shakespeare" {
+		t.Errorf("Get() = %v, want shakespeare", got)
+	}
+}
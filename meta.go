@@ -0,0 +1,57 @@
+package caskdb
+
+import "fmt"
+
+// SetWithMeta stores the value for the key, just like Set, along with a few bytes
+// of metadata of the application, like a content type or the id of the source of
+// the value. The metadata is kept in the record next to the value, see flagMeta,
+// so it does not have to be framed into the value itself. It can take up to 65535
+// bytes, and empty metadata is the same as none. Use GetWithMetadata to read it
+// back.
+//
+// The metadata is not kept in the memory, so reading it always goes to the disk,
+// even with WithInlineValues. Overwriting the key with Set, or SetWithExpiry,
+// clears its metadata, while Rename carries it over to the new key.
+func (d *DiskStore) SetWithMeta(key string, value string, meta []byte) error {
+	if len(meta) > maxMetaSize {
+		return fmt.Errorf("caskdb: the metadata of the key %q takes %d bytes, more than %d", key, len(meta), maxMetaSize)
+	}
+	d.mu.Lock()
+	defer d.unlockAndNotify()
+	if d.closed {
+		return ErrClosed
+	}
+	var ext extension
+	if len(meta) > 0 {
+		ext.meta = meta
+	}
+	return d.setExtended(key, value, ext)
+}
+
+// GetWithMetadata returns the value of the key, just like Get, along with the
+// metadata it was stored with by SetWithMeta. The metadata is nil if there is
+// none.
+func (d *DiskStore) GetWithMetadata(key string) (string, []byte, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return "", nil, ErrClosed
+	}
+	if d.opts.noIndex {
+		return "", nil, ErrNoIndex
+	}
+	kEntry, ok := d.lookup(key)
+	if !ok {
+		return "", nil, ErrKeyNotFound
+	}
+	d.touch(key)
+	data, err := d.readEntry(key, kEntry)
+	if err != nil {
+		return "", nil, err
+	}
+	_, _, value, err := decodeKV(data)
+	if err != nil {
+		return "", nil, err
+	}
+	return value, decodeExtension(data).meta, nil
+}
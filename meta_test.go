@@ -0,0 +1,49 @@
+package caskdb
+
+import (
+	"os"
+	"testing"
+)
+
+func TestDiskStore_SetWithMeta(t *testing.T) {
+	store, err := NewDiskStore("test.db", WithInlineValues(64))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+
+	if err := store.SetWithMeta("othello", "shakespeare", []byte("text/plain")); err != nil {
+		t.Fatalf("SetWithMeta() error = %v", err)
+	}
+	store.Set("dune", "frank herbert")
+	if err := store.SetWithMeta("hamlet", "shakespeare", make([]byte, maxMetaSize+1)); err == nil {
+		t.Errorf("SetWithMeta() with too much metadata did not fail")
+	}
+	if err := store.Rename("othello", "macbeth"); err != nil {
+		t.Fatalf("Rename() error = %v", err)
+	}
+	store.Close()
+
+	store, err = NewDiskStore("test.db", WithVerifyOnStartup())
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	tests := []struct {
+		key   string
+		value string
+		meta  string
+	}{
+		{"macbeth", "shakespeare", "text/plain"},
+		{"dune", "frank herbert", ""},
+	}
+	for _, tt := range tests {
+		value, meta, err := store.GetWithMetadata(tt.key)
+		if err != nil || value != tt.value || string(meta) != tt.meta {
+			t.Errorf("GetWithMetadata(%q) = (%v, %q, %v), want (%v, %q, nil)", tt.key, value, meta, err, tt.value, tt.meta)
+		}
+	}
+	if got, _ := store.Get("macbeth"); got != "shakespeare" {
+		t.Errorf("Get() = %v, want shakespeare", got)
+	}
+}
@@ -0,0 +1,273 @@
+package caskdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// legacyHeaderSize is the size of the record header in the files written before
+// the file header existed, which we call version 0. The records had no crc and no
+// flags:
+//
+//	┌───────────────┬──────────────┬────────────────┐
+//	│ timestamp(4B) │ key_size(4B) │ value_size(4B) │
+//	└───────────────┴──────────────┴────────────────┘
+const legacyHeaderSize = 12
+
+// headerSizeV1 is the size of the record header in the format version 1, which had
+// the timestamp in seconds, in 4 bytes:
+//
+//	┌─────────┬───────────────┬──────────────┬────────────────┬───────────┐
+//	│ crc(4B) │ timestamp(4B) │ key_size(4B) │ value_size(4B) │ flags(1B) │
+//	└─────────┴───────────────┴──────────────┴────────────────┴───────────┘
+const headerSizeV1 = 17
+
+// migrateRecord is a record decoded from a file of any format version.
+type migrateRecord struct {
+	timestamp int64
+	key       string
+	value     string
+	flags     byte
+}
+
+// recordDecoder reads the next record of one format version. It returns the
+// number of bytes the record took in the file, and io.EOF once there are no more
+// records. A torn record at the end of the file is treated just like the end.
+type recordDecoder func(r *bufio.Reader) (migrateRecord, int, error)
+
+// recordDecoders has a decoder for every format version we can still read. Any
+// change to the record format must bump formatVersion and add the decoder of the
+// previous format here, so that the existing files can be migrated.
+var recordDecoders = map[int]recordDecoder{
+	0: decodeRecordV0,
+	1: decodeRecordV1,
+	2: decodeRecordV2,
+}
+
+// Migrate reads the file at srcPath, written in the format fromVersion, and writes
+// all of its records to destPath in the format toVersion. It lets the files
+// written by the older versions of this package be opened by NewDiskStore, which
+// only reads the current format. The timestamps of the formats before version 2
+// are in seconds, and become the nanosecond at the start of their second.
+//
+// The format of the source is detected from its file header, and Migrate fails if
+// it is not fromVersion. For now, toVersion can only be the current format. Every
+// record is copied in the same order, so the new file replays exactly like the old
+// one, stale records and tombstones included. Run Merge after opening it to drop
+// them.
+//
+// The new file is written next to destPath with a `.migrate` suffix and renamed
+// over it once it is complete, so destPath may even be srcPath. The source must
+// not be open by a DiskStore while it is migrated.
+func Migrate(srcPath, destPath string, fromVersion, toVersion int) error {
+	if toVersion != formatVersion {
+		return fmt.Errorf("caskdb: cannot migrate to format version %d, only to %d", toVersion, formatVersion)
+	}
+	decode, ok := recordDecoders[fromVersion]
+	if !ok {
+		return fmt.Errorf("caskdb: cannot migrate from unknown format version %d", fromVersion)
+	}
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	reader := bufio.NewReader(src)
+	version, offset, err := detectFormatVersion(reader)
+	if err != nil {
+		return err
+	}
+	if version != fromVersion {
+		return fmt.Errorf("caskdb: %s has format version %d, not %d", srcPath, version, fromVersion)
+	}
+
+	tmpPath := destPath + ".migrate"
+	dest, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	cleanup := func(err error) error {
+		dest.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	writer := bufio.NewWriter(dest)
+	if _, err := writer.Write(encodeFileHeader(formatVersion)); err != nil {
+		return cleanup(err)
+	}
+	for {
+		record, size, err := decode(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if err == ErrCorruptRecord {
+				return cleanup(&CorruptError{Offset: offset, Reason: "checksum mismatch"})
+			}
+			return cleanup(err)
+		}
+		_, data := encodeRecord(record.timestamp, record.key, record.value, record.flags)
+		if _, err := writer.Write(data); err != nil {
+			return cleanup(err)
+		}
+		offset += int64(size)
+	}
+	if err := writer.Flush(); err != nil {
+		return cleanup(err)
+	}
+	if err := dest.Sync(); err != nil {
+		return cleanup(err)
+	}
+	if err := dest.Close(); err != nil {
+		return cleanup(err)
+	}
+	if err := os.Rename(tmpPath, destPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// detectFormatVersion reads the file header, and returns the format version along
+// with the offset of the first record. The files without the caskdb magic bytes
+// are taken to be version 0, which had no file header at all.
+func detectFormatVersion(r *bufio.Reader) (int, int64, error) {
+	header, err := r.Peek(fileHeaderSize)
+	if err != nil && err != io.EOF {
+		return 0, 0, err
+	}
+	if len(header) < fileHeaderSize {
+		return 0, 0, nil
+	}
+	version, ok := decodeFileHeader(header)
+	if !ok {
+		return 0, 0, nil
+	}
+	if _, err := r.Discard(fileHeaderSize); err != nil {
+		return 0, 0, err
+	}
+	return int(version), fileHeaderSize, nil
+}
+
+// readRecord reads the header of the given size and then the key and the value,
+// whose sizes are at the offsets keySizeAt and keySizeAt+4 of the header.
+func readRecord(r *bufio.Reader, size int, keySizeAt int) ([]byte, error) {
+	header := make([]byte, size)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	keySize := binary.LittleEndian.Uint32(header[keySizeAt : keySizeAt+4])
+	valueSize := binary.LittleEndian.Uint32(header[keySizeAt+4 : keySizeAt+8])
+	record := make([]byte, size+int(keySize)+int(valueSize))
+	copy(record, header)
+	if _, err := io.ReadFull(r, record[size:]); err != nil {
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	return record, nil
+}
+
+func decodeRecordV0(r *bufio.Reader) (migrateRecord, int, error) {
+	data, err := readRecord(r, legacyHeaderSize, 4)
+	if err != nil {
+		return migrateRecord{}, 0, err
+	}
+	keySize := binary.LittleEndian.Uint32(data[4:8])
+	return migrateRecord{
+		timestamp: int64(binary.LittleEndian.Uint32(data[0:4])) * int64(time.Second),
+		key:       string(data[legacyHeaderSize : legacyHeaderSize+keySize]),
+		value:     string(data[legacyHeaderSize+keySize:]),
+	}, len(data), nil
+}
+
+func decodeRecordV1(r *bufio.Reader) (migrateRecord, int, error) {
+	data, err := readCheckedRecord(r, headerSizeV1, 8)
+	if err != nil {
+		return migrateRecord{}, 0, err
+	}
+	record := decodeKVV1(data)
+	if record.flags&flagBatch != 0 {
+		// the records of a transaction are in the old format as well
+		var batch []byte
+		for inner := []byte(record.value); len(inner) > 0; {
+			if len(inner) < headerSizeV1 {
+				return migrateRecord{}, 0, ErrCorruptRecord
+			}
+			keySize := binary.LittleEndian.Uint32(inner[8:12])
+			valueSize := binary.LittleEndian.Uint32(inner[12:16])
+			size := int64(headerSizeV1) + int64(keySize) + int64(valueSize)
+			if size > int64(len(inner)) {
+				return migrateRecord{}, 0, ErrCorruptRecord
+			}
+			write := decodeKVV1(inner[:size])
+			_, encoded := encodeRecord(write.timestamp, write.key, write.value, write.flags)
+			batch = append(batch, encoded...)
+			inner = inner[size:]
+		}
+		record.value = string(batch)
+	}
+	return record, len(data), nil
+}
+
+// decodeKVV1 decodes a record of the format version 1, without its padding.
+func decodeKVV1(data []byte) migrateRecord {
+	keySize := binary.LittleEndian.Uint32(data[8:12])
+	valueSize := binary.LittleEndian.Uint32(data[12:16])
+	return migrateRecord{
+		timestamp: int64(binary.LittleEndian.Uint32(data[4:8])) * int64(time.Second),
+		key:       string(data[headerSizeV1 : headerSizeV1+keySize]),
+		value:     string(data[headerSizeV1+keySize : headerSizeV1+keySize+valueSize]),
+		flags:     data[16] &^ flagPadded,
+	}
+}
+
+func decodeRecordV2(r *bufio.Reader) (migrateRecord, int, error) {
+	data, err := readCheckedRecord(r, headerSize, 12)
+	if err != nil {
+		return migrateRecord{}, 0, err
+	}
+	// the records are written out without their padding. The value is taken as it
+	// is, so that an expiring record keeps its expire_at
+	timestamp, keySize, valueSize := decodeHeader(data)
+	key := string(data[headerSize : headerSize+keySize])
+	value := string(data[headerSize+keySize : headerSize+keySize+valueSize])
+	return migrateRecord{timestamp, key, value, data[flagsOffset] &^ flagPadded}, len(data), nil
+}
+
+// readCheckedRecord reads a record with a crc and flags, like readRecord, along
+// with its padding, and verifies its checksum. The flags are the last byte of the
+// header.
+func readCheckedRecord(r *bufio.Reader, size int, keySizeAt int) ([]byte, error) {
+	data, err := readRecord(r, size, keySizeAt)
+	if err != nil {
+		return nil, err
+	}
+	if data[size-1]&flagPadded != 0 {
+		padSize := make([]byte, padSizeSize)
+		if _, err := io.ReadFull(r, padSize); err != nil {
+			return nil, io.EOF
+		}
+		padding := make([]byte, binary.LittleEndian.Uint32(padSize))
+		if _, err := io.ReadFull(r, padding); err != nil {
+			return nil, io.EOF
+		}
+		data = append(append(data, padSize...), padding...)
+	}
+	if !validChecksum(data) {
+		// a bad crc on the last record is a torn tail, same as in NewDiskStore
+		if _, err := r.Peek(1); err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, ErrCorruptRecord
+	}
+	return data, nil
+}
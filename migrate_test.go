@@ -0,0 +1,96 @@
+package caskdb
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"testing"
+	"time"
+)
+
+// encodeKVV0 encodes the record just like the version 0 did.
+func encodeKVV0(timestamp uint32, key string, value string) []byte {
+	record := make([]byte, legacyHeaderSize)
+	binary.LittleEndian.PutUint32(record[0:4], timestamp)
+	binary.LittleEndian.PutUint32(record[4:8], uint32(len(key)))
+	binary.LittleEndian.PutUint32(record[8:12], uint32(len(value)))
+	return append(record, key+value...)
+}
+
+func TestMigrate(t *testing.T) {
+	var data []byte
+	data = append(data, encodeKVV0(10, "othello", "marlowe")...)
+	data = append(data, encodeKVV0(11, "anna karenina", "tolstoy")...)
+	data = append(data, encodeKVV0(12, "othello", "shakespeare")...)
+	// a torn record at the end is dropped
+	data = append(data, encodeKVV0(13, "dune", "frank herbert")[:20]...)
+	if err := os.WriteFile("test_v0.db", data, 0666); err != nil {
+		t.Fatalf("failed to write the file: %v", err)
+	}
+	defer os.Remove("test_v0.db")
+	defer os.Remove("test.db")
+
+	if err := Migrate("test_v0.db", "test.db", 1, formatVersion); err == nil {
+		t.Errorf("Migrate() with the wrong fromVersion did not fail")
+	}
+	if err := Migrate("test_v0.db", "test.db", 0, formatVersion); err != nil {
+		t.Fatalf("Migrate() error = %v", err)
+	}
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	tests := map[string]string{"othello": "shakespeare", "anna karenina": "tolstoy", "dune": ""}
+	for key, val := range tests {
+		if got, _ := store.Get(key); got != val {
+			t.Errorf("Get() = %v, want %v", got, val)
+		}
+	}
+	if ts := store.keyDir["othello"].timestamp; ts != int64(12*time.Second) {
+		t.Errorf("timestamp = %v, want %v", ts, int64(12*time.Second))
+	}
+}
+
+// encodeRecordV1 encodes the record just like the version 1 did.
+func encodeRecordV1(timestamp uint32, key string, value string, flags byte) []byte {
+	record := make([]byte, headerSizeV1)
+	binary.LittleEndian.PutUint32(record[4:8], timestamp)
+	binary.LittleEndian.PutUint32(record[8:12], uint32(len(key)))
+	binary.LittleEndian.PutUint32(record[12:16], uint32(len(value)))
+	record[16] = flags
+	record = append(record, key+value...)
+	binary.LittleEndian.PutUint32(record[0:4], crc32.ChecksumIEEE(record[4:]))
+	return record
+}
+
+func TestMigrateV1(t *testing.T) {
+	data := encodeFileHeader(1)
+	data = append(data, encodeRecordV1(10, "othello", "marlowe", 0)...)
+	batch := append(encodeRecordV1(11, "othello", "shakespeare", 0), encodeRecordV1(11, "dune", "frank herbert", 0)...)
+	data = append(data, encodeRecordV1(11, "", string(batch), flagBatch)...)
+	data = append(data, encodeRecordV1(12, "dune", "", flagTombstone)...)
+	if err := os.WriteFile("test_v1.db", data, 0666); err != nil {
+		t.Fatalf("failed to write the file: %v", err)
+	}
+	defer os.Remove("test_v1.db")
+	defer os.Remove("test.db")
+
+	if err := Migrate("test_v1.db", "test.db", 1, formatVersion); err != nil {
+		t.Fatalf("Migrate() error = %v", err)
+	}
+	store, err := NewDiskStore("test.db", WithVerifyOnStartup())
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	tests := map[string]string{"othello": "shakespeare", "dune": ""}
+	for key, val := range tests {
+		if got, _ := store.Get(key); got != val {
+			t.Errorf("Get() = %v, want %v", got, val)
+		}
+	}
+	if ts := store.keyDir["othello"].timestamp; ts != int64(11*time.Second) {
+		t.Errorf("timestamp = %v, want %v", ts, int64(11*time.Second))
+	}
+}
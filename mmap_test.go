@@ -0,0 +1,76 @@
+package caskdb
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDiskStore_Mmap(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	store.Set("othello", "shakespeare")
+	store.Close()
+
+	store, err = NewDiskStore("test.db", WithMmap())
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	// write enough data so that the file gets mapped again
+	value := strings.Repeat("x", 1024)
+	for i := 0; i < mmapRemapSize/len(value)+1; i++ {
+		store.Set(fmt.Sprint(i), value)
+	}
+	store.Set("dune", "frank herbert")
+	if val, _ := store.Get("othello"); val != "shakespeare" {
+		t.Errorf("Get() = %v, want %v", val, "shakespeare")
+	}
+	if val, _ := store.Get("0"); val != value {
+		t.Errorf("Get() = %v, want %v", val, value)
+	}
+	// the last record is not mapped yet and is read from the file
+	if val, _ := store.Get("dune"); val != "frank herbert" {
+		t.Errorf("Get() = %v, want %v", val, "frank herbert")
+	}
+	if !store.Close() {
+		t.Errorf("Close() failed")
+	}
+}
+
+func benchmarkRandomGet(b *testing.B, opts ...Option) {
+	store, err := NewDiskStore("bench.db")
+	if err != nil {
+		b.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("bench.db")
+	const numKeys = 10000
+	value := strings.Repeat("x", 256)
+	for i := 0; i < numKeys; i++ {
+		store.Set(fmt.Sprint(i), value)
+	}
+	store.Close()
+
+	store, err = NewDiskStore("bench.db", opts...)
+	if err != nil {
+		b.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	keys := rand.Perm(numKeys)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		store.Get(fmt.Sprint(keys[i%numKeys]))
+	}
+}
+
+func BenchmarkDiskStore_GetReadAt(b *testing.B) {
+	benchmarkRandomGet(b)
+}
+
+func BenchmarkDiskStore_GetMmap(b *testing.B) {
+	benchmarkRandomGet(b, WithMmap())
+}
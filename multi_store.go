@@ -0,0 +1,119 @@
+package caskdb
+
+import (
+	"fmt"
+	"hash/fnv"
+	"time"
+)
+
+// MultiStore spreads the keys over several DiskStores, the shards, and presents
+// them as a single store. Every key lives in exactly one shard, as picked by the
+// shard function, so the shards never disagree about a key. The writes of
+// different shards take different locks and go to different files, possibly on
+// different disks, so they do not wait for each other.
+//
+// The shard function must keep mapping a key to the same shard, or the keys
+// written before are lost from view. So the shards must always be passed in the
+// same order, and their number must not change, unless the data is moved around
+// first.
+type MultiStore struct {
+	shards []*DiskStore
+	shard  func(key string) int
+}
+
+// NewMultiStore returns the MultiStore over the shards. shard maps a key to the
+// index of its shard in shards, and with nil, the FNV-1a hash of the key modulo
+// the number of shards is used. NewMultiStore returns ErrNoShards if shards is
+// empty. For the keys which the shard function maps to an index out of range,
+// the methods return ErrShardOutOfRange.
+func NewMultiStore(shards []*DiskStore, shard func(key string) int) (*MultiStore, error) {
+	if len(shards) == 0 {
+		return nil, ErrNoShards
+	}
+	if shard == nil {
+		n := uint32(len(shards))
+		shard = func(key string) int {
+			h := fnv.New32a()
+			h.Write([]byte(key))
+			return int(h.Sum32() % n)
+		}
+	}
+	return &MultiStore{shards: shards, shard: shard}, nil
+}
+
+// storeOf returns the shard of the key.
+func (m *MultiStore) storeOf(key string) (*DiskStore, error) {
+	i := m.shard(key)
+	if i < 0 || i >= len(m.shards) {
+		return nil, fmt.Errorf("%w: %d for the key %q, with %d shards", ErrShardOutOfRange, i, key, len(m.shards))
+	}
+	return m.shards[i], nil
+}
+
+// Get returns the value of the key from its shard, see DiskStore.Get.
+func (m *MultiStore) Get(key string) (string, error) {
+	d, err := m.storeOf(key)
+	if err != nil {
+		return "", err
+	}
+	return d.Get(key)
+}
+
+// Set stores the value for the key in its shard, see DiskStore.Set.
+func (m *MultiStore) Set(key string, value string) error {
+	d, err := m.storeOf(key)
+	if err != nil {
+		return err
+	}
+	return d.Set(key, value)
+}
+
+// Delete removes the key from its shard, see DiskStore.Delete.
+func (m *MultiStore) Delete(key string) error {
+	d, err := m.storeOf(key)
+	if err != nil {
+		return err
+	}
+	return d.Delete(key)
+}
+
+// ScanSince runs DiskStore.ScanSince over every shard in turn, till fn returns
+// false. Each shard is consistent on its own, but a write may land in one shard
+// while another is being scanned.
+func (m *MultiStore) ScanSince(t time.Time, fn func(key, value string) bool) error {
+	stopped := false
+	for _, d := range m.shards {
+		err := d.ScanSince(t, func(key, value string) bool {
+			stopped = !fn(key, value)
+			return !stopped
+		})
+		if err != nil {
+			return err
+		}
+		if stopped {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Stats returns the stats of every shard, in the order of the shards.
+func (m *MultiStore) Stats() []Stats {
+	stats := make([]Stats, len(m.shards))
+	for i, d := range m.shards {
+		stats[i] = d.Stats()
+	}
+	return stats
+}
+
+// Close closes all of the shards, and reports whether all of them closed
+// cleanly.
+func (m *MultiStore) Close() bool {
+	ok := true
+	for _, d := range m.shards {
+		if !d.Close() {
+			ok = false
+		}
+	}
+	return ok
+}
@@ -0,0 +1,113 @@
+package caskdb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMultiStore(t *testing.T) {
+	var shards []*DiskStore
+	for i := 0; i < 3; i++ {
+		fileName := fmt.Sprintf("test-%d.db", i)
+		store, err := NewDiskStore(fileName)
+		if err != nil {
+			t.Fatalf("failed to create disk store: %v", err)
+		}
+		defer os.Remove(fileName)
+		shards = append(shards, store)
+	}
+	multi, err := NewMultiStore(shards, nil)
+	if err != nil {
+		t.Fatalf("NewMultiStore() error = %v", err)
+	}
+	defer multi.Close()
+	var store Store = multi
+
+	tests := make(map[string]string)
+	for i := 0; i < 30; i++ {
+		tests[fmt.Sprintf("key-%d", i)] = fmt.Sprintf("value-%d", i)
+	}
+	for key, val := range tests {
+		store.Set(key, val)
+	}
+	for key, val := range tests {
+		if got, _ := store.Get(key); got != val {
+			t.Errorf("Get() = %v, want %v", got, val)
+		}
+	}
+	// every key is in exactly one shard, and every shard got some
+	total := 0
+	for i, stats := range multi.Stats() {
+		if stats.Keys == 0 {
+			t.Errorf("shard %d got no keys", i)
+		}
+		total += stats.Keys
+	}
+	if total != len(tests) {
+		t.Errorf("the shards hold %d keys, want %d", total, len(tests))
+	}
+
+	if err := multi.Delete("key-0"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, err := store.Get("key-0"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Get() error = %v, want %v", err, ErrKeyNotFound)
+	}
+	seen := 0
+	err = multi.ScanSince(time.Time{}, func(key, value string) bool {
+		seen++
+		return true
+	})
+	if err != nil || seen != len(tests)-1 {
+		t.Errorf("ScanSince() visited %d keys, %v, want %d", seen, err, len(tests)-1)
+	}
+	seen = 0
+	multi.ScanSince(time.Time{}, func(key, value string) bool {
+		seen++
+		return false
+	})
+	if seen != 1 {
+		t.Errorf("ScanSince() visited %d keys after fn returned false, want 1", seen)
+	}
+}
+
+func TestMultiStore_ShardOutOfRange(t *testing.T) {
+	if _, err := NewMultiStore(nil, nil); !errors.Is(err, ErrNoShards) {
+		t.Errorf("NewMultiStore() error = %v, want %v", err, ErrNoShards)
+	}
+
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	multi, err := NewMultiStore([]*DiskStore{store}, func(key string) int {
+		if key == "othello" {
+			return 0
+		}
+		return len(key)
+	})
+	if err != nil {
+		t.Fatalf("NewMultiStore() error = %v", err)
+	}
+	defer multi.Close()
+
+	if err := multi.Set("othello", "shakespeare"); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	if err := multi.Set("dune", "frank herbert"); !errors.Is(err, ErrShardOutOfRange) {
+		t.Errorf("Set() error = %v, want %v", err, ErrShardOutOfRange)
+	}
+	if _, err := multi.Get("dune"); !errors.Is(err, ErrShardOutOfRange) {
+		t.Errorf("Get() error = %v, want %v", err, ErrShardOutOfRange)
+	}
+	if err := multi.Delete("dune"); !errors.Is(err, ErrShardOutOfRange) {
+		t.Errorf("Delete() error = %v, want %v", err, ErrShardOutOfRange)
+	}
+	if got, _ := multi.Get("othello"); got != "shakespeare" {
+		t.Errorf("Get() = %v, want shakespeare", got)
+	}
+}
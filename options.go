@@ -0,0 +1,699 @@
+package caskdb
+
+import (
+	"io"
+	"time"
+)
+
+// Option configures the optional behaviour of a DiskStore. Options are passed to
+// NewDiskStore and are applied in the given order:
+//
+//	store, _ := NewDiskStore("books.db", WithMmap())
+type Option func(*options)
+
+// options holds all the knobs of a DiskStore. The zero value is the default
+// behaviour, so that adding a new option never changes how existing stores work.
+type options struct {
+	// mmap serves reads from a memory mapped view of the file, see WithMmap
+	mmap bool
+	// verifyOnStartup checks the crc of every record while loading the file, see
+	// WithVerifyOnStartup
+	verifyOnStartup bool
+	// tombstoneGrace is how long Merge keeps the tombstones around, see
+	// WithTombstoneGrace
+	tombstoneGrace time.Duration
+	// clock returns the current time, it is time.Now when nil. See WithClock
+	clock func() time.Time
+	// groupCommit is the interval between the fsyncs, see WithGroupCommit
+	groupCommit time.Duration
+	// initialMapCapacity is the number of keys keyDir is sized for upfront, see
+	// WithInitialMapCapacity
+	initialMapCapacity int
+	// strictReads checks that the record read by Get is of the requested key, see
+	// WithStrictReads
+	strictReads bool
+	// corruptionPolicy decides what happens when the startup finds a corrupt
+	// record, see WithCorruptionPolicy
+	corruptionPolicy CorruptionPolicy
+	// syncEveryN is the number of writes between the fsyncs, see WithSyncEveryN
+	syncEveryN int
+	// visibleAfterSync makes every write fsync before keyDir is updated, see
+	// WithVisibleAfterSync
+	visibleAfterSync bool
+	// readOnly opens the file for reading only and rejects the writes, see
+	// WithReplicaMode
+	readOnly bool
+	// replicaPoll is the interval between the catch ups of a replica, see
+	// WithReplicaMode
+	replicaPoll time.Duration
+	// alignment is the boundary every record starts at, see WithAlignment
+	alignment int
+	// readerPool is the number of read only descriptors Get spreads the reads
+	// over, see WithReaderPool
+	readerPool int
+	// fsyncDir syncs the directory after creating or renaming the files, see
+	// WithFsyncDir
+	fsyncDir bool
+	// inlineValues is the size up to which the values are kept in keyDir, see
+	// WithInlineValues
+	inlineValues int
+	// name identifies the store in the logs and the stats, see WithName
+	name string
+	// noIndex skips building the keyDir, see WithNoIndex
+	noIndex bool
+	// accessTracking records the time every key was last used, see
+	// WithAccessTracking
+	accessTracking bool
+	// verifyTimestamps checks that the timestamps in the file never go back, see
+	// WithAppendOnlyVerify
+	verifyTimestamps bool
+	// timestampSkew is how far back a timestamp may go before it is flagged
+	timestampSkew time.Duration
+	// atomicCreate creates a new file under a temporary name, see
+	// WithAtomicCreate
+	atomicCreate bool
+	// maxRecordCount is the most keys the store may hold, see WithMaxRecordCount
+	maxRecordCount int
+	// preallocate is the size of the chunks the file grows by, see
+	// WithPreallocate
+	preallocate int64
+	// onEvict is called with the keys the store removes by itself, see
+	// WithOnEvict
+	onEvict func(key string, reason EvictReason)
+	// indexFlush is the interval between the writes of the hint file, see
+	// WithPeriodicIndexFlush
+	indexFlush time.Duration
+	// maxStartup is how long loading the file may take, see
+	// WithMaxStartupDuration
+	maxStartup time.Duration
+	// validator checks every value before it is written, see
+	// WithValueValidator
+	validator func(key, value string) error
+	// scanReadAhead is how many bytes the scans read from the file at once, see
+	// WithScanReadAhead
+	scanReadAhead int
+	// sortedCompaction makes Merge write the records in the order of their keys,
+	// see WithSortedCompaction
+	sortedCompaction bool
+	// maxIndexMemory is how much memory the keyDir may take, and
+	// indexMemoryPolicy what happens beyond it, see WithMaxIndexMemory
+	maxIndexMemory    int64
+	indexMemoryPolicy IndexMemoryPolicy
+	// tee gets a copy of every record appended to the file, and teePolicy tells
+	// what to do when it fails, see WithWriteTee
+	tee       io.Writer
+	teePolicy TeePolicy
+	// startupProgress is called while the file is loaded, see
+	// WithStartupProgress
+	startupProgress func(bytesScanned, totalBytes int64)
+	// baseOffset is where the store starts in the file, see WithBaseOffset
+	baseOffset int64
+	// bulkDuplicates tells BulkLoad what to do with a key emitted twice, see
+	// WithBulkLoadDuplicates
+	bulkDuplicates DuplicatePolicy
+	// fullHintChecksum makes the hint cover all the records instead of just the
+	// last few, see WithFullHintChecksum
+	fullHintChecksum bool
+	// ioRetryAttempts is how many times the reads and the writes of the file are
+	// tried, and ioRetryBackoff the first wait between them, see WithIORetry
+	ioRetryAttempts int
+	ioRetryBackoff  time.Duration
+}
+
+// CorruptionPolicy tells the store what to do when it finds a corrupt record
+// while loading the file.
+type CorruptionPolicy int
+
+const (
+	// CorruptionFail makes NewDiskStore return a CorruptError. This is the default
+	CorruptionFail CorruptionPolicy = iota
+	// CorruptionSkipRecord logs and skips the corrupt record, and goes on loading
+	// the rest of the file. This recovers as many keys as possible, but the keys
+	// of the skipped record may come back with their older values
+	CorruptionSkipRecord
+	// CorruptionTruncateTail cuts the file at the corrupt record, dropping it and
+	// everything which was written after it
+	CorruptionTruncateTail
+)
+
+// WithMmap memory maps the data file, so that Get can copy the value straight out
+// of the mapping instead of making a read syscall for every lookup. This helps
+// read heavy workloads where the file does not fit the page cache comfortably.
+//
+// Since the file is append only, the bytes which are already written never change
+// and are safe to map. The records which are appended after the file was mapped
+// are read with the regular syscall path, till enough of them pile up and the file
+// is mapped again. On platforms which do not support mmap, this option does
+// nothing.
+func WithMmap() Option {
+	return func(o *options) {
+		o.mmap = true
+	}
+}
+
+// WithVerifyOnStartup verifies the checksum of every record while the keyDir is
+// being built, so that a silently corrupted record is caught when the store is
+// opened rather than on its first read. NewDiskStore returns an error with the
+// offset of the first bad record.
+//
+// Reading every record fully makes the startup slower. Without this option only
+// the last record is verified, to find out whether the process crashed in the
+// middle of writing it.
+func WithVerifyOnStartup() Option {
+	return func(o *options) {
+		o.verifyOnStartup = true
+	}
+}
+
+// WithTombstoneGrace makes Merge keep the tombstones which were written within
+// the last d, and purge only the older ones. By default Merge drops every
+// tombstone, which is fine for a single process. But when the file is shipped to
+// followers, a follower which has not seen the tombstone yet would never learn
+// that the key was deleted, and the key would come back to life. The grace period
+// should be longer than the time it takes for a write to reach every follower.
+func WithTombstoneGrace(d time.Duration) Option {
+	return func(o *options) {
+		o.tombstoneGrace = d
+	}
+}
+
+// WithClock makes the store use clock instead of time.Now for the timestamps of
+// the records and for everything which depends on the current time. This is
+// meant for tests, which can move a fake clock forward to check time dependent
+// behaviour deterministically.
+func WithClock(clock func() time.Time) Option {
+	return func(o *options) {
+		o.clock = clock
+	}
+}
+
+// WithGroupCommit stops Set from calling fsync after every write. The writes
+// return as soon as their bytes are handed over to the OS, and a background
+// goroutine fsyncs the file at most once per window. This is much faster for
+// write heavy workloads, but a crash can lose the writes of the last window.
+// Use SyncAndWait to flush the pending writes right away.
+func WithGroupCommit(window time.Duration) Option {
+	return func(o *options) {
+		o.groupCommit = window
+	}
+}
+
+// WithInitialMapCapacity sizes the keyDir for n keys when the store is opened. By
+// default the store guesses the number of keys from the size of the file, which
+// can be way off when the values are much larger or smaller than usual, or when
+// the file has a lot of stale records. If you know roughly how many keys the
+// database holds, passing it here avoids growing the map during the startup.
+func WithInitialMapCapacity(n int) Option {
+	return func(o *options) {
+		o.initialMapCapacity = n
+	}
+}
+
+// WithStrictReads makes Get check that the record it read from the disk is of the
+// key it was asked for, and return ErrCorruptRecord when it is not. This guards
+// against a keyDir entry which points at the wrong offset, which would otherwise
+// silently return the value of some other key. The key is decoded along with the
+// value anyway, so the check is cheap.
+func WithStrictReads() Option {
+	return func(o *options) {
+		o.strictReads = true
+	}
+}
+
+// WithCorruptionPolicy sets what NewDiskStore does when it finds a corrupt record
+// in the middle of the file, trading the availability of the store against the
+// data which is lost: fail with an error, skip the record, or truncate the file
+// at it. Only the records whose checksum is verified can be found corrupt, so this
+// goes together with WithVerifyOnStartup. A partially written record at the end
+// of the file is always cut off, whatever the policy.
+func WithCorruptionPolicy(policy CorruptionPolicy) Option {
+	return func(o *options) {
+		o.corruptionPolicy = policy
+	}
+}
+
+// WithSyncEveryN makes the store fsync the file once every n writes, instead of
+// after every single one. A crash loses at most the last n writes. This is the
+// count based alternative to WithGroupCommit, and both can be used together, in
+// which case the file is synced by whichever comes first.
+func WithSyncEveryN(n int) Option {
+	return func(o *options) {
+		o.syncEveryN = n
+	}
+}
+
+// WithVisibleAfterSync makes a write visible to Get only once its record is synced
+// to the disk, so that a reader never sees a value which a crash could still
+// lose. Without WithGroupCommit or WithSyncEveryN this is how every write works
+// already. With them, the write fsyncs the file before it updates the keyDir,
+// just like SetDurable does, which costs the latency those options save. The
+// writes hold the write lock while they sync, so the fsyncs are not shared
+// between the writers either. If the fsync fails, the write fails and the key
+// keeps its old value.
+func WithVisibleAfterSync() Option {
+	return func(o *options) {
+		o.visibleAfterSync = true
+	}
+}
+
+// WithReplicaMode opens the store as a read only replica of a file which another
+// process, the leader, keeps appending to. Every pollInterval the replica calls
+// Reopen to load the records the leader has written since, so Get reflects the
+// leader's writes within one interval. A record which the leader is still in the
+// middle of writing is left for the next poll. When the leader replaces the file
+// with Merge, the replica opens the new file and loads it from scratch.
+//
+// The writes to a replica return ErrReadOnly. Polling stops on Close.
+func WithReplicaMode(pollInterval time.Duration) Option {
+	return func(o *options) {
+		o.readOnly = true
+		o.replicaPoll = pollInterval
+	}
+}
+
+// WithAlignment pads the records, so that every record starts at a multiple of n
+// bytes in the file, e.g. 8 to keep the headers in the mmapped file word aligned,
+// or 512 for direct I/O. The padding is recorded in the record itself, so the
+// files can be read whatever the alignment of the store which opens them. The
+// padding costs up to n+3 bytes per record. Merge aligns the records again in the
+// new file, while InPlaceCompact moves them as they are, unaligned.
+//
+// The default of 1 means no padding, and the records are written just like
+// before the option existed.
+func WithAlignment(n int) Option {
+	return func(o *options) {
+		o.alignment = n
+	}
+}
+
+// WithReaderPool opens n extra read only descriptors of the data file, and spreads
+// the reads of Get over them in a round robin. The reads with ReadAt do not need
+// a lock, but on some platforms a single descriptor still becomes a point of
+// contention under a lot of concurrent readers. The writes keep going through
+// their own descriptor. Without this option, or with n below 2, all the reads go
+// through the descriptor of the writes.
+func WithReaderPool(n int) Option {
+	return func(o *options) {
+		o.readerPool = n
+	}
+}
+
+// WithFsyncDir fsyncs the directory of the data file whenever the store creates
+// or renames a file in it: when a new database is created, when Merge renames the
+// merged file over the old one and when InPlaceCompact writes its plan. Syncing
+// the file itself does not make its directory entry durable, so on some file
+// systems a crash right after creating a database can lose the whole file, or
+// bring back the old file after a Merge. This costs an extra fsync for each of
+// these, which are rare, and does nothing on the platforms without it.
+func WithFsyncDir() Option {
+	return func(o *options) {
+		o.fsyncDir = true
+	}
+}
+
+// WithInlineValues keeps a copy of the values of up to maxLen bytes in the memory,
+// next to their position in the keyDir, so that Get returns them without reading
+// the disk. Every write updates the copy. This suits the workloads with a lot of
+// small values which are read all the time, like configs or counters, at the cost
+// of the memory they take, see EstimatedMemoryUsage.
+func WithInlineValues(maxLen int) Option {
+	return func(o *options) {
+		o.inlineValues = maxLen
+	}
+}
+
+// WithName names the store, so that its log lines and stats can be told apart
+// from the ones of the other stores in the same process. The name defaults to the
+// base name of the data file, e.g. "books.db".
+func WithName(name string) Option {
+	return func(o *options) {
+		o.name = name
+	}
+}
+
+// WithNoIndex opens the store for writing only, without scanning the file to
+// build the keyDir, so the startup takes no time whatever the size of the file.
+// This suits the ingestion pipelines, which only append the data for some other
+// process to read later. Set, Delete and the other writes work as usual, while
+// Get and everything else which needs the keyDir, including Merge, return
+// ErrNoIndex. Delete always writes a tombstone, since it cannot tell whether the
+// key exists.
+//
+// Without the scan, a torn tail left behind by a crash is not cut off, and the
+// new records get appended after it. Open the file with the default options once
+// after a crash, to clean it up.
+func WithNoIndex() Option {
+	return func(o *options) {
+		o.noIndex = true
+	}
+}
+
+// WithAccessTracking records the time every key was last read or written, which
+// EvictLRU uses to pick the keys to evict. Get updates the time with a single
+// atomic store, but it does read the clock on every call. The times are kept only
+// in the memory, so after a restart every key starts with the time it was
+// loaded at.
+func WithAccessTracking() Option {
+	return func(o *options) {
+		o.accessTracking = true
+	}
+}
+
+// WithAppendOnlyVerify checks, while the file is loaded, that the timestamps of
+// the records never go back. The records are appended in the order they are
+// written, so a record older than the one before it hints at a record which landed
+// in the wrong place, or at a clock which jumped back. The crc cannot catch either,
+// since every record is fine on its own.
+//
+// A timestamp may go back by up to skew, to allow for the small adjustments of the
+// clock. Every record beyond that is logged along with its offset and counted in
+// Stats.OutOfOrder, but it is still loaded as usual.
+func WithAppendOnlyVerify(skew time.Duration) Option {
+	return func(o *options) {
+		o.verifyTimestamps = true
+		o.timestampSkew = skew
+	}
+}
+
+// WithAtomicCreate makes NewDiskStore create a new database file atomically. The
+// file is first written with its header under a temporary name with the `.create`
+// suffix, synced and then renamed in place, and the directory is synced after the
+// rename. A crash while creating the database leaves either the complete file or
+// no file at all, never an empty one which the next start would refuse to open.
+// An existing file is opened as usual.
+//
+// Only one process should create the same database at once, as the rename would
+// replace the file created by the other.
+func WithAtomicCreate() Option {
+	return func(o *options) {
+		o.atomicCreate = true
+	}
+}
+
+// WithMaxRecordCount caps the number of live keys in the store at n, for the
+// environments where the store must not grow without a bound. A write which would
+// add a key past the cap fails with ErrRecordLimit and leaves the file and the
+// keyDir untouched, while the overwrites and the deletes of the existing keys
+// always go through. Set returns the error, as it does with any failed write.
+//
+// The count is that of keyDir, so it costs nothing to keep track of. The stale
+// records still take space in the file till the next Merge. The cap does not
+// apply with WithNoIndex, which does not know the keys.
+func WithMaxRecordCount(n int) Option {
+	return func(o *options) {
+		o.maxRecordCount = n
+	}
+}
+
+// WithPreallocate grows the file in chunks of chunkSize bytes ahead of the writes,
+// instead of a record at a time. The filesystem then allocates the file in a few
+// large extents, which keeps it from getting fragmented and saves the work of
+// allocating a block on every other write. On Linux the chunks are really
+// allocated with fallocate, elsewhere the file is just extended.
+//
+// The file is larger than the data it holds till Close, which truncates it back
+// to the end of the last record. After a crash, the startup stops at the zeroed
+// space after the last record, and checks the checksum of every record so that a
+// torn write in front of the zeroes is not mistaken for a good record.
+//
+// The writes have to go at the end of the data rather than at the end of the
+// file, so NewDiskStore opens the file without os.O_APPEND. A file passed to
+// NewDiskStoreFromFile must be opened without it as well. The option is ignored
+// with WithReplicaMode and WithNoIndex.
+func WithPreallocate(chunkSize int64) Option {
+	return func(o *options) {
+		o.preallocate = chunkSize
+	}
+}
+
+// EvictReason tells why the store removed a key by itself, see WithOnEvict.
+type EvictReason int
+
+const (
+	// EvictCapacity is a key removed by EvictLRU to make room
+	EvictCapacity EvictReason = iota
+	// EvictIndexMemory is a key removed to keep the keyDir within
+	// WithMaxIndexMemory
+	EvictIndexMemory
+)
+
+// WithOnEvict calls fn with every key which the store removes by itself, unlike
+// the keys removed by Delete. It lets a cache clean up whatever it keeps outside
+// of the store for the key. fn is called after the store is unlocked, so it may
+// use the store.
+func WithOnEvict(fn func(key string, reason EvictReason)) Option {
+	return func(o *options) {
+		o.onEvict = fn
+	}
+}
+
+// WithPeriodicIndexFlush writes a copy of the keyDir to a hint file, with the
+// `.hint` suffix next to the data file, once every interval and on Close. The
+// next NewDiskStore loads the keyDir from the hint and only scans the records
+// written after it, instead of the whole file. The startup stays quick even after
+// a crash, since the hint is at most one interval old.
+//
+// The keyDir is copied under the read lock, and the hint is written to a
+// temporary file which then replaces the old hint, so a crash never leaves a torn
+// one. The hint remembers how far into the data file it goes, along with the
+// checksum of the bytes right before that point, and it is ignored when they do
+// not match the data file. Merge, ReplaceAll and InPlaceCompact remove the hint
+// before they change the file. A hint is ignored with WithInlineValues, which
+// needs the values of the records, and RebuildIndex always scans the whole file.
+func WithPeriodicIndexFlush(interval time.Duration) Option {
+	return func(o *options) {
+		o.indexFlush = interval
+	}
+}
+
+// WithFullHintChecksum makes the hint of WithPeriodicIndexFlush remember the
+// checksum of all the records it covers, rather than of the last 4KB only. Then
+// the hint is ignored when any of its records changed, say, when the file was
+// patched in place, and not just when its tail did. The cost is that the records
+// are read in full, under the read lock, every time the hint is written, and once
+// more when it is loaded, which still saves decoding them all.
+//
+// The store must be opened with the option every time. A hint written without it
+// does not match the file when loaded with it, and the other way round, so the
+// file is just scanned in full.
+func WithFullHintChecksum() Option {
+	return func(o *options) {
+		o.fullHintChecksum = true
+	}
+}
+
+// WithMaxStartupDuration makes NewDiskStore give up with ErrStartupTimeout, if
+// loading the file takes longer than max. Loading a huge file, or a file on a slow
+// disk, can block the start of a service for minutes, and it is better to fail
+// loudly than to hang. The time is checked every few thousand records, as per the
+// clock of the store, see WithClock.
+func WithMaxStartupDuration(max time.Duration) Option {
+	return func(o *options) {
+		o.maxStartup = max
+	}
+}
+
+// WithValueValidator runs validate on every key and value before they are
+// written, by Set, AppendRaw, Swap, Rename, Txn, BulkLoad and ReplaceAll. If it
+// returns an error, the write is rejected with it and neither the file nor keyDir
+// is touched, e.g. to make sure that only valid JSON ever makes it to the store:
+//
+//	store, _ := NewDiskStore("books.db", WithValueValidator(func(key, value string) error {
+//		if !json.Valid([]byte(value)) {
+//			return errors.New("not json")
+//		}
+//		return nil
+//	}))
+//
+// Set returns the error, as it does with any failed write. A rejected transaction
+// or bulk load writes nothing at all.
+// validate is called with the write lock held, so it must not use the store.
+func WithValueValidator(validate func(key, value string) error) Option {
+	return func(o *options) {
+		o.validator = validate
+	}
+}
+
+// WithScanReadAhead makes the scans read the file n bytes at a time, and serve
+// the records which follow from the bytes read already. The scans go through the
+// records in the order of their offsets, so a single read of a large window
+// replaces the one or two reads per record they do otherwise, which saves a lot
+// of syscalls over a file of small records. This applies to ScanSince,
+// ScanPhysical, Merge, InPlaceCompact and CheckConsistency, the reads of Get are
+// left as they are. Every scan has a window of its own, so n bytes are allocated
+// per running scan. A record larger than the window is read on its own. With
+// WithMmap, the records which are mapped already are read from the mapping as
+// usual.
+func WithScanReadAhead(n int) Option {
+	return func(o *options) {
+		o.scanReadAhead = n
+	}
+}
+
+// WithSortedCompaction makes Merge write the live records in the order of their
+// keys, rather than in the order they were written. Right after the merge, the
+// keys which sort next to each other sit next to each other in the file, so
+// reading a run of them, like ScanSince does in the order of the offsets, reads
+// the file mostly sequentially. The price is a sort of all the keys during every
+// Merge, and the new writes are appended at the end as usual, so the locality
+// fades till the next Merge. InPlaceCompact keeps the order of the file.
+//
+// The records of the merged file are no longer in the order of their timestamps,
+// so WithAppendOnlyVerify reports them as out of order.
+func WithSortedCompaction() Option {
+	return func(o *options) {
+		o.sortedCompaction = true
+	}
+}
+
+// IndexMemoryPolicy tells the store what to do when a new key would take the
+// keyDir over WithMaxIndexMemory.
+type IndexMemoryPolicy int
+
+const (
+	// IndexMemoryReject fails the write of the new key with ErrIndexMemory. The
+	// writes to the existing keys go through as usual. This is the default
+	IndexMemoryReject IndexMemoryPolicy = iota
+	// IndexMemoryEvictOldest deletes the keys with the oldest timestamps, i.e. the
+	// ones written the longest ago, to make room for the new key
+	IndexMemoryEvictOldest
+)
+
+// WithMaxIndexMemory caps the memory the keyDir takes at maxBytes, as estimated
+// by EstimatedMemoryUsage. Every key has to live in the memory, so a store with a
+// lot of keys needs a lot of RAM, and this lets it run within a fixed budget. When
+// a new key would go over the cap, the policy decides whether the write fails or
+// older keys make room for it.
+//
+// The evicted keys are deleted just like with Delete, tombstones included, so
+// they do not come back on the next start. They are evicted only once the new key
+// is written, so a write which fails evicts nothing. Finding the oldest keys
+// means going through the whole keyDir, so rather than evicting a single key
+// every time, the store evicts till the keyDir is down to 90% of the cap. See
+// WithOnEvict to be told about the evicted keys. The writes of Txn count too,
+// while BulkLoad and ReplaceAll do not, and neither does loading the file, so a
+// file which is too large already is loaded in full.
+func WithMaxIndexMemory(maxBytes int64, policy IndexMemoryPolicy) Option {
+	return func(o *options) {
+		o.maxIndexMemory = maxBytes
+		o.indexMemoryPolicy = policy
+	}
+}
+
+// TeePolicy tells the store what to do when the writer of WithWriteTee fails.
+type TeePolicy int
+
+const (
+	// TeeFailWrite fails the write, and the record is cut off the file again.
+	// This is the default
+	TeeFailWrite TeePolicy = iota
+	// TeeLogAndContinue logs the error and writes the record to the file anyway,
+	// so the copy misses the record
+	TeeLogAndContinue
+)
+
+// WithWriteTee writes a copy of every record which is appended to the data file
+// to w as well, byte for byte, padding included. w might be a connection to a
+// follower, or an audit log, so that a replica or a trail can be built without a
+// change feed: the bytes it gets are records of the current format, which can be
+// appended as they are to a file which starts with the same records.
+//
+// The record goes to w right after it is appended to the file, under the write
+// lock, so w sees the records in the order of the file, never gets a record which
+// failed to go to the file, and a slow w slows down all the writes. If w fails,
+// the policy decides whether the write fails. BulkLoad hands its records to w in
+// one go, once they are all in the file, and a failure of w fails the whole load.
+// Merge, InPlaceCompact and ReplaceAll rewrite the file rather than append to it,
+// so they are not copied to w, and a copy of the file has to be taken afresh after
+// them. The store never closes w.
+func WithWriteTee(w io.Writer, policy TeePolicy) Option {
+	return func(o *options) {
+		o.tee = w
+		o.teePolicy = policy
+	}
+}
+
+// WithStartupProgress calls fn every few thousand records while NewDiskStore loads
+// the file, to report how far it has got, just like MergeWithProgress does for
+// Merge. bytesScanned is how much of the file has been loaded and totalBytes is
+// its size, so a boot log can tell a slow start from a hung one. fn is called
+// once more with bytesScanned equal to totalBytes when the file is loaded. The
+// scans of RebuildIndex, and of Reopen when the file was replaced, report to fn
+// as well. A file loaded from the hint, see WithPeriodicIndexFlush, starts at
+// the offset the hint goes up to.
+func WithStartupProgress(fn func(bytesScanned, totalBytes int64)) Option {
+	return func(o *options) {
+		o.startupProgress = fn
+	}
+}
+
+// WithBaseOffset opens a store which is embedded in a larger file, starting at the
+// byte offset n. Everything before n belongs to someone else and is never read
+// or written, so a container file can keep its own header, or other datasets,
+// ahead of the store. The store takes the rest of the file, from n to the end:
+// the file header of the store is at n, the positions of the records are
+// relative to it, and the new records are appended at the end of the file as
+// usual. A file of exactly n bytes gets a new store.
+//
+// Merge, InPlaceCompact, PurgeKeys and ReplaceAll rewrite the whole file, which
+// would take the rest of the container with it, so they return ErrBaseOffset.
+// NewDiskStore fails if the option is combined with WithMmap, WithPreallocate,
+// WithPeriodicIndexFlush, WithReplicaMode or WithAtomicCreate, which all assume
+// the store has the file to itself.
+func WithBaseOffset(n int64) Option {
+	return func(o *options) {
+		o.baseOffset = n
+	}
+}
+
+// applyOptions returns the options as set by opts, for NewDiskStore to look at
+// before the store exists.
+func applyOptions(opts []Option) options {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// DuplicatePolicy tells BulkLoad what to do when fn emits the same key more than
+// once.
+type DuplicatePolicy int
+
+const (
+	// DuplicateLastWins keeps the last value emitted for the key, just like calling
+	// Set for each of them would. This is the default
+	DuplicateLastWins DuplicatePolicy = iota
+	// DuplicateFirstWins keeps the first value emitted for the key, and the later
+	// ones are not written at all
+	DuplicateFirstWins
+	// DuplicateFail fails the whole load with ErrDuplicateKey, which suits checking
+	// that an export has unique keys
+	DuplicateFail
+)
+
+// WithBulkLoadDuplicates sets what BulkLoad does with a key which fn emits more
+// than once. Only the keys emitted within the same load count as duplicates, a
+// key which is in the store already is overwritten as usual.
+func WithBulkLoadDuplicates(policy DuplicatePolicy) Option {
+	return func(o *options) {
+		o.bulkDuplicates = policy
+	}
+}
+
+// WithIORetry makes the reads and the writes of the records try again when they
+// fail with a transient error of the disk, EINTR, EAGAIN or EIO, up to attempts
+// times in total. The wait between the attempts starts at backoff and doubles
+// with every attempt. A write which fails half way goes on from where it stopped,
+// so a retry never writes the same bytes twice. The other errors, and the damaged
+// records, are returned right away.
+//
+// fsync is never retried: once it fails, the kernel may have dropped the dirty
+// pages already, and a second fsync would report success without them ever
+// getting to the disk.
+func WithIORetry(attempts int, backoff time.Duration) Option {
+	return func(o *options) {
+		o.ioRetryAttempts = attempts
+		o.ioRetryBackoff = backoff
+	}
+}
@@ -0,0 +1,109 @@
+package caskdb
+
+import (
+	"io"
+	"math"
+	"os"
+)
+
+// reader returns the descriptor the next read should go through, see
+// WithReaderPool. The offsets of its reads are relative to the base offset, see
+// WithBaseOffset. The caller must hold the lock.
+func (d *DiskStore) reader() io.ReaderAt {
+	file := d.file
+	if len(d.readers) > 0 {
+		file = d.readers[d.nextReader.Add(1)%uint32(len(d.readers))]
+	}
+	if d.opts.baseOffset > 0 {
+		return io.NewSectionReader(file, d.opts.baseOffset, math.MaxInt64-d.opts.baseOffset)
+	}
+	return file
+}
+
+// openReaders opens the pool of read only descriptors of the file, closing the
+// old ones first. If any of them fails to open, the store is left without a pool.
+// The caller must hold the write lock.
+func (d *DiskStore) openReaders() error {
+	if err := d.closeReaders(); err != nil {
+		return err
+	}
+	if d.opts.readerPool < 2 {
+		return nil
+	}
+	readers := make([]*os.File, 0, d.opts.readerPool)
+	for i := 0; i < d.opts.readerPool; i++ {
+		file, err := os.Open(d.fileName)
+		if err != nil {
+			for _, reader := range readers {
+				reader.Close()
+			}
+			return err
+		}
+		readers = append(readers, file)
+	}
+	d.readers = readers
+	return nil
+}
+
+// closeReaders closes the pool of read only descriptors. The caller must hold the
+// write lock.
+func (d *DiskStore) closeReaders() error {
+	var firstErr error
+	for _, reader := range d.readers {
+		if err := reader.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	d.readers = nil
+	return firstErr
+}
+
+// scanReader returns the reader a scan should go through, which reads ahead with
+// WithScanReadAhead. The scan must read the records in the order of their
+// offsets for the window to help. The caller must hold the lock for as long as
+// it uses the reader.
+func (d *DiskStore) scanReader() io.ReaderAt {
+	if d.opts.scanReadAhead <= 0 {
+		return d.reader()
+	}
+	return &readAhead{file: d.reader(), end: int64(d.writePosition), size: d.opts.scanReadAhead}
+}
+
+// readAhead reads the file a window at a time, see WithScanReadAhead.
+type readAhead struct {
+	file io.ReaderAt
+	// end is the end of the records, the window never goes past it
+	end int64
+	// size is the size of the window
+	size int
+	// window has the bytes of the file starting at the offset start
+	window []byte
+	start  int64
+}
+
+func (r *readAhead) ReadAt(p []byte, off int64) (int, error) {
+	if off >= r.start && off+int64(len(p)) <= r.start+int64(len(r.window)) {
+		return copy(p, r.window[off-r.start:]), nil
+	}
+	if len(p) >= r.size {
+		return r.file.ReadAt(p, off)
+	}
+	n := int64(r.size)
+	if off+n > r.end {
+		n = r.end - off
+	}
+	if n < int64(len(p)) {
+		// the read goes past the end of the records, which is up to the file to
+		// report
+		return r.file.ReadAt(p, off)
+	}
+	if r.window == nil {
+		r.window = make([]byte, r.size)
+	}
+	read, err := r.file.ReadAt(r.window[:n], off)
+	r.window, r.start = r.window[:read], off
+	if read < len(p) {
+		return copy(p, r.window), err
+	}
+	return copy(p, r.window), nil
+}
@@ -0,0 +1,86 @@
+package caskdb
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestDiskStore_ReaderPool(t *testing.T) {
+	store, err := NewDiskStore("test.db", WithReaderPool(4))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	if len(store.readers) != 4 {
+		t.Fatalf("readers = %v, want 4", len(store.readers))
+	}
+	for i := 0; i < 100; i++ {
+		store.Set(fmt.Sprint(i), fmt.Sprint(i*i))
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				if val, err := store.Get(fmt.Sprint(i)); val != fmt.Sprint(i*i) {
+					t.Errorf("Get() = (%v, %v), want %v", val, err, i*i)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// the pool follows the file to the merged one
+	store.Set("0", "zero")
+	if err := store.Merge(); err != nil {
+		t.Fatalf("Merge() error = %v", err)
+	}
+	if val, _ := store.Get("0"); val != "zero" {
+		t.Errorf("Get() after Merge() = %v, want %v", val, "zero")
+	}
+}
+
+func benchmarkParallelGet(b *testing.B, opts ...Option) {
+	store, err := NewDiskStore("bench.db")
+	if err != nil {
+		b.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("bench.db")
+	const numKeys = 10000
+	value := strings.Repeat("x", 256)
+	for i := 0; i < numKeys; i++ {
+		store.Set(fmt.Sprint(i), value)
+	}
+	store.Close()
+
+	store, err = NewDiskStore("bench.db", opts...)
+	if err != nil {
+		b.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	keys := rand.Perm(numKeys)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := rand.Intn(numKeys)
+		for pb.Next() {
+			store.Get(fmt.Sprint(keys[i%numKeys]))
+			i++
+		}
+	})
+}
+
+// run with -cpu to see how the reads scale with the cores, e.g. -cpu 1,4,16
+func BenchmarkDiskStore_ParallelGet(b *testing.B) {
+	for _, n := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("pool=%d", n), func(b *testing.B) {
+			benchmarkParallelGet(b, WithReaderPool(n))
+		})
+	}
+}
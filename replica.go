@@ -0,0 +1,167 @@
+package caskdb
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"time"
+)
+
+// Reopen catches up with the records which were appended to the file by another
+// process since the store was opened or last reopened. Only the new tail of the
+// file is read, so it is cheap to call often. If the file at the path was replaced
+// in the meantime, like Merge does, Reopen opens the new file and loads it from
+// scratch.
+//
+// This is meant for the replicas, see WithReplicaMode, which calls it
+// periodically.
+func (d *DiskStore) Reopen() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return ErrClosed
+	}
+
+	replaced, err := d.fileReplaced()
+	if err != nil {
+		return err
+	}
+	if replaced {
+		return d.reload()
+	}
+	info, err := d.file.Stat()
+	if err != nil {
+		return err
+	}
+	fileSize := info.Size()
+	if d.writePosition == 0 {
+		// the leader has not written the whole file header when we opened it
+		if fileSize < fileHeaderSize {
+			return nil
+		}
+		return d.initKeyDir()
+	}
+	if fileSize <= int64(d.writePosition) {
+		return nil
+	}
+	// the section starts at the writePosition, but the records are read till the
+	// fileSize, so both are in the offsets of the file
+	section := io.NewSectionReader(d.file, int64(d.writePosition), fileSize-int64(d.writePosition))
+	if err := d.loadRecords(bufio.NewReader(section), fileSize, nil); err != nil {
+		return err
+	}
+	d.maybeRemap()
+	return nil
+}
+
+// RebuildIndex throws away the keyDir and builds it again from the data file,
+// with the same scan which NewDiskStore runs. This is the way out when the keyDir
+// is suspected to disagree with the file, e.g. because of a bug, without closing
+// and reopening the store. It holds the write lock for the whole scan. If the scan
+// fails, the old keyDir is kept and the error is returned. Whatever the scan does
+// not load, as per WithCorruptionPolicy, is cut off the file.
+func (d *DiskStore) RebuildIndex() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return ErrClosed
+	}
+	if d.opts.noIndex {
+		return ErrNoIndex
+	}
+	keyDir, valueSizes, indexMemory, liveBytes, writePosition := d.keyDir, d.valueSizes, d.indexMemory, d.liveBytes, d.writePosition
+	d.keyDir = make(map[string]KeyEntry, d.opts.initialMapCapacity)
+	d.valueSizes = [valueSizeBuckets]int{}
+	d.indexMemory = 0
+	d.liveBytes = 0
+	d.writePosition = 0
+	// the hint is a copy of the keyDir we do not trust
+	if err := d.buildKeyDir(false); err != nil {
+		d.keyDir, d.valueSizes, d.indexMemory, d.liveBytes, d.writePosition = keyDir, valueSizes, indexMemory, liveBytes, writePosition
+		return err
+	}
+	if d.writePosition == 0 {
+		// the file is empty, but still has the file header
+		d.writePosition = writePosition
+	}
+	// the scan may have stopped before the end of the file, at a torn tail or at a
+	// corrupt record, see WithCorruptionPolicy. Just like NewDiskStore, we cut the
+	// rest off and move the cursor, or the new records would go after the garbage
+	if !d.opts.readOnly {
+		if err := d.rollback(); err != nil {
+			return err
+		}
+	}
+	if d.opts.mmap {
+		_ = d.remap()
+	}
+	return nil
+}
+
+// fileReplaced reports whether the path of the store now points at a different
+// file than the one we have open.
+func (d *DiskStore) fileReplaced() (bool, error) {
+	current, err := d.file.Stat()
+	if err != nil {
+		return false, err
+	}
+	info, err := os.Stat(d.fileName)
+	if err != nil {
+		// in the middle of a rename, we simply look again on the next poll
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return !os.SameFile(current, info), nil
+}
+
+// reload opens the file at the path again and builds the keyDir from it. The
+// caller must hold the write lock.
+func (d *DiskStore) reload() error {
+	file, err := os.OpenFile(d.fileName, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	if d.mmapped != nil {
+		if err := munmap(d.mmapped); err != nil {
+			file.Close()
+			return err
+		}
+		d.mmapped = nil
+	}
+	d.file.Close()
+	d.file = file
+	// without the pool, the reads simply go through the file
+	if err := d.openReaders(); err != nil {
+		d.logf("failed to open the reader pool: %v", err)
+	}
+	d.keyDir = make(map[string]KeyEntry, d.opts.initialMapCapacity)
+	d.valueSizes = [valueSizeBuckets]int{}
+	d.indexMemory = 0
+	d.liveBytes = 0
+	d.writePosition = 0
+	if err := d.initKeyDir(); err != nil {
+		return err
+	}
+	if d.opts.mmap {
+		_ = d.remap()
+	}
+	return nil
+}
+
+// replicaLoop calls Reopen every poll interval, till the store is closed.
+func (d *DiskStore) replicaLoop(done <-chan struct{}) {
+	ticker := time.NewTicker(d.opts.replicaPoll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := d.Reopen(); err != nil {
+				d.logf("failed to catch up with %s: %v", d.fileName, err)
+			}
+		}
+	}
+}
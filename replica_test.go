@@ -0,0 +1,161 @@
+package caskdb
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDiskStore_ReplicaMode(t *testing.T) {
+	leader, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer leader.Close()
+	leader.Set("othello", "shakespeare")
+
+	replica, err := NewDiskStore("test.db", WithReplicaMode(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("failed to create the replica: %v", err)
+	}
+	defer replica.Close()
+	if val, _ := replica.Get("othello"); val != "shakespeare" {
+		t.Errorf("Get() = %v, want %v", val, "shakespeare")
+	}
+	if err := replica.Delete("othello"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Delete() error = %v, want %v", err, ErrReadOnly)
+	}
+
+	leader.Set("dune", "frank herbert")
+	leader.Delete("othello")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		val, _ := replica.Get("dune")
+		_, err := replica.Get("othello")
+		if val == "frank herbert" && errors.Is(err, ErrKeyNotFound) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the replica did not catch up, Get() = %v, %v", val, err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// the replica follows the leader to the new file
+	leader.Set("dune", "herbert")
+	if err := leader.Merge(); err != nil {
+		t.Fatalf("Merge() error = %v", err)
+	}
+	if err := replica.Reopen(); err != nil {
+		t.Fatalf("Reopen() error = %v", err)
+	}
+	if val, _ := replica.Get("dune"); val != "herbert" {
+		t.Errorf("Get() after Merge() = %v, want %v", val, "herbert")
+	}
+}
+
+func TestDiskStore_ReopenTornTail(t *testing.T) {
+	leader, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	leader.Close()
+
+	// an hour long poll, so that only our Reopen calls catch up
+	replica, err := NewDiskStore("test.db", WithReplicaMode(time.Hour))
+	if err != nil {
+		t.Fatalf("failed to create the replica: %v", err)
+	}
+	defer replica.Close()
+
+	// the leader is in the middle of writing the record
+	_, record := encodeKV(time.Now().UnixNano(), "othello", "shakespeare")
+	file, err := os.OpenFile("test.db", os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("failed to open the file: %v", err)
+	}
+	defer file.Close()
+	file.Write(record[:20])
+	if err := replica.Reopen(); err != nil {
+		t.Fatalf("Reopen() error = %v", err)
+	}
+	if _, err := replica.Get("othello"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Get() error = %v, want %v", err, ErrKeyNotFound)
+	}
+	file.Write(record[20:])
+	if err := replica.Reopen(); err != nil {
+		t.Fatalf("Reopen() error = %v", err)
+	}
+	if val, _ := replica.Get("othello"); val != "shakespeare" {
+		t.Errorf("Get() = %v, want %v", val, "shakespeare")
+	}
+}
+
+func TestDiskStore_RebuildIndexCorruptRecord(t *testing.T) {
+	store, err := NewDiskStore("test.db", WithVerifyOnStartup(), WithCorruptionPolicy(CorruptionTruncateTail))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	store.Set("othello", "shakespeare")
+	store.Set("dune", "frank herbert")
+	store.Set("hamlet", "shakespeare")
+	// flip a byte in the value of the record in the middle
+	file, err := os.OpenFile("test.db", os.O_WRONLY, 0666)
+	if err != nil {
+		t.Fatalf("failed to open the file: %v", err)
+	}
+	offset := int64(store.keyDir["dune"].position) + headerSize + int64(len("dune"))
+	if _, err := file.WriteAt([]byte{'F'}, offset); err != nil {
+		t.Fatalf("failed to write the file: %v", err)
+	}
+	file.Close()
+
+	if err := store.RebuildIndex(); err != nil {
+		t.Fatalf("RebuildIndex() error = %v", err)
+	}
+	// the write after the rebuild goes where the corrupt record was, and reads back
+	if err := store.Set("macbeth", "shakespeare"); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	tests := map[string]string{"othello": "shakespeare", "dune": "", "hamlet": "", "macbeth": "shakespeare"}
+	for key, val := range tests {
+		if got, _ := store.Get(key); got != val {
+			t.Errorf("Get(%q) = %v, want %v", key, got, val)
+		}
+	}
+}
+
+func TestDiskStore_RebuildIndex(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	store.Set("othello", "shakespeare")
+	store.Set("dune", "frank herbert")
+	want := store.keyDir["dune"]
+	// a bug messed up the index
+	store.keyDir["dune"] = store.keyDir["othello"]
+	delete(store.keyDir, "othello")
+	store.keyDir["hamlet"] = want
+	if err := store.RebuildIndex(); err != nil {
+		t.Fatalf("RebuildIndex() error = %v", err)
+	}
+	tests := map[string]string{"othello": "shakespeare", "dune": "frank herbert", "hamlet": ""}
+	for key, val := range tests {
+		if got, _ := store.Get(key); got != val {
+			t.Errorf("Get() = %v, want %v", got, val)
+		}
+	}
+	if stats := store.Stats(); stats.Keys != 2 {
+		t.Errorf("Stats().Keys = %v, want 2", stats.Keys)
+	}
+}
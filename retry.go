@@ -0,0 +1,30 @@
+package caskdb
+
+import (
+	"errors"
+	"syscall"
+	"time"
+)
+
+// retryIO runs op, the read or the write of the file, and runs it again while it
+// fails with a transient error, up to the attempts of WithIORetry. The wait
+// between the attempts starts at the backoff and doubles every time. The caller
+// holds the lock all along, so the ones waiting for it wait for the retries too.
+func (d *DiskStore) retryIO(op func() error) error {
+	backoff := d.opts.ioRetryBackoff
+	err := op()
+	for attempt := 1; attempt < d.opts.ioRetryAttempts && retryable(err); attempt++ {
+		d.logf("retrying after a transient error of the disk: %v", err)
+		time.Sleep(backoff)
+		backoff *= 2
+		err = op()
+	}
+	return err
+}
+
+// retryable reports whether the error of the disk might go away when the read or
+// the write is tried again. io.EOF, and the errors of the store itself, like
+// ErrCorruptRecord, never do.
+func retryable(err error) bool {
+	return errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EIO)
+}
@@ -0,0 +1,71 @@
+package caskdb
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// flakyReader fails the first reads with the error, and then reads from the file.
+type flakyReader struct {
+	r     io.ReaderAt
+	fails int
+	err   error
+}
+
+func (f *flakyReader) ReadAt(p []byte, off int64) (int, error) {
+	if f.fails > 0 {
+		f.fails--
+		return 0, &os.PathError{Op: "read", Path: "test.db", Err: f.err}
+	}
+	return f.r.ReadAt(p, off)
+}
+
+func TestDiskStore_IORetry(t *testing.T) {
+	store, err := NewDiskStore("test.db", WithIORetry(3, time.Millisecond))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+	store.Set("othello", "shakespeare")
+	kEntry := store.keyDir["othello"]
+
+	tests := []struct {
+		name    string
+		fails   int
+		err     error
+		wantErr bool
+	}{
+		{"transient", 2, syscall.EIO, false},
+		{"too many attempts", 3, syscall.EIO, true},
+		{"not retryable", 1, syscall.ENOENT, true},
+	}
+	for _, tt := range tests {
+		r := &flakyReader{r: store.reader(), fails: tt.fails, err: tt.err}
+		if _, err := store.readEntryFrom(r, "othello", kEntry); (err != nil) != tt.wantErr {
+			t.Errorf("%s: readEntryFrom() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func Test_retryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&os.PathError{Op: "write", Path: "test.db", Err: syscall.EINTR}, true},
+		{syscall.EAGAIN, true},
+		{io.EOF, false},
+		{ErrCorruptRecord, false},
+		{ErrKeyNotFound, false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		if got := retryable(tt.err); got != tt.want {
+			t.Errorf("retryable(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package caskdb
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// ScanSince calls fn for every key which was written after t, along with its
+// value, till fn returns false. The keyDir keeps the timestamp of the latest write
+// of every key, so the keys which did not change are skipped without touching the
+// disk. This makes incremental backups cheap, e.g. everything which changed in
+// the last hour:
+//
+//	err := store.ScanSince(time.Now().Add(-time.Hour), func(key, value string) bool {
+//		backup.Set(key, value)
+//		return true
+//	})
+//
+// An overwrite updates the timestamp of the key, so a key shows up with its latest
+// value, however many times it was written since t. The deleted and the expired
+// keys do not show up at all. A write at exactly t is not visited. The keys are
+// visited in the order they are laid out in the file, so the disk is read
+// sequentially. ScanSince holds the read lock, so fn must not write to the store.
+func (d *DiskStore) ScanSince(t time.Time, fn func(key, value string) bool) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return ErrClosed
+	}
+	if d.opts.noIndex {
+		return ErrNoIndex
+	}
+	since := t.UnixNano()
+	now := d.now().UnixNano()
+	var keys []string
+	for key, kEntry := range d.keyDir {
+		if kEntry.timestamp > since && !kEntry.expired(now) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return d.keyDir[keys[i]].position < d.keyDir[keys[j]].position })
+	file := d.scanReader()
+	for _, key := range keys {
+		value, err := d.readValueFrom(file, key, d.keyDir[key])
+		if err != nil {
+			return err
+		}
+		if !fn(key, value) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// errStopScan stops forEachRecord when the callback of ScanPhysical is done.
+var errStopScan = errors.New("caskdb: scan stopped")
+
+// ScanPhysical calls fn for every record in the file, in the order they were
+// written, till fn returns false. Unlike ScanSince, which sees only the latest
+// value of every key, this is the raw log: the overwritten values and the
+// tombstones show up as well, each with its offset in the file, decoded into a
+// Record just like ReadRecordAt does. The writes of a transaction show up one by
+// one. Every record is read and its checksum verified, so this takes as long as
+// reading the whole file. ScanPhysical holds the read lock, so fn must not write
+// to the store.
+func (d *DiskStore) ScanPhysical(fn func(r Record, offset int64) bool) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return ErrClosed
+	}
+	err := d.forEachRecord(func(data []byte, offset int64) error {
+		r, err := decodeRecord(data)
+		if err != nil {
+			return err
+		}
+		if !fn(r, offset) {
+			return errStopScan
+		}
+		return nil
+	})
+	if err == errStopScan {
+		return nil
+	}
+	return err
+}
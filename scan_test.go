@@ -0,0 +1,164 @@
+package caskdb
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiskStore_ScanSince(t *testing.T) {
+	now := time.Unix(1000, 0)
+	store, err := NewDiskStore("test.db", WithClock(func() time.Time { return now }))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	store.Set("othello", "marlowe")
+	store.Set("anna karenina", "tolstoy")
+	since := now
+	now = now.Add(time.Minute)
+	store.Set("dune", "frank herbert")
+	store.Set("othello", "shakespeare")
+	// expired by the time of the scan
+	store.SetWithExpiry("hamlet", "shakespeare", now.Add(time.Second))
+	now = now.Add(time.Minute)
+
+	var got []string
+	err = store.ScanSince(since, func(key, value string) bool {
+		got = append(got, key+"="+value)
+		return true
+	})
+	if err != nil {
+		t.Fatalf("ScanSince() error = %v", err)
+	}
+	want := []string{"dune=frank herbert", "othello=shakespeare"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("ScanSince() visited %v, want %v", got, want)
+	}
+
+	// returning false stops the scan
+	got = nil
+	store.ScanSince(since, func(key, value string) bool {
+		got = append(got, key)
+		return false
+	})
+	if len(got) != 1 {
+		t.Errorf("ScanSince() visited %v after fn returned false", got)
+	}
+}
+
+func TestDiskStore_ScanPhysical(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	store.Set("othello", "marlowe")
+	store.Txn(func(tx *Txn) error {
+		tx.Set("dune", "frank herbert")
+		tx.Set("othello", "shakespeare")
+		return nil
+	})
+	store.Delete("dune")
+
+	var got []string
+	var first int64
+	err = store.ScanPhysical(func(r Record, offset int64) bool {
+		if len(got) == 0 {
+			first = offset
+		}
+		got = append(got, fmt.Sprintf("%s=%s %v", r.Key, r.Value, r.Tombstone))
+		return true
+	})
+	if err != nil {
+		t.Fatalf("ScanPhysical() error = %v", err)
+	}
+	want := []string{"othello=marlowe false", "dune=frank herbert false", "othello=shakespeare false", "dune= true"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("ScanPhysical() visited %v, want %v", got, want)
+	}
+	if first != fileHeaderSize {
+		t.Errorf("ScanPhysical() first offset = %v, want %v", first, fileHeaderSize)
+	}
+
+	visited := 0
+	store.ScanPhysical(func(r Record, offset int64) bool {
+		visited++
+		return false
+	})
+	if visited != 1 {
+		t.Errorf("ScanPhysical() visited %v records after fn returned false, want 1", visited)
+	}
+}
+
+func TestDiskStore_ScanReadAhead(t *testing.T) {
+	store, err := NewDiskStore("test.db", WithScanReadAhead(64))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	// the window holds a couple of the small records, but not the large one
+	want := map[string]string{}
+	for i := 0; i < 20; i++ {
+		want[fmt.Sprint(i)] = fmt.Sprint("value", i)
+	}
+	want["large"] = strings.Repeat("x", 100)
+	for i := 0; i < 20; i++ {
+		store.Set(fmt.Sprint(i), want[fmt.Sprint(i)])
+		if i == 10 {
+			store.Set("large", want["large"])
+		}
+	}
+	got := map[string]string{}
+	err = store.ScanSince(time.Time{}, func(key, value string) bool {
+		got[key] = value
+		return true
+	})
+	if err != nil {
+		t.Fatalf("ScanSince() error = %v", err)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("ScanSince() visited %v, want %v", got, want)
+	}
+	if err := store.Merge(); err != nil {
+		t.Fatalf("Merge() error = %v", err)
+	}
+	if got, _ := store.Get("large"); got != want["large"] {
+		t.Errorf("Get() = %v, want %v", got, want["large"])
+	}
+}
+
+func benchmarkScan(b *testing.B, opts ...Option) {
+	store, err := NewDiskStore("bench.db", opts...)
+	if err != nil {
+		b.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("bench.db")
+	defer store.Close()
+	value := strings.Repeat("x", 64)
+	for i := 0; i < 10000; i++ {
+		store.Set(fmt.Sprint(i), value)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		store.ScanPhysical(func(r Record, offset int64) bool {
+			return true
+		})
+	}
+}
+
+func BenchmarkDiskStore_Scan(b *testing.B) {
+	benchmarkScan(b)
+}
+
+func BenchmarkDiskStore_ScanReadAhead(b *testing.B) {
+	benchmarkScan(b, WithScanReadAhead(64*1024))
+}
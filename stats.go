@@ -0,0 +1,138 @@
+package caskdb
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"unsafe"
+)
+
+// keyEntryOverhead is the memory taken by a single keyDir entry, apart from the
+// bytes of the key itself: the string header of the key and the KeyEntry.
+const keyEntryOverhead = int64(unsafe.Sizeof("")) + int64(unsafe.Sizeof(KeyEntry{}))
+
+// mapOverheadFactor accounts for the bookkeeping of the Go map and the slots it
+// keeps empty. A map grows once its buckets are ~80% full, so on average a good
+// chunk of the allocated slots is unused.
+const mapOverheadFactor = 1.5
+
+// valueSizeBuckets is the number of buckets in the value size histogram.
+const valueSizeBuckets = 5
+
+// valueSizeBounds are the upper bounds of the buckets of the value size histogram,
+// the last bucket has all the values from 256KB on.
+var valueSizeBounds = [valueSizeBuckets - 1]int{128, 1 << 10, 16 << 10, 256 << 10}
+
+// Stats describes the data in the store at some point in time.
+type Stats struct {
+	// Name is the name of the store, see WithName
+	Name string
+	// Keys is the number of live keys
+	Keys int
+	// FileSize is the size of the data file in bytes, stale records included
+	FileSize int64
+	// ValueSizes is a coarse histogram of the sizes of the live values. The
+	// buckets count the values under 128B, 1KB, 16KB and 256KB, and the last one
+	// counts the values of 256KB or more. It tells whether the values are small
+	// enough that compression would not pay off, or whether a few huge values
+	// take most of the file
+	ValueSizes [valueSizeBuckets]int
+	// OutOfOrder is the number of records whose timestamp went back while the file
+	// was loaded, see WithAppendOnlyVerify
+	OutOfOrder int
+}
+
+// Stats returns the stats of the store. The histogram is built while loading the
+// file and kept up to date with every write, so this is cheap to call.
+func (d *DiskStore) Stats() Stats {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return Stats{
+		Name:       d.opts.name,
+		Keys:       len(d.keyDir),
+		FileSize:   int64(d.writePosition),
+		ValueSizes: d.valueSizes,
+		OutOfOrder: d.outOfOrder,
+	}
+}
+
+// valueSizeBucket returns the bucket of the histogram for the value of the key
+// which kEntry points at.
+func valueSizeBucket(key string, kEntry KeyEntry) int {
+	size := int(kEntry.totalSize) - headerSize - len(key)
+	for i, bound := range valueSizeBounds {
+		if size < bound {
+			return i
+		}
+	}
+	return len(valueSizeBounds)
+}
+
+// WriteAmplification returns the ratio of the bytes written to the file to the
+// bytes of the live records, the ones keyDir points at. Every overwrite and every
+// tombstone is written but not live, and every Merge writes the live records once
+// more, so the higher the ratio, the more the disk works for every byte which is
+// kept. For a workload which mostly overwrites, it tells whether the writes have
+// to change, or the merges have to run less often.
+//
+// The file as it was when the store was opened counts as written, then everything
+// written since, the file header, the padding, Merge, ReplaceAll and
+// InPlaceCompact included. The totals start over with every NewDiskStore. It is 0
+// when there are no live records.
+func (d *DiskStore) WriteAmplification() float64 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.liveBytes == 0 {
+		return 0
+	}
+	return float64(d.bytesWritten) / float64(d.liveBytes)
+}
+
+// EstimatedMemoryUsage returns a rough estimate of the bytes the keyDir takes in
+// the memory. Since every key has to live in the memory, this is the main cost of
+// a large database. The number is not exact, it is meant for planning how much
+// RAM a host needs.
+func (d *DiskStore) EstimatedMemoryUsage() int64 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	var keyBytes int64
+	for key, kEntry := range d.keyDir {
+		// the inline values, see WithInlineValues, live in the memory too
+		keyBytes += int64(len(key)) + int64(len(kEntry.value))
+	}
+	return keyBytes + int64(float64(int64(len(d.keyDir))*keyEntryOverhead)*mapOverheadFactor)
+}
+
+// entryMemory is the share of EstimatedMemoryUsage of a single keyDir entry.
+func entryMemory(key string, kEntry KeyEntry) int64 {
+	return int64(len(key)) + int64(len(kEntry.value)) + int64(float64(keyEntryOverhead)*mapOverheadFactor)
+}
+
+// DumpIndex writes every entry of the keyDir to w, one per line, in the order of
+// their positions in the file:
+//
+//	key="othello" position=8 size=39 timestamp=1665000000000000000
+//
+// This is meant for debugging. When Get returns the wrong data, comparing the
+// index with the records at the same positions, e.g. with ReadRecordAt, tells
+// whether the index or the file is wrong. DumpIndex holds the read lock while it
+// writes, so w should not block for long.
+func (d *DiskStore) DumpIndex(w io.Writer) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return ErrClosed
+	}
+	keys := make([]string, 0, len(d.keyDir))
+	for key := range d.keyDir {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return d.keyDir[keys[i]].position < d.keyDir[keys[j]].position })
+	for _, key := range keys {
+		kEntry := d.keyDir[key]
+		if _, err := fmt.Fprintf(w, "key=%q position=%d size=%d timestamp=%d\n", key, kEntry.position, kEntry.totalSize, kEntry.timestamp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package caskdb
+
+import (
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiskStore_EstimatedMemoryUsage(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	if usage := store.EstimatedMemoryUsage(); usage != 0 {
+		t.Errorf("EstimatedMemoryUsage() = %v, want 0", usage)
+	}
+	store.Set("othello", "shakespeare")
+	store.Set("anna karenina", "tolstoy")
+	usage := store.EstimatedMemoryUsage()
+	if min := int64(len("othello") + len("anna karenina")); usage <= min {
+		t.Errorf("EstimatedMemoryUsage() = %v, want more than the key bytes %v", usage, min)
+	}
+	// the values are on the disk, they do not count
+	store.Set("othello", "a much longer value than shakespeare")
+	if got := store.EstimatedMemoryUsage(); got != usage {
+		t.Errorf("EstimatedMemoryUsage() = %v, want %v", got, usage)
+	}
+}
+
+func TestDiskStore_Stats(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+
+	store.Set("othello", "shakespeare")
+	store.Set("dune", strings.Repeat("a", 2000))
+	store.Set("hamlet", strings.Repeat("b", 300*1024))
+	store.Set("hamlet", "shakespeare")
+	store.Set("anna karenina", "tolstoy")
+	store.Delete("anna karenina")
+	want := Stats{Name: "test.db", Keys: 3, FileSize: int64(store.writePosition), ValueSizes: [valueSizeBuckets]int{2, 0, 1, 0, 0}}
+	if got := store.Stats(); got != want {
+		t.Errorf("Stats() = %v, want %v", got, want)
+	}
+	store.Close()
+
+	// the startup builds the same histogram from the file
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	if got := store.Stats(); got != want {
+		t.Errorf("Stats() after reopening = %v, want %v", got, want)
+	}
+}
+
+func TestDiskStore_DumpIndex(t *testing.T) {
+	now := time.Unix(1000, 0)
+	store, err := NewDiskStore("test.db", WithClock(func() time.Time { return now }))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	store.Set("othello", "marlowe")
+	store.Set("dune", "frank herbert")
+	store.Set("othello", "shakespeare")
+	var buf strings.Builder
+	if err := store.DumpIndex(&buf); err != nil {
+		t.Fatalf("DumpIndex() error = %v", err)
+	}
+	want := `key="dune" position=43 size=38 timestamp=1000000000000
+key="othello" position=81 size=39 timestamp=1000000000000
+`
+	if buf.String() != want {
+		t.Errorf("DumpIndex() = %q, want %q", buf.String(), want)
+	}
+}
+
+func TestDiskStore_WithName(t *testing.T) {
+	store, err := NewDiskStore("test.db", WithName("books"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	if name := store.Stats().Name; name != "books" {
+		t.Errorf("Stats().Name = %v, want %v", name, "books")
+	}
+	var buf strings.Builder
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	store.logf("hello %s", "world")
+	if !strings.Contains(buf.String(), "caskdb[books]: hello world") {
+		t.Errorf("logf() wrote %q, want it prefixed with the name", buf.String())
+	}
+}
+
+func TestDiskStore_WriteAmplification(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	if got := store.WriteAmplification(); got != 0 {
+		t.Errorf("WriteAmplification() of an empty store = %v, want 0", got)
+	}
+	for i := 0; i < 10; i++ {
+		store.Set("othello", "shakespeare")
+	}
+	// the file header and nine overwritten records on top of the live one
+	record := float64(store.keyDir["othello"].totalSize)
+	written := float64(fileHeaderSize) + 10*record
+	want := written / record
+	if got := store.WriteAmplification(); got != want {
+		t.Errorf("WriteAmplification() = %v, want %v", got, want)
+	}
+	if err := store.Merge(); err != nil {
+		t.Fatalf("Merge() error = %v", err)
+	}
+	// the merge writes the header and the live record once more
+	want = (written + float64(fileHeaderSize) + record) / record
+	if got := store.WriteAmplification(); got != want {
+		t.Errorf("WriteAmplification() after Merge() = %v, want %v", got, want)
+	}
+}
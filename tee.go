@@ -0,0 +1,25 @@
+package caskdb
+
+import "fmt"
+
+// tee writes the record, which has just been appended to the file, to the writer
+// of WithWriteTee. The caller must hold the write lock.
+func (d *DiskStore) tee(data []byte) error {
+	if d.opts.tee == nil {
+		return nil
+	}
+	_, err := d.opts.tee.Write(data)
+	return d.teeFailed(err)
+}
+
+// teeFailed handles the error of the writer of WithWriteTee as per its policy.
+func (d *DiskStore) teeFailed(err error) error {
+	if err == nil {
+		return nil
+	}
+	if d.opts.teePolicy == TeeLogAndContinue {
+		d.logf("failed to write to the tee: %v", err)
+		return nil
+	}
+	return fmt.Errorf("caskdb: failed to write to the tee: %w", err)
+}
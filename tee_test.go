@@ -0,0 +1,97 @@
+package caskdb
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+)
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestDiskStore_WriteTee(t *testing.T) {
+	var tee bytes.Buffer
+	store, err := NewDiskStore("test.db", WithWriteTee(&tee, TeeFailWrite))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	store.Set("othello", "shakespeare")
+	store.Delete("othello")
+	store.Txn(func(tx *Txn) error {
+		tx.Set("dune", "frank herbert")
+		return nil
+	})
+	store.BulkLoad(func(emit func(key, value string)) error {
+		emit("anna karenina", "tolstoy")
+		return nil
+	})
+	store.Close()
+
+	// the tee has every record of the file, byte for byte
+	data, err := os.ReadFile("test.db")
+	if err != nil {
+		t.Fatalf("failed to read the file: %v", err)
+	}
+	if !bytes.Equal(data[fileHeaderSize:], tee.Bytes()) {
+		t.Errorf("the tee got %d bytes, want the %d bytes of the records", tee.Len(), len(data)-fileHeaderSize)
+	}
+}
+
+func TestDiskStore_WriteTeeFailedAppend(t *testing.T) {
+	var tee bytes.Buffer
+	store, err := NewDiskStore("test.db", WithWriteTee(&tee, TeeFailWrite))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+	store.Set("othello", "shakespeare")
+	sent := tee.Len()
+
+	// a record which does not make it to the file does not reach the tee either
+	store.writeHook = func(p []byte) (int, error) {
+		return 0, errors.New("write failed")
+	}
+	if err := store.Set("dune", "frank herbert"); err == nil {
+		t.Errorf("Set() with a failing write did not fail")
+	}
+	if tee.Len() != sent {
+		t.Errorf("the tee got %d bytes of the failed write", tee.Len()-sent)
+	}
+}
+
+func TestDiskStore_WriteTeePolicy(t *testing.T) {
+	store, err := NewDiskStore("test.db", WithWriteTee(failingWriter{}, TeeFailWrite))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	if _, err := store.AppendRaw("othello", "shakespeare"); err == nil {
+		t.Errorf("AppendRaw() with a failing tee did not fail")
+	}
+	if _, err := store.Get("othello"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Get() error = %v, want %v", err, ErrKeyNotFound)
+	}
+	// the record is cut off the file again
+	if got := fileSize(t, "test.db"); got != fileHeaderSize {
+		t.Errorf("file size after the failed write = %d, want %d", got, fileHeaderSize)
+	}
+	store.Close()
+
+	store, err = NewDiskStore("test.db", WithWriteTee(failingWriter{}, TeeLogAndContinue))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	if _, err := store.AppendRaw("othello", "shakespeare"); err != nil {
+		t.Errorf("AppendRaw() error = %v", err)
+	}
+	if got, _ := store.Get("othello"); got != "shakespeare" {
+		t.Errorf("Get() = %v, want shakespeare", got)
+	}
+}
@@ -0,0 +1,157 @@
+package caskdb
+
+// Txn is a transaction, which buffers the writes till it is committed. See
+// DiskStore.Txn.
+type Txn struct {
+	d *DiskStore
+	// writes has the latest write of every key in the transaction, a nil value is
+	// a delete
+	writes map[string]*string
+	// order is the order in which the keys were first written
+	order []string
+}
+
+// Txn runs fn in a transaction. Within fn, tx.Get sees the writes done by tx.Set
+// and tx.Delete before it, while the store is left untouched. Once fn returns nil,
+// all the writes are committed at once: they are written to the file as a single
+// record, with a single fsync, so even a crash never leaves some of them behind
+// without the rest. If fn returns an error, nothing is written and the error is
+// returned.
+//
+// Txn holds the write lock while fn runs, so the reads and the writes of the
+// transaction are never interleaved with the other writers. fn must be quick, and
+// must not call the methods of the store itself, or it deadlocks.
+//
+//	err := store.Txn(func(tx *Txn) error {
+//		stock, err := tx.Get("stock")
+//		if err != nil {
+//			return err
+//		}
+//		if stock == "0" {
+//			return errors.New("out of stock")
+//		}
+//		tx.Set("stock", "0")
+//		tx.Set("order", "dune")
+//		return nil
+//	})
+func (d *DiskStore) Txn(fn func(tx *Txn) error) error {
+	d.mu.Lock()
+	defer d.unlockAndNotify()
+	if d.closed {
+		return ErrClosed
+	}
+	if d.opts.readOnly {
+		return ErrReadOnly
+	}
+	tx := &Txn{d: d, writes: make(map[string]*string)}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.commit()
+}
+
+// Get returns the value of the key as of the transaction, i.e. the value which it
+// last set, or the one in the store if the transaction did not write the key.
+func (tx *Txn) Get(key string) (string, error) {
+	if value, ok := tx.writes[key]; ok {
+		if value == nil {
+			return "", ErrKeyNotFound
+		}
+		return *value, nil
+	}
+	if tx.d.opts.noIndex {
+		return "", ErrNoIndex
+	}
+	kEntry, ok := tx.d.lookup(key)
+	if !ok {
+		return "", ErrKeyNotFound
+	}
+	return tx.d.readValue(key, kEntry)
+}
+
+// Set stores the value for the key once the transaction is committed.
+func (tx *Txn) Set(key string, value string) {
+	tx.write(key, &value)
+}
+
+// Delete removes the key once the transaction is committed.
+func (tx *Txn) Delete(key string) {
+	tx.write(key, nil)
+}
+
+func (tx *Txn) write(key string, value *string) {
+	if _, ok := tx.writes[key]; !ok {
+		tx.order = append(tx.order, key)
+	}
+	tx.writes[key] = value
+}
+
+// commit writes the batch record of the transaction and applies it to keyDir. The
+// caller must hold the write lock.
+func (tx *Txn) commit() error {
+	d := tx.d
+	timestamp := d.now().UnixNano()
+	var batch []byte
+	var keys []string
+	var offsets []int
+	// newKeys is by how much the transaction grows the number of keys, and
+	// newMemory the memory the new ones take in keyDir
+	newKeys := 0
+	var newMemory int64
+	for _, key := range tx.order {
+		value := tx.writes[key]
+		_, exists := d.keyDir[key]
+		switch {
+		case value == nil && exists:
+			newKeys--
+		case value != nil && !exists:
+			newKeys++
+			newMemory += entryMemory(key, d.newKeyEntry(0, 0, 0, *value))
+		}
+		var data []byte
+		if value == nil {
+			// just like Delete, there is nothing to do for a key which is not there
+			if !exists && !d.opts.noIndex {
+				continue
+			}
+			_, data = encodeTombstone(timestamp, key)
+		} else {
+			if err := d.validate(key, *value); err != nil {
+				return err
+			}
+			_, data = encodeKV(timestamp, key, *value)
+		}
+		keys = append(keys, key)
+		offsets = append(offsets, len(batch))
+		batch = append(batch, data...)
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	if err := d.checkRecordLimit(newKeys); err != nil {
+		return err
+	}
+	evict, err := d.checkIndexRoom(newMemory)
+	if err != nil {
+		return err
+	}
+	_, data := encodeRecord(timestamp, "", string(batch), flagBatch)
+	data = d.align(data)
+	if err := d.write(data); err != nil {
+		return err
+	}
+	start := d.writePosition + headerSize
+	for i, key := range keys {
+		if value := tx.writes[key]; value == nil {
+			d.removeKey(key)
+		} else {
+			d.putKey(key, d.newKeyEntry(timestamp, start+offsets[i], headerSize+len(key)+len(*value), *value))
+		}
+	}
+	d.writePosition += len(data)
+	d.maybeRemap()
+	if evict {
+		d.makeIndexRoom(newMemory, keys...)
+	}
+	return nil
+}
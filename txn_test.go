@@ -0,0 +1,120 @@
+package caskdb
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestDiskStore_Txn(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+
+	store.Set("othello", "marlowe")
+	store.Set("dune", "frank herbert")
+	err = store.Txn(func(tx *Txn) error {
+		author, err := tx.Get("othello")
+		if err != nil {
+			return err
+		}
+		if author != "marlowe" {
+			t.Errorf("tx.Get() = %v, want %v", author, "marlowe")
+		}
+		tx.Set("othello", "shakespeare")
+		tx.Delete("dune")
+		tx.Set("hamlet", "shakespeare")
+		if author, _ := tx.Get("othello"); author != "shakespeare" {
+			t.Errorf("tx.Get() after tx.Set() = %v, want %v", author, "shakespeare")
+		}
+		if _, err := tx.Get("dune"); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("tx.Get() after tx.Delete() error = %v, want %v", err, ErrKeyNotFound)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Txn() error = %v", err)
+	}
+
+	// a failed transaction writes nothing
+	size := fileSize(t, "test.db")
+	errAbort := errors.New("abort")
+	err = store.Txn(func(tx *Txn) error {
+		tx.Set("othello", "bacon")
+		return errAbort
+	})
+	if err != errAbort {
+		t.Errorf("Txn() error = %v, want %v", err, errAbort)
+	}
+	if got := fileSize(t, "test.db"); got != size {
+		t.Errorf("file size after a failed Txn() = %v, want %v", got, size)
+	}
+
+	tests := map[string]string{"othello": "shakespeare", "hamlet": "shakespeare", "dune": ""}
+	for key, val := range tests {
+		if got, _ := store.Get(key); got != val {
+			t.Errorf("Get() = %v, want %v", got, val)
+		}
+	}
+	store.Close()
+
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	for key, val := range tests {
+		if got, _ := store.Get(key); got != val {
+			t.Errorf("Get() after reopening = %v, want %v", got, val)
+		}
+	}
+	// Merge copies the records out of the batch
+	if err := store.Merge(); err != nil {
+		t.Fatalf("Merge() error = %v", err)
+	}
+	store.Close()
+
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	for key, val := range tests {
+		if got, _ := store.Get(key); got != val {
+			t.Errorf("Get() after Merge() = %v, want %v", got, val)
+		}
+	}
+}
+
+func TestDiskStore_TxnTorn(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+
+	store.Set("othello", "marlowe")
+	store.Txn(func(tx *Txn) error {
+		tx.Set("othello", "shakespeare")
+		tx.Set("dune", "frank herbert")
+		return nil
+	})
+	store.Close()
+
+	// we crashed while writing the end of the transaction
+	if err := os.Truncate("test.db", fileSize(t, "test.db")-4); err != nil {
+		t.Fatalf("failed to truncate the file: %v", err)
+	}
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	tests := map[string]string{"othello": "marlowe", "dune": ""}
+	for key, val := range tests {
+		if got, _ := store.Get(key); got != val {
+			t.Errorf("Get() = %v, want %v", got, val)
+		}
+	}
+}
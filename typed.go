@@ -0,0 +1,130 @@
+package caskdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+)
+
+// Codec converts the values of type T to and from the strings which the store
+// keeps. The encoding of the keys must be deterministic, i.e. the same key must
+// always encode to the same string, or Get will not find what Set stored.
+type Codec[T any] interface {
+	Encode(v T) (string, error)
+	Decode(data string) (T, error)
+}
+
+// TypedStore is a thin layer over a DiskStore which stores the keys of type K and
+// the values of type V, encoding them with the given codecs. The file format does
+// not change, the store still sees only strings:
+//
+//	books := NewTypedStore[int64, Book](store, Int64Codec{}, GobCodec[Book]{})
+//	books.Set(42, Book{Title: "Othello", Author: "Shakespeare"})
+//	book, err := books.Get(42)
+type TypedStore[K comparable, V any] struct {
+	store  *DiskStore
+	keys   Codec[K]
+	values Codec[V]
+}
+
+// NewTypedStore creates the typed layer over the store. The store can still be
+// used directly, but the keys written through the TypedStore are only meaningful
+// to the codecs.
+func NewTypedStore[K comparable, V any](store *DiskStore, keys Codec[K], values Codec[V]) *TypedStore[K, V] {
+	return &TypedStore[K, V]{store: store, keys: keys, values: values}
+}
+
+// Get returns the value of the key, or ErrKeyNotFound if it does not exist.
+func (t *TypedStore[K, V]) Get(key K) (V, error) {
+	var zero V
+	k, err := t.keys.Encode(key)
+	if err != nil {
+		return zero, err
+	}
+	data, err := t.store.Get(k)
+	if err != nil {
+		return zero, err
+	}
+	return t.values.Decode(data)
+}
+
+// Set stores the value for the key.
+func (t *TypedStore[K, V]) Set(key K, value V) error {
+	k, err := t.keys.Encode(key)
+	if err != nil {
+		return err
+	}
+	data, err := t.values.Encode(value)
+	if err != nil {
+		return err
+	}
+	return t.store.Set(k, data)
+}
+
+// Delete removes the key from the store.
+func (t *TypedStore[K, V]) Delete(key K) error {
+	k, err := t.keys.Encode(key)
+	if err != nil {
+		return err
+	}
+	return t.store.Delete(k)
+}
+
+// StringCodec stores the strings as they are.
+type StringCodec struct{}
+
+func (StringCodec) Encode(v string) (string, error)    { return v, nil }
+func (StringCodec) Decode(data string) (string, error) { return data, nil }
+
+// Int64Codec stores the integers in 8 bytes, big endian, which takes less space
+// than their decimal form for the large numbers.
+type Int64Codec struct{}
+
+func (Int64Codec) Encode(v int64) (string, error) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(v))
+	return string(b[:]), nil
+}
+
+func (Int64Codec) Decode(data string) (int64, error) {
+	if len(data) != 8 {
+		return 0, fmt.Errorf("caskdb: cannot decode %d bytes as an int64", len(data))
+	}
+	return int64(binary.BigEndian.Uint64([]byte(data))), nil
+}
+
+// Uint64Codec stores the unsigned integers in 8 bytes, big endian.
+type Uint64Codec struct{}
+
+func (Uint64Codec) Encode(v uint64) (string, error) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	return string(b[:]), nil
+}
+
+func (Uint64Codec) Decode(data string) (uint64, error) {
+	if len(data) != 8 {
+		return 0, fmt.Errorf("caskdb: cannot decode %d bytes as a uint64", len(data))
+	}
+	return binary.BigEndian.Uint64([]byte(data)), nil
+}
+
+// GobCodec stores any value with encoding/gob. It suits the values, like structs,
+// better than the keys: gob does not promise the same bytes for the same value,
+// e.g. for maps.
+type GobCodec[T any] struct{}
+
+func (GobCodec[T]) Encode(v T) (string, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func (GobCodec[T]) Decode(data string) (T, error) {
+	var v T
+	err := gob.NewDecoder(bytes.NewBufferString(data)).Decode(&v)
+	return v, err
+}
@@ -0,0 +1,81 @@
+package caskdb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestTypedStore(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	type book struct {
+		Title  string
+		Author string
+	}
+	books := NewTypedStore[int64, book](store, Int64Codec{}, GobCodec[book]{})
+	if err := books.Set(42, book{"Othello", "Shakespeare"}); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	if err := books.Set(-7, book{"Dune", "Frank Herbert"}); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	if got, err := books.Get(42); err != nil || got != (book{"Othello", "Shakespeare"}) {
+		t.Errorf("Get() = (%v, %v), want Othello", got, err)
+	}
+	if got, _ := books.Get(-7); got.Title != "Dune" {
+		t.Errorf("Get() = %v, want Dune", got)
+	}
+	books.Delete(42)
+	if _, err := books.Get(42); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Get() error = %v, want %v", err, ErrKeyNotFound)
+	}
+
+	// the codecs of the common types round trip
+	if v, _ := (Uint64Codec{}).Encode(1 << 40); len(v) != 8 {
+		t.Errorf("Uint64Codec.Encode() = %v bytes, want 8", len(v))
+	}
+	if _, err := (Int64Codec{}).Decode("short"); err == nil {
+		t.Errorf("Int64Codec.Decode() of 5 bytes did not fail")
+	}
+	names := NewTypedStore[string, string](store, StringCodec{}, StringCodec{})
+	names.Set("othello", "shakespeare")
+	if val, _ := store.Get("othello"); val != "shakespeare" {
+		t.Errorf("Get() = %v, want %v", val, "shakespeare")
+	}
+}
+
+func TestTypedStore_SetLikeDiskStore(t *testing.T) {
+	entry := entryMemory("key0", KeyEntry{})
+	var evicted []string
+	onEvict := func(key string, reason EvictReason) {
+		evicted = append(evicted, key)
+	}
+	store, err := NewDiskStore("test.db", WithMaxIndexMemory(entry*3, IndexMemoryEvictOldest), WithOnEvict(onEvict))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+
+	// the keys evicted to make room for the typed writes are told about too
+	names := NewTypedStore[string, string](store, StringCodec{}, StringCodec{})
+	for i := 0; i < 4; i++ {
+		if err := names.Set(fmt.Sprint("key", i), "value"); err != nil {
+			t.Fatalf("Set() error = %v", err)
+		}
+	}
+	if len(evicted) == 0 || evicted[0] != "key0" {
+		t.Errorf("OnEvict() called with %v, want key0 first", evicted)
+	}
+
+	store.Close()
+	if err := names.Set("dune", "frank herbert"); !errors.Is(err, ErrClosed) {
+		t.Errorf("Set() after Close() error = %v, want %v", err, ErrClosed)
+	}
+}
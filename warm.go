@@ -0,0 +1,56 @@
+package caskdb
+
+import "sync"
+
+// WarmCache reads the records of the keys, so that the OS pulls them into its
+// page cache, and the first Get of each of them after a restart does not have to
+// wait for the disk. The records are read and their checksums verified, just like
+// Get does, but the values are thrown away. The keys which are not in the store
+// are skipped.
+//
+// The reads run concurrently, one goroutine per descriptor of WithReaderPool, or a
+// single one without a pool, so WarmCache never opens descriptors of its own. It
+// holds the read lock till all the reads are done, and returns the first error,
+// once it has gone through all of the keys.
+func (d *DiskStore) WarmCache(keys []string) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return ErrClosed
+	}
+	if d.opts.noIndex {
+		return ErrNoIndex
+	}
+	workers := len(d.readers)
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(keys) {
+		workers = len(keys)
+	}
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	next := make(chan string)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range next {
+				kEntry, ok := d.lookup(key)
+				if !ok {
+					continue
+				}
+				if _, err := d.readEntry(key, kEntry); err != nil {
+					once.Do(func() { firstErr = err })
+				}
+			}
+		}()
+	}
+	for _, key := range keys {
+		next <- key
+	}
+	close(next)
+	wg.Wait()
+	return firstErr
+}
@@ -0,0 +1,44 @@
+package caskdb
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestDiskStore_WarmCache(t *testing.T) {
+	store, err := NewDiskStore("test.db", WithReaderPool(4))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	var keys []string
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		store.Set(key, "value")
+		keys = append(keys, key)
+	}
+	if err := store.WarmCache(append(keys, "missing")); err != nil {
+		t.Errorf("WarmCache() error = %v", err)
+	}
+	if err := store.WarmCache(nil); err != nil {
+		t.Errorf("WarmCache() of no keys error = %v", err)
+	}
+
+	// a damaged record is reported
+	kEntry := store.keyDir["key-0"]
+	file, err := os.OpenFile("test.db", os.O_WRONLY, 0666)
+	if err != nil {
+		t.Fatalf("failed to open the file: %v", err)
+	}
+	_, err = file.WriteAt([]byte("X"), int64(kEntry.position+kEntry.totalSize-1))
+	file.Close()
+	if err != nil {
+		t.Fatalf("failed to damage the record: %v", err)
+	}
+	if err := store.WarmCache(keys); err == nil {
+		t.Errorf("WarmCache() of a damaged record did not fail")
+	}
+}